@@ -8,7 +8,6 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
-	log "github.com/Sirupsen/logrus"
 	"math/big"
 	"net"
 	"os"
@@ -32,28 +31,28 @@ func serverTLSCert(bind string) tls.Certificate {
 		// create new cert, write to files
 		cn, _, err := net.SplitHostPort(bind)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"at":    "serverTLSPair",
-				"error": err.Error(),
-			}).Fatal("invalid bind")
+			fatal("invalid bind",
+				"at", "serverTLSPair",
+				"error", err,
+			)
 		}
 		cert_data, key_data := selfSignedCert(cn)
 		cert_file, err := os.OpenFile(crt_filename, os.O_CREATE|os.O_WRONLY, 0600)
 		if err != nil {
-			log.Fatal(err)
+			fatal("unable to create certificate file", "error", err)
 		}
 		cert_file.Write(cert_data)
 		cert_file.Close()
 		key_file, err := os.OpenFile(key_filename, os.O_CREATE|os.O_WRONLY, 0600)
 		if err != nil {
-			log.Fatal(err)
+			fatal("unable to create key file", "error", err)
 		}
 		key_file.Write(key_data)
 		key_file.Close()
 	}
 	certificate, err := tls.LoadX509KeyPair(crt_filename, key_filename)
 	if err != nil {
-		log.Fatal(err)
+		fatal("unable to load certificate", "error", err)
 	}
 	return certificate
 }
@@ -62,7 +61,7 @@ func randomSerial() *big.Int {
 	serial_number_limit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serial_number, err := rand.Int(rand.Reader, serial_number_limit)
 	if err != nil {
-		log.Fatalf("failed to generate serial number for self signed certificate: %s", err)
+		fatal("failed to generate serial number for self signed certificate", "error", err)
 	}
 	return serial_number
 }
@@ -87,21 +86,21 @@ func selfSignedCert(cn string) (cert_data []byte, key_data []byte) {
 	// Generate key
 	priv, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		log.Fatalf("failed to generate private key for self signed certificate: %s", err)
+		fatal("failed to generate private key for self signed certificate", "error", err)
 	}
 	pub := &priv.PublicKey
 
 	// Create Certificate
 	cert_der, err := x509.CreateCertificate(rand.Reader, ca, ca, pub, priv)
 	if err != nil {
-		log.Fatalf("failed to create self signed certificate: %s", err)
+		fatal("failed to create self signed certificate", "error", err)
 	}
 
 	// Create PEM encoding of certificate
 	var cert_buffer bytes.Buffer
 	err = pem.Encode(&cert_buffer, &pem.Block{Type: "CERTIFICATE", Bytes: cert_der})
 	if err != nil {
-		log.Fatalf("could not PEM encode certificate data: %s", err)
+		fatal("could not PEM encode certificate data", "error", err)
 	}
 	cert_data = cert_buffer.Bytes()
 
@@ -109,7 +108,7 @@ func selfSignedCert(cn string) (cert_data []byte, key_data []byte) {
 	var key_buffer bytes.Buffer
 	err = pem.Encode(&key_buffer, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
 	if err != nil {
-		log.Fatalf("could not PEM encode key data: %s", err)
+		fatal("could not PEM encode key data", "error", err)
 	}
 	key_data = key_buffer.Bytes()
 
@@ -2,46 +2,47 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	log "github.com/Sirupsen/logrus"
 	"github.com/hkparker/imux"
+	"github.com/quic-go/quic-go"
 	"net"
+	"net/url"
 	"os"
 	"reflect"
 	"strings"
+	"time"
 )
 
-// Dial the TLS server specified in the dial address and
+// Fetch the certificate of the server specified in the dial address and
 // perform Trust Of First Use, interactively checking if
 // the presented certificate is safe and if it should be
 // saved in ~/.imux/known_hosts or if the connection
 // should be aborted.
-func TOFU(dial string) *x509.Certificate {
+func TOFU(dial string, fetch func(string) (*x509.Certificate, error)) *x509.Certificate {
 	known_hosts := LoadKnownHosts()
-	conn, err := tls.Dial(
-		"tcp",
-		dial,
-		&tls.Config{InsecureSkipVerify: true},
-	)
+	cert, err := fetch(dial)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"at":    "TOFU",
-			"error": err.Error(),
-		}).Fatal("unable to dial server")
+		fatal("unable to dial server",
+			"at", "TOFU",
+			"error", err,
+		)
 	}
-	signature := SHA256Sig(conn)
+	signature := SHA256Sig(cert)
 
 	if saved_signature, present := known_hosts[dial]; present {
 		if signature != saved_signature {
 			connect, update := MitMWarning(signature, saved_signature)
 			if !connect {
-				log.WithFields(log.Fields{
-					"at": "TOFU",
-				}).Fatal("TLS certificate mismatch")
+				fatal("TLS certificate mismatch",
+					"at", "TOFU",
+				)
 			}
 			if update {
 				AppendHost(dial, signature)
@@ -50,57 +51,160 @@ func TOFU(dial string) *x509.Certificate {
 	} else {
 		connect, save_cert := TrustDialog(dial, signature)
 		if !connect {
-			log.WithFields(log.Fields{
-				"at": "TOFU",
-			}).Fatal("TLS certificate rejected by user")
+			fatal("TLS certificate rejected by user",
+				"at", "TOFU",
+			)
 		} else if save_cert {
 			AppendHost(dial, signature)
 		}
 	}
 
-	return conn.ConnectionState().PeerCertificates[0]
+	return cert
+}
+
+// Create a function that dials the TLS server at the dial address with
+// the dialer and returns its certificate without verifying it
+func createTLSCertificateFetcher(dialer proxyDialer) func(string) (*x509.Certificate, error) {
+	return func(dial string) (*x509.Certificate, error) {
+		conn, err := dialTLS(dialer, dial)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0], nil
+	}
+}
+
+// Dial the TLS server at the dial address with the dialer, without
+// verifying its certificate, giving up after dialTimeout
+func dialTLS(dialer proxyDialer, dial string) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	conn, err := dialer(ctx, dial)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(dial)
+	tls_conn := tls.Client(conn, &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         host,
+	})
+	if err := tls_conn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tls_conn, nil
+}
+
+// Dial the QUIC server at the dial address and return its certificate
+// without verifying it
+func fetchQUICCertificate(dial string) (*x509.Certificate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(
+		ctx,
+		dial,
+		&tls.Config{InsecureSkipVerify: true, NextProtos: []string{imux.QUICProtocol}},
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.CloseWithError(0, "")
+	return conn.ConnectionState().TLS.PeerCertificates[0], nil
+}
+
+// Create a QUIC transport that dials the server at the dial address,
+// accepting only the certificate trusted on first use
+func createQUICTransport(dial string, cert *x509.Certificate) *imux.QUICTransport {
+	return &imux.QUICTransport{
+		Address:   dial,
+		TLSConfig: pinnedTLSConfig(cert),
+		Logger:    logger,
+	}
+}
+
+// Create a WebSocket transport that sends upgrades to the path on the
+// server at the dial address through each bind's proxy, accepting only
+// the certificate trusted on first use
+func createWebSocketTransport(dial, path string, cert *x509.Certificate, proxies map[string]*url.URL) *imux.WebSocketTransport {
+	return &imux.WebSocketTransport{
+		URL:       "wss://" + dial + path,
+		TLSConfig: pinnedTLSConfig(cert),
+		Redialers: createProxyRedialerGenerator(dial, proxies),
+		Logger:    logger,
+	}
+}
+
+// Create a TLS config that only accepts the certificate trusted on first
+// use
+func pinnedTLSConfig(cert *x509.Certificate) *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw_certs [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw_certs) == 0 || !bytes.Equal(raw_certs[0], cert.Raw) {
+				return errors.New("server certificate does not match the trusted certificate")
+			}
+			return nil
+		},
+	}
 }
 
-// Parse the listen address and return a TCP listsner
-func createClientListener(listen string) net.Listener {
-	listener, err := net.Listen("tcp", listen)
+// Parse the listen address and return a TCP listsner, or a unix domain
+// socket listener with the socket mode for unix: addresses
+func createClientListener(listen string, socket_mode os.FileMode) net.Listener {
+	network, address := splitNetworkAddress(listen)
+	var listener net.Listener
+	var err error
+	if network == "unix" {
+		listener, err = listenUnix(address, socket_mode)
+	} else {
+		listener, err = net.Listen(network, address)
+	}
 	if err != nil {
-		log.WithFields(log.Fields{
-			"at":      "createClientListener",
-			"address": listen,
-			"error":   err.Error(),
-		}).Fatal("unable to open client listener")
+		fatal("unable to open client listener",
+			"at", "createClientListener",
+			"address", listen,
+			"error", err,
+		)
 	}
 	return listener
 }
 
 // Create a function that accepts bind address and returns imux.Redialer
-// functions that bind to that address and dial the specified dial address
-func createRedailerGenerator(dial string, cert *x509.Certificate) imux.RedialerGenerator {
+// functions that bind to that address and dial the specified dial address,
+// through the bind's proxy if it has one
+func createRedailerGenerator(dial string, cert *x509.Certificate, proxies map[string]*url.URL) imux.RedialerGenerator {
 	return func(bind string) imux.Redialer {
+		dialer := createProxyDialer(bind, proxies[bind])
 		return func() (net.Conn, error) {
-			bind_addr, err := net.ResolveTCPAddr("tcp", bind+":0")
-			if err != nil {
-				log.WithFields(log.Fields{
-					"at":      "createRedialerGenerator",
-					"address": bind,
-					"error":   err.Error(),
-				}).Error("error parsing bind address")
-			}
-			conn, err := tls.DialWithDialer(
-				&net.Dialer{
-					LocalAddr: bind_addr,
-				},
-				"tcp",
-				dial,
-				&tls.Config{InsecureSkipVerify: true},
-			)
+			conn, err := dialTLS(dialer, dial)
 			if err != nil {
+				logger.Error("error dialing server",
+					"at", "createRedialerGenerator",
+					"address", bind,
+					"error", err,
+				)
+				return nil, err
 			}
 			if !reflect.DeepEqual(cert.Signature, conn.ConnectionState().PeerCertificates[0].Signature) {
-				log.Error("holy shit")
+				logger.Error("holy shit")
 			}
-			return conn, err
+			return conn, nil
+		}
+	}
+}
+
+// Create a function that accepts bind address and returns imux.Redialer
+// functions that dial the specified dial address without TLS, through the
+// bind's proxy if it has one
+func createProxyRedialerGenerator(dial string, proxies map[string]*url.URL) imux.RedialerGenerator {
+	return func(bind string) imux.Redialer {
+		dialer := createProxyDialer(bind, proxies[bind])
+		return func() (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+			defer cancel()
+			return dialer(ctx, dial)
 		}
 	}
 }
@@ -117,7 +221,7 @@ func LoadKnownHosts() map[string]string {
 	known_hosts, err := os.Open(filename)
 	defer known_hosts.Close()
 	if err != nil {
-		log.Fatal(err)
+		fatal("unable to open known hosts", "error", err)
 	}
 	scanner := bufio.NewScanner(known_hosts)
 	for scanner.Scan() {
@@ -159,7 +263,7 @@ func AppendHost(hostname string, signature string) {
 	filename := os.Getenv("HOME") + "/.imux/known_hosts"
 	known_hosts, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0600)
 	if err != nil {
-		log.Fatal(err)
+		fatal("unable to append to known hosts", "error", err)
 	}
 	known_hosts.WriteString(hostname + " " + signature + "\n")
 	known_hosts.Close()
@@ -193,8 +297,8 @@ func TrustDialog(hostname, signature string) (bool, bool) {
 	return connect, save
 }
 
-func SHA256Sig(conn *tls.Conn) string {
-	sig := conn.ConnectionState().PeerCertificates[0].Signature
+func SHA256Sig(cert *x509.Certificate) string {
+	sig := cert.Signature
 	sha := sha256.Sum256(sig)
 	str := hex.EncodeToString(sha[:])
 	return str
@@ -3,59 +3,193 @@ package main
 import (
 	"encoding/json"
 	"flag"
-	log "github.com/Sirupsen/logrus"
 	"github.com/hkparker/imux"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var client bool
 var binds string
+var proxies string
 var server bool
 var listen string
 var dial string
+var socket_mode string
+var transport string
+var socks5 bool
+var websocket_path string
 var chunk_size int
+var stream_window int
+var compression string
+var parity int
+var duplicates int
+var heartbeat_interval time.Duration
+var heartbeat_timeout time.Duration
+var redial_backoff time.Duration
 var debug bool
 
+// The level of the CLI's logger, debug with -debug and warn otherwise
+var log_level = new(slog.LevelVar)
+
+// Where the CLI and the imux client or server log
+var logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: log_level}))
+
 func main() {
 	flag.BoolVar(&client, "client", false, "create an imux client")
-	flag.StringVar(&binds, "binds", "{\"0.0.0.0\": 10}", "JSON encoding of map from bind address strings to int counts")
+	flag.StringVar(&binds, "binds", "{\"0.0.0.0\": 10}", "JSON encoding of map from bind address strings, or interface names with quic, to int counts")
+	flag.StringVar(&proxies, "proxies", "{}", "JSON encoding of map from bind address strings to the http:// or socks5:// proxy URLs clients dial through from them, with optional user:password")
 	flag.BoolVar(&server, "server", false, "create an imux server")
-	flag.StringVar(&listen, "listen", "0.0.0.0:443", "listener address and port for clients to imux out and servers to imux in")
-	flag.StringVar(&dial, "dial", "127.0.0.1:443", "dial address and port for clients to dial servers and servers to dial out")
-	flag.IntVar(&chunk_size, "chunk-size", 16384, "maximum number of bytes per chunk")
+	flag.StringVar(&listen, "listen", "0.0.0.0:443", "listener address and port for clients to imux out and servers to imux in, or unix:/path for clients to listen on a unix domain socket")
+	flag.StringVar(&dial, "dial", "127.0.0.1:443", "dial address and port for clients to dial servers and servers to dial out, or unix:/path for servers to dial a unix domain socket")
+	flag.StringVar(&socket_mode, "socket-mode", "0600", "octal permissions of the unix domain socket clients listen on")
+	flag.StringVar(&transport, "transport", "tls", "transport carrying imux sockets between clients and servers, tls, quic or websocket")
+	flag.BoolVar(&socks5, "socks5", false, "clients speak SOCKS5 on their listener and servers dial the addresses clients request, instead of only the dial address")
+	flag.StringVar(&websocket_path, "websocket-path", "/imux", "path websocket clients send upgrades to and servers accept them on, alongside tls clients")
+	flag.IntVar(&chunk_size, "chunk-size", 16384, "maximum number of bytes per chunk, lowered to the peer's maximum if it is smaller")
+	flag.IntVar(&stream_window, "stream-window", 1048576, "maximum number of bytes buffered per socket while waiting to write it out")
+	flag.StringVar(&compression, "compression", "none", "chunk compression algorithm to negotiate, none or deflate")
+	flag.IntVar(&parity, "parity", 0, "number of chunks covered by each XOR parity chunk, up to 16, or 0 to disable parity")
+	flag.IntVar(&duplicates, "duplicates", 1, "number of distinct binds each chunk is sent over at once, up to 4")
+	flag.DurationVar(&heartbeat_interval, "heartbeat-interval", 5*time.Second, "how often each transport socket is pinged")
+	flag.DurationVar(&heartbeat_timeout, "heartbeat-timeout", 15*time.Second, "how long a transport socket may go without answering pings before it is redialed")
+	flag.DurationVar(&redial_backoff, "redial-backoff", 10*time.Second, "how long to wait before redialing a failed transport socket, doubled for each failure in a row")
 	flag.BoolVar(&debug, "debug", false, "debug logging")
 	flag.Parse()
 	validateFlags()
+	options := createOptions()
 
 	if server {
-		imux.ManyToOne(
-			createServerListener(listen),
-			createDestinationDialer(dial),
+		imux_server, err := imux.NewServerWithOptions(createDestinationDialer(dial), options)
+		if err != nil {
+			fatal("unable to create imux server", "error", err)
+		}
+		imux_server.Logger = logger
+		if socks5 {
+			imux_server.DialAddress = createAddressDialer()
+		}
+		if transport == "quic" {
+			err = imux_server.ServeTransport(createQUICServerListener(listen))
+		} else if transport == "websocket" {
+			err = imux_server.ServeTransport(createWebSocketServerListener(listen, websocket_path))
+		} else {
+			err = imux_server.Serve(createServerListener(listen))
+		}
+		logger.Error("imux server failed",
+			"at", "main",
+			"error", err,
 		)
 	} else if client {
-		imux.MaxChunkDataSize = chunk_size
 		bind_map := make(map[string]int)
 		err := json.Unmarshal([]byte(binds), &bind_map)
 		if err != nil {
-			log.Fatal("invalid binds option")
+			fatal("invalid binds option")
+		}
+		proxy_map := parseProxies(proxies)
+		first_bind := firstBind(bind_map)
+		fetch_cert := createTLSCertificateFetcher(createProxyDialer(first_bind, proxy_map[first_bind]))
+		if transport == "quic" {
+			fetch_cert = fetchQUICCertificate
 		}
-		good_cert := TOFU(dial)
-		imux.OneToMany(
-			createClientListener(listen),
+		good_cert := TOFU(dial, fetch_cert)
+		imux_client, err := imux.NewClientWithOptions(
 			bind_map,
-			createRedailerGenerator(dial, good_cert),
+			createRedailerGenerator(dial, good_cert, proxy_map),
+			options,
 		)
+		if err != nil {
+			fatal("unable to create imux client", "error", err)
+		}
+		imux_client.Logger = logger
+		imux_client.SOCKS5 = socks5
+		if transport == "quic" {
+			imux_client.Transport = createQUICTransport(dial, good_cert)
+		} else if transport == "websocket" {
+			imux_client.Transport = createWebSocketTransport(dial, websocket_path, good_cert, proxy_map)
+		}
+		imux_client.Serve(createClientListener(listen, parseSocketMode(socket_mode)))
+	}
+}
+
+// Parse the octal permissions of a unix domain socket, exiting if they
+// are invalid
+func parseSocketMode(socket_mode string) os.FileMode {
+	mode, err := strconv.ParseUint(socket_mode, 8, 32)
+	if err != nil || mode > 0777 {
+		fatal("socket mode must be octal permissions such as 0600")
+	}
+	return os.FileMode(mode)
+}
+
+// Return the bind that sorts first, which the server's certificate is
+// fetched from
+func firstBind(bind_map map[string]int) string {
+	first := ""
+	for bind := range bind_map {
+		if first == "" || bind < first {
+			first = bind
+		}
 	}
+	return first
+}
+
+// Build the imux options from the flags, exiting if they are invalid
+func createOptions() imux.Options {
+	algorithm, err := imux.ParseCompression(compression)
+	if err != nil {
+		fatal("invalid compression", "error", err)
+	}
+	options := imux.DefaultOptions()
+	options.ChunkSize = chunk_size
+	options.StreamWindowSize = stream_window
+	options.Compression = algorithm
+	options.ParityInterval = parity
+	options.DuplicateSends = duplicates
+	options.HeartbeatInterval = heartbeat_interval
+	options.HeartbeatTimeout = heartbeat_timeout
+	options.RedialBackoff = redial_backoff
+	if options.MaxRedialBackoff < redial_backoff {
+		options.MaxRedialBackoff = redial_backoff
+	}
+	if err := options.Validate(); err != nil {
+		fatal("invalid options", "error", err)
+	}
+	return options
 }
 
 func validateFlags() {
+	if debug {
+		log_level.Set(slog.LevelDebug)
+	} else {
+		log_level.Set(slog.LevelWarn)
+	}
+	slog.SetDefault(logger)
 	if client && server {
-		log.Fatal("cannot be in client and server mode at the same time")
+		fatal("cannot be in client and server mode at the same time")
 	} else if !client && !server {
-		log.Fatal("must be in client mode or server mode")
+		fatal("must be in client mode or server mode")
 	}
-	if debug {
-		log.SetLevel(log.DebugLevel)
-	} else {
-		log.SetLevel(log.WarnLevel)
+	if transport != "tls" && transport != "quic" && transport != "websocket" {
+		fatal("transport must be tls, quic or websocket")
+	}
+	if server && strings.HasPrefix(listen, unixPrefix) {
+		fatal("servers cannot listen on a unix domain socket")
+	}
+	if client && strings.HasPrefix(dial, unixPrefix) {
+		fatal("clients cannot dial servers over a unix domain socket")
 	}
+	if transport == "quic" && len(parseProxies(proxies)) > 0 {
+		fatal("proxies cannot carry the quic transport")
+	}
+	if transport == "websocket" && !strings.HasPrefix(websocket_path, "/") {
+		fatal("websocket path must start with /")
+	}
+}
+
+// Log an error and exit
+func fatal(message string, args ...any) {
+	logger.Error(message, args...)
+	os.Exit(1)
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// How long dialing the server may take, including the handshakes with a
+// proxy and the TLS handshake after it
+var dialTimeout = 30 * time.Second
+
+// A function that dials an address from a bind, through that bind's
+// proxy if it has one, until ctx is done
+type proxyDialer func(context.Context, string) (net.Conn, error)
+
+// Parse the JSON encoding of a map from bind address strings to proxy
+// URLs, exiting if any proxy is invalid
+func parseProxies(proxies string) map[string]*url.URL {
+	proxy_map := make(map[string]string)
+	err := json.Unmarshal([]byte(proxies), &proxy_map)
+	if err != nil {
+		fatal("invalid proxies option")
+	}
+	proxy_urls := make(map[string]*url.URL)
+	for bind, proxy_url := range proxy_map {
+		parsed, err := url.Parse(proxy_url)
+		if err != nil {
+			fatal("invalid proxy URL",
+				"at", "parseProxies",
+				"bind", bind,
+				"error", err,
+			)
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "socks5" {
+			fatal("proxy URL scheme must be http or socks5",
+				"at", "parseProxies",
+				"bind", bind,
+			)
+		}
+		if parsed.Port() == "" {
+			fatal("proxy URL must include a port",
+				"at", "parseProxies",
+				"bind", bind,
+			)
+		}
+		proxy_urls[bind] = parsed
+	}
+	return proxy_urls
+}
+
+// Create a function that dials addresses from the bind address, through
+// an HTTP CONNECT or SOCKS5 proxy unless proxy_url is nil
+func createProxyDialer(bind string, proxy_url *url.URL) proxyDialer {
+	return func(ctx context.Context, address string) (net.Conn, error) {
+		bind_addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(bind, "0"))
+		if err != nil {
+			return nil, err
+		}
+		dialer := &net.Dialer{
+			LocalAddr: bind_addr,
+		}
+		if proxy_url == nil {
+			return dialer.DialContext(ctx, "tcp", address)
+		}
+		if proxy_url.Scheme == "socks5" {
+			return dialSOCKS5(ctx, dialer, proxy_url, address)
+		}
+		return dialHTTPConnect(ctx, dialer, proxy_url, address)
+	}
+}
+
+// Dial an address through a SOCKS5 proxy, authenticating with the
+// username and password in the proxy URL if there are any
+func dialSOCKS5(ctx context.Context, dialer *net.Dialer, proxy_url *url.URL, address string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if proxy_url.User != nil {
+		password, _ := proxy_url.User.Password()
+		auth = &proxy.Auth{
+			User:     proxy_url.User.Username(),
+			Password: password,
+		}
+	}
+	socks, err := proxy.SOCKS5("tcp", proxy_url.Host, auth, dialer)
+	if err != nil {
+		return nil, err
+	}
+	return socks.(proxy.ContextDialer).DialContext(ctx, "tcp", address)
+}
+
+// Dial an address through an HTTP proxy with a CONNECT request, using
+// basic auth with the username and password in the proxy URL if there
+// are any
+func dialHTTPConnect(ctx context.Context, dialer *net.Dialer, proxy_url *url.URL, address string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", proxy_url.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if proxy_url.User != nil {
+		password, _ := proxy_url.User.Password()
+		credentials := proxy_url.User.Username() + ":" + password
+		request.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	if err := request.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT to %s: %s", address, response.Status)
+	}
+	if reader.Buffered() > 0 {
+		conn.Close()
+		return nil, errors.New("proxy sent data before the tunnel was established")
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Listen on loopback, handling each connection with handle until the
+// test finishes
+func serveProxy(t *testing.T, handle func(net.Conn)) *url.URL {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return &url.URL{Host: listener.Addr().String()}
+}
+
+// Write a line through a tunnel and check it is echoed back
+func expectEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("through the tunnel\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "through the tunnel\n" {
+		t.Fatalf("expected the tunnel to echo the line, read %q, %v", line, err)
+	}
+}
+
+func TestDialHTTPConnect(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	proxy_url := serveProxy(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		requests <- request
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		io.Copy(conn, reader)
+	})
+	proxy_url.Scheme = "http"
+	proxy_url.User = url.UserPassword("user", "secret")
+
+	conn, err := createProxyDialer("127.0.0.1", proxy_url)(context.Background(), "server.example:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := <-requests
+	if request.Method != http.MethodConnect || request.Host != "server.example:443" {
+		t.Fatalf("expected a CONNECT to server.example:443, got %s %s", request.Method, request.Host)
+	}
+	credentials := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	if auth := request.Header.Get("Proxy-Authorization"); auth != "Basic "+credentials {
+		t.Fatalf("expected basic auth for user, got %q", auth)
+	}
+	expectEcho(t, conn)
+}
+
+func TestDialHTTPConnectRefused(t *testing.T) {
+	proxy_url := serveProxy(t, func(conn net.Conn) {
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		}
+	})
+	proxy_url.Scheme = "http"
+	_, err := createProxyDialer("127.0.0.1", proxy_url)(context.Background(), "server.example:443")
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Fatalf("expected the refused CONNECT to fail with its status, got %v", err)
+	}
+}
+
+func TestDialHTTPConnectTimeout(t *testing.T) {
+	proxy_url := serveProxy(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+	proxy_url.Scheme = "http"
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := createProxyDialer("127.0.0.1", proxy_url)(ctx, "server.example:443")
+	if net_err, ok := err.(net.Error); !ok || !net_err.Timeout() {
+		t.Fatalf("expected a proxy that never answers to time out, got %v", err)
+	}
+}
+
+func TestDialSOCKS5(t *testing.T) {
+	targets := make(chan string, 1)
+	proxy_url := serveProxy(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		// Greeting, answered by choosing username and password auth
+		greeting := make([]byte, 2)
+		if _, err := io.ReadFull(reader, greeting); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(reader, make([]byte, greeting[1])); err != nil {
+			return
+		}
+		conn.Write([]byte{5, 2})
+		// Username and password
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return
+		}
+		username := make([]byte, header[1])
+		io.ReadFull(reader, username)
+		length, _ := reader.ReadByte()
+		password := make([]byte, length)
+		io.ReadFull(reader, password)
+		if string(username) != "user" || string(password) != "secret" {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+		// Connect request for a domain name
+		request := make([]byte, 5)
+		if _, err := io.ReadFull(reader, request); err != nil || request[3] != 3 {
+			return
+		}
+		host := make([]byte, request[4])
+		io.ReadFull(reader, host)
+		port := make([]byte, 2)
+		io.ReadFull(reader, port)
+		targets <- net.JoinHostPort(string(host), "443")
+		conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+		io.Copy(conn, reader)
+	})
+	proxy_url.Scheme = "socks5"
+	proxy_url.User = url.UserPassword("user", "secret")
+
+	conn, err := createProxyDialer("127.0.0.1", proxy_url)(context.Background(), "server.example:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if target := <-targets; target != "server.example:443" {
+		t.Fatalf("expected the proxy to be asked for server.example:443, got %s", target)
+	}
+	expectEcho(t, conn)
+}
+
+func TestDialTLSHandshakeTimeout(t *testing.T) {
+	timeout := dialTimeout
+	dialTimeout = 50 * time.Millisecond
+	defer func() { dialTimeout = timeout }()
+	// A proxy that opens the tunnel but the server behind it never
+	// answers the TLS handshake
+	proxy_url := serveProxy(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		if _, err := http.ReadRequest(reader); err == nil {
+			io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			io.Copy(io.Discard, reader)
+		}
+	})
+	proxy_url.Scheme = "http"
+
+	failed := make(chan error, 1)
+	go func() {
+		_, err := dialTLS(createProxyDialer("127.0.0.1", proxy_url), "server.example:443")
+		failed <- err
+	}()
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Fatal("expected the TLS handshake to fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("TLS handshake through the proxy was not given a deadline")
+	}
+}
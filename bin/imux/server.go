@@ -2,8 +2,9 @@ package main
 
 import (
 	"crypto/tls"
-	log "github.com/Sirupsen/logrus"
+	"github.com/hkparker/imux"
 	"net"
+	"time"
 )
 
 // Create a new listener to accept transport imux sockets
@@ -19,19 +20,73 @@ func createServerListener(listen string) net.Listener {
 		},
 	)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"at":    "createServerListener",
-			"bind":  listen,
-			"error": err.Error(),
-		}).Fatal("unable to start server listener")
+		fatal("unable to start server listener",
+			"at", "createServerListener",
+			"bind", listen,
+			"error", err,
+		)
 	}
 	return listener
 }
 
-// Return a function that when called dials the specified address
-// and returns the new connection
+// Create a new QUIC listener to accept transport imux sockets
+func createQUICServerListener(listen string) imux.TransportListener {
+	certificate := serverTLSCert(listen)
+	transport := &imux.QUICTransport{
+		ListenAddress: listen,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{
+				certificate,
+			},
+		},
+		Logger: logger,
+	}
+	listener, err := transport.Listen()
+	if err != nil {
+		fatal("unable to start QUIC server listener",
+			"at", "createQUICServerListener",
+			"bind", listen,
+			"error", err,
+		)
+	}
+	return listener
+}
+
+// Create a new listener to accept transport imux sockets over WebSockets
+// upgraded on the path, alongside plain TLS ones
+func createWebSocketServerListener(listen, path string) imux.TransportListener {
+	transport := &imux.WebSocketTransport{
+		Path:     path,
+		Listener: createServerListener(listen),
+		Logger:   logger,
+	}
+	listener, err := transport.Listen()
+	if err != nil {
+		fatal("unable to start WebSocket server listener",
+			"at", "createWebSocketServerListener",
+			"bind", listen,
+			"error", err,
+		)
+	}
+	return listener
+}
+
+// Return a function that when called dials the specified address, a TCP
+// address or a unix: domain socket path, and returns the new connection
 func createDestinationDialer(dial string) func() (net.Conn, error) {
+	network, address := splitNetworkAddress(dial)
 	return func() (net.Conn, error) {
-		return net.Dial("tcp", dial)
+		return net.Dial(network, address)
+	}
+}
+
+// Return a function that dials the addresses SOCKS5 clients request,
+// resolving host names on the server
+func createAddressDialer() func(string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+	}
+	return func(address string) (net.Conn, error) {
+		return dialer.Dial("tcp", address)
 	}
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Prefix of addresses naming a unix domain socket instead of a TCP address
+const unixPrefix = "unix:"
+
+// Pattern of the private directory a unix domain socket is created in,
+// whose random suffix is at most 10 digits long
+const privateSocketDir = ".imux-"
+
+// Longest path a unix domain socket can be created at, sun_path less its
+// terminating NUL, which is 108 bytes on Linux and 104 elsewhere
+func maxUnixPath() int {
+	if runtime.GOOS == "linux" {
+		return 107
+	}
+	return 103
+}
+
+// Split an address into the network and address to dial or listen on,
+// unix for addresses starting with unix: and tcp for the rest
+func splitNetworkAddress(address string) (string, string) {
+	if strings.HasPrefix(address, unixPrefix) {
+		return "unix", strings.TrimPrefix(address, unixPrefix)
+	}
+	return "tcp", address
+}
+
+// Listen on the unix domain socket at path, removing a stale socket left
+// there by a process that exited without cleaning up, and restrict the
+// socket to mode.  Paths that hold anything other than a socket, or a
+// socket something is still listening on, are left alone.  The socket is
+// created inside a private directory and only moved to path once it has
+// its mode, so nothing can connect to it before then.  That directory is
+// made beside path, so path's directory must be writable and short
+// enough for the socket's longer path inside it.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	longest := filepath.Join(filepath.Dir(path), privateSocketDir+"0123456789", "socket")
+	if limit := maxUnixPath(); len(path) > limit || len(longest) > limit {
+		return nil, fmt.Errorf("socket path is too long, unix domain sockets are limited to %d bytes and this one is first created %d bytes deep in a directory beside it", limit, len(longest))
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New("path exists and is not a socket")
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.New("socket is already in use")
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	private, err := os.MkdirTemp(filepath.Dir(path), privateSocketDir)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(private)
+	created := filepath.Join(private, "socket")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: created, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(created, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(created, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: listener, path: path}, nil
+}
+
+// A listener on a unix domain socket that was moved after it was created,
+// removing the socket from where it was moved to when closed
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (listener *unixListener) Close() error {
+	os.Remove(listener.path)
+	return listener.UnixListener.Close()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListenUnixMode(t *testing.T) {
+	directory := t.TempDir()
+	path := filepath.Join(directory, "imux.sock")
+	listener, err := listenUnix(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected a socket with mode 0600, got %v", info.Mode())
+	}
+	if entries, _ := os.ReadDir(directory); len(entries) != 1 {
+		t.Fatalf("expected the private directory to be removed, found %d entries", len(entries))
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	listener.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected closing the listener to remove the socket, got %v", err)
+	}
+}
+
+func TestListenUnixRemovesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "imux.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnix(path, 0600)
+	if err != nil {
+		t.Fatalf("expected the stale socket to be replaced, got %v", err)
+	}
+	listener.Close()
+}
+
+func TestListenUnixLeavesPathsInUse(t *testing.T) {
+	directory := t.TempDir()
+	active := filepath.Join(directory, "active.sock")
+	listener, err := net.Listen("unix", active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if _, err := listenUnix(active, 0600); err == nil {
+		t.Fatal("expected a socket still being listened on to be left alone")
+	}
+
+	file := filepath.Join(directory, "file")
+	if err := os.WriteFile(file, []byte("not a socket"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(file, 0600); err == nil {
+		t.Fatal("expected a path holding a file to be left alone")
+	}
+	if contents, _ := os.ReadFile(file); string(contents) != "not a socket" {
+		t.Fatal("expected the file to be untouched")
+	}
+}
+
+func TestListenUnixPathTooLong(t *testing.T) {
+	directory := t.TempDir()
+	nested := filepath.Join(directory, strings.Repeat("d", maxUnixPath()-len(directory)-20))
+	if err := os.Mkdir(nested, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// Short enough to be a socket path, but not once it is inside the
+	// private directory
+	path := filepath.Join(nested, "s")
+	if len(path) > maxUnixPath() {
+		t.Fatalf("test path is %d bytes, longer than intended", len(path))
+	}
+	_, err := listenUnix(path, 0600)
+	if err == nil || !strings.Contains(err.Error(), "too long") {
+		t.Fatalf("expected the socket path to be rejected as too long, got %v", err)
+	}
+	if entries, _ := os.ReadDir(nested); len(entries) != 0 {
+		t.Fatalf("expected nothing to be created, found %d entries", len(entries))
+	}
+}
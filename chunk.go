@@ -2,7 +2,6 @@ package imux
 
 import (
 	"encoding/json"
-	log "github.com/Sirupsen/logrus"
 	"github.com/hkparker/TLJ"
 )
 
@@ -10,31 +9,57 @@ import (
 // socket on the client side and a socket on the server size.  A
 // session ID defines sockets that are part of one imux session,
 // while the socket ID specifies which socket a chunk should queue
-// into, ordered by the Sequence ID.
+// into, ordered by the Sequence ID.  Compression is the algorithm
+// Data was compressed with, Parity marks a parity chunk for the group
+// of chunks starting at the Sequence ID, and Duplicates is the number of
+// routes the chunk is sent over at once.  None are sent over TLJ.
+// Close marks the last chunk read from a socket.  When half-close is
+// negotiated it only shuts down the write side of the peer's socket.
 type Chunk struct {
-	SessionID  string `json:"a"`
-	SocketID   string `json:"b"`
-	SequenceID uint64 `json:"c"`
-	Data       []byte `json:"d"`
-	Close      bool   `json:"e"`
+	SessionID   string      `json:"a"`
+	SocketID    string      `json:"b"`
+	SequenceID  uint64      `json:"c"`
+	Data        []byte      `json:"d"`
+	Close       bool        `json:"e"`
+	Compression Compression `json:"-"`
+	Parity      bool        `json:"-"`
+	Duplicates  int         `json:"-"`
 }
 
-// TLJ code to unpack Chunk data into an interface
-func buildChunk(data []byte, _ tlj.TLJContext) interface{} {
-	chunk := &Chunk{}
-	err := json.Unmarshal(data, &chunk)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"at":    "BuildChunk",
-			"error": err.Error(),
-		}).Error("error unmarshaling chunk data")
-		return nil
+// Create the TLJ code to unpack Chunk data into an interface
+func buildChunk(logger *logger) func([]byte, tlj.TLJContext) interface{} {
+	return func(data []byte, _ tlj.TLJContext) interface{} {
+		chunk := &Chunk{}
+		err := json.Unmarshal(data, &chunk)
+		if err != nil {
+			logger.Error("error unmarshaling chunk data",
+				"at", "BuildChunk",
+				"error", err,
+			)
+			return nil
+		}
+		if logger.debugging() {
+			logger.Debug("unmarshalled chunk data",
+				"at", "BuildChunk",
+				"sequence_id", chunk.SequenceID,
+				"socket_id", chunk.SocketID,
+				"session_id", chunk.SessionID,
+			)
+		}
+		return chunk
 	}
-	log.WithFields(log.Fields{
-		"at":          "BuildChunk",
-		"sequence_id": chunk.SequenceID,
-		"socket_id":   chunk.SocketID,
-		"session_id":  chunk.SessionID,
-	}).Debug("unmarshalled chunk data")
-	return chunk
+}
+
+// An Ack tells the sender of a socket's chunks which chunks have been
+// received, so they can be dropped from its retransmit buffer.  Every
+// sequence ID up to and including Cumulative has been received, along
+// with the out of order sequence IDs in Selective.  When flow control is
+// negotiated, Window is the highest sequence ID the receiver has room to
+// buffer, granting the sender credit to read and send up to it.
+type Ack struct {
+	SessionID  string
+	SocketID   string
+	Cumulative uint64
+	Selective  []uint64
+	Window     uint64
 }
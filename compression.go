@@ -0,0 +1,149 @@
+package imux
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Chunk data can be compressed when both peers select the same algorithm.
+// Each algorithm has a feature bit offered in the hello, so the algorithm
+// is negotiated like any other feature, and a chunk flag marking chunks
+// whose data was compressed with it.  Chunks whose data does not compress
+// are sent raw.
+type Compression byte
+
+const (
+	CompressionNone Compression = iota
+	CompressionDeflate
+)
+
+// Feature bits of every compression algorithm
+const compressionFeatures = FeatureDeflate
+
+// Chunks with less data than this are always sent raw
+const minCompressSize = 128
+
+// Number of chunks from a socket sent raw after one fails to compress,
+// sparing the effort on incompressible streams such as encrypted traffic
+const incompressibleBackoff = 16
+
+// Returned when compressed chunk data expands past the max chunk size
+var ErrDecompressedTooLarge = errors.New("decompressed chunk data exceeds max chunk size")
+
+var deflaters = sync.Pool{
+	New: func() interface{} {
+		writer, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return writer
+	},
+}
+
+// Parse the name of a compression algorithm
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "", "none":
+		return CompressionNone, nil
+	case "deflate":
+		return CompressionDeflate, nil
+	}
+	return CompressionNone, fmt.Errorf("unknown compression algorithm %q", name)
+}
+
+// The feature bit offering an algorithm in a hello
+func (algorithm Compression) feature() uint32 {
+	switch algorithm {
+	case CompressionDeflate:
+		return FeatureDeflate
+	}
+	return 0
+}
+
+// The frame flag marking chunk data compressed with an algorithm
+func (algorithm Compression) chunkFlag() byte {
+	switch algorithm {
+	case CompressionDeflate:
+		return chunkFlagDeflate
+	}
+	return 0
+}
+
+// Find the algorithm negotiated in a feature bitmap
+func negotiatedCompression(features uint32) Compression {
+	if features&FeatureDeflate != 0 {
+		return CompressionDeflate
+	}
+	return CompressionNone
+}
+
+// Find the algorithm a chunk frame's flags say its data is compressed with
+func flaggedCompression(flags byte) Compression {
+	if flags&chunkFlagDeflate != 0 {
+		return CompressionDeflate
+	}
+	return CompressionNone
+}
+
+// A compressor compresses the data read from one socket, backing off
+// for a while each time data fails to compress
+type compressor struct {
+	skip int
+}
+
+// Compress data if it gets smaller, returning the data to send and the
+// algorithm it was compressed with
+func (compressor *compressor) compress(algorithm Compression, data []byte) ([]byte, Compression) {
+	if algorithm == CompressionNone || len(data) < minCompressSize {
+		return data, CompressionNone
+	}
+	if compressor.skip > 0 {
+		compressor.skip--
+		return data, CompressionNone
+	}
+	compressed, err := compressData(algorithm, data)
+	if err != nil || len(compressed) >= len(data) {
+		compressor.skip = incompressibleBackoff
+		return data, CompressionNone
+	}
+	return compressed, algorithm
+}
+
+func compressData(algorithm Compression, data []byte) ([]byte, error) {
+	if algorithm != CompressionDeflate {
+		return nil, fmt.Errorf("unknown compression algorithm %d", algorithm)
+	}
+	var buffer bytes.Buffer
+	buffer.Grow(len(data))
+	writer := deflaters.Get().(*flate.Writer)
+	defer deflaters.Put(writer)
+	writer.Reset(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Decompress chunk data, refusing data that expands past max_size bytes
+func decompressData(algorithm Compression, data []byte, max_size int) ([]byte, error) {
+	switch algorithm {
+	case CompressionNone:
+		return data, nil
+	case CompressionDeflate:
+		reader := flate.NewReader(bytes.NewReader(data))
+		defer reader.Close()
+		decompressed, err := io.ReadAll(io.LimitReader(reader, int64(max_size)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(decompressed) > max_size {
+			return nil, ErrDecompressedTooLarge
+		}
+		return decompressed, nil
+	}
+	return nil, fmt.Errorf("unknown compression algorithm %d", algorithm)
+}
@@ -0,0 +1,102 @@
+package imux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/satori/go.uuid"
+	"testing"
+	"time"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("compressible chunk data "), 100)
+	compressed, algorithm := (&compressor{}).compress(CompressionDeflate, data)
+	if algorithm != CompressionDeflate || len(compressed) >= len(data) {
+		t.Fatalf("expected the data to be deflated, got %d bytes with %d", len(compressed), algorithm)
+	}
+	decompressed, err := decompressData(algorithm, compressed, len(data))
+	if err != nil || !bytes.Equal(decompressed, data) {
+		t.Fatalf("expected the data back after decompressing, got %d bytes, %v", len(decompressed), err)
+	}
+}
+
+func TestCompressorBacksOffIncompressibleData(t *testing.T) {
+	random := make([]byte, 1024)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	compressor := &compressor{}
+	if data, algorithm := compressor.compress(CompressionDeflate, random); algorithm != CompressionNone || !bytes.Equal(data, random) {
+		t.Fatal("expected incompressible data to be sent raw")
+	}
+	compressible := bytes.Repeat([]byte{1}, 1024)
+	for i := 0; i < incompressibleBackoff; i++ {
+		if _, algorithm := compressor.compress(CompressionDeflate, compressible); algorithm != CompressionNone {
+			t.Fatalf("expected chunk %d after incompressible data to be sent raw", i)
+		}
+	}
+	if _, algorithm := compressor.compress(CompressionDeflate, compressible); algorithm != CompressionDeflate {
+		t.Fatal("expected compression to resume after backing off")
+	}
+}
+
+func TestDecompressTooLarge(t *testing.T) {
+	compressed, err := compressData(CompressionDeflate, make([]byte, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decompressData(CompressionDeflate, compressed, 999); err != ErrDecompressedTooLarge {
+		t.Fatalf("expected ErrDecompressedTooLarge, got %v", err)
+	}
+	if decompressed, err := decompressData(CompressionDeflate, compressed, 1000); err != nil || len(decompressed) != 1000 {
+		t.Fatalf("expected data that fits to decompress, got %d bytes, %v", len(decompressed), err)
+	}
+}
+
+// A destination that holds everything written to it
+type bufferDestination struct {
+	bytes.Buffer
+}
+
+func (destination *bufferDestination) Close() error {
+	return nil
+}
+
+func TestWriteQueueDecompressesWithinNegotiatedChunkSize(t *testing.T) {
+	options := DefaultOptions()
+	options.ChunkSize = 1024
+	lifecycle := newLifecycle()
+	defer lifecycle.stop()
+	acker := newDataIMUX(uuid.NewV4().String(), &options, lifecycle, newLogger(nil), newReporter(nil), newPipeline())
+	observer := &streamClosedRecorder{closed: make(chan StreamEvent, 1)}
+	acker.reporter.use(observer)
+	acker.negotiated(supportedFeatures)
+	acker.limitChunkSize(256)
+	destination := &bufferDestination{}
+	write_queue := newWriteQueue(uuid.NewV4().String(), destination, acker, newWriteQueues(lifecycle, time.Minute))
+
+	// Fits ChunkSize, but not the chunk size negotiated with the peer
+	compressed, err := compressData(CompressionDeflate, make([]byte, 512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write_queue.deliver(&Chunk{
+		SessionID:   acker.SessionID,
+		SocketID:    write_queue.socketID,
+		SequenceID:  1,
+		Data:        compressed,
+		Compression: CompressionDeflate,
+	})
+	select {
+	case event := <-observer.closed:
+		stream_err, ok := event.Err.(*StreamError)
+		if !ok || stream_err.Reason != ErrDecompressedTooLarge.Error() {
+			t.Fatalf("expected the stream to fail decompressing, closed with %v", event.Err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a chunk decompressing past the negotiated chunk size to fail the stream")
+	}
+	if destination.Len() != 0 {
+		t.Fatalf("expected nothing written out, wrote %d bytes", destination.Len())
+	}
+}
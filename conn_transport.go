@@ -0,0 +1,276 @@
+package imux
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Returned by a ConnTransport that has no Redialers when dialing, or no
+// Listener when listening
+var (
+	errNoRedialers = errors.New("imux: transport has no redialers")
+	errNoListener  = errors.New("imux: transport has no listener")
+)
+
+// A Transport over net.Conns, the TLS connections imux has always used.
+// Clients dial with Redialers created by Redialers for each bind, and
+// Servers accept from Listener.  Connections negotiate binary frames,
+// falling back to TLJ encoded chunks with peers that predate the
+// handshake.  Once a Server at a bind fails to negotiate, later
+// connections from that bind skip the handshake.
+type ConnTransport struct {
+	Redialers RedialerGenerator
+	Listener  net.Listener
+	// Where connections log, set before the transport is used.  Nil uses
+	// slog's default logger.
+	Logger *slog.Logger
+	legacy map[string]bool
+	mux    sync.Mutex
+}
+
+func (transport *ConnTransport) Dial(ctx context.Context, bind string) (TransportConn, error) {
+	if transport.Redialers == nil {
+		return nil, errNoRedialers
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	redialer := transport.Redialers(bind)
+	socket, err := redialer()
+	if err != nil {
+		return nil, err
+	}
+	conn := newFramedConn(socket, bind, true, newLogger(transport.Logger))
+	conn.redialer = redialer
+	conn.transport = transport
+	return conn, nil
+}
+
+func (transport *ConnTransport) Listen() (TransportListener, error) {
+	if transport.Listener == nil {
+		return nil, errNoListener
+	}
+	return &connTransportListener{transport: transport}, nil
+}
+
+// Check if the Server at a bind did not negotiate
+func (transport *ConnTransport) isLegacy(bind string) bool {
+	transport.mux.Lock()
+	defer transport.mux.Unlock()
+	return transport.legacy[bind]
+}
+
+// Remember that the Server at a bind did not negotiate
+func (transport *ConnTransport) markLegacy(bind string) {
+	transport.mux.Lock()
+	defer transport.mux.Unlock()
+	if transport.legacy == nil {
+		transport.legacy = make(map[string]bool)
+	}
+	transport.legacy[bind] = true
+}
+
+// Accepts connections from a ConnTransport's Listener
+type connTransportListener struct {
+	transport *ConnTransport
+}
+
+func (listener *connTransportListener) Accept() (TransportConn, error) {
+	socket, err := listener.transport.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newFramedConn(socket, peerRoute(socket), false, newLogger(listener.transport.Logger)), nil
+}
+
+func (listener *connTransportListener) Close() error {
+	return listener.transport.Listener.Close()
+}
+
+func (listener *connTransportListener) Addr() net.Addr {
+	return listener.transport.Listener.Addr()
+}
+
+// A TransportConn over a net.Conn, dialed by a Client or accepted by a
+// Server.  Connections dialed by a ConnTransport keep their Redialer and
+// transport to dial again and fall back to TLJ when the Server turns out
+// not to negotiate.  The socket may only be replaced while negotiating,
+// holding mux so Close always closes the current one.  The counters come
+// first to stay aligned for atomic access.
+type framedConn struct {
+	framesSent     uint64
+	framesReceived uint64
+	bytesSent      uint64
+	bytesReceived  uint64
+	socket         net.Conn
+	route          string
+	dialed         bool
+	redialer       Redialer
+	transport      *ConnTransport
+	writer         chunkWriter
+	reader         chunkReader
+	logger         *logger
+	closed         bool
+	mux            sync.Mutex
+}
+
+func newFramedConn(socket net.Conn, route string, dialed bool, logger *logger) *framedConn {
+	conn := &framedConn{
+		route:  route,
+		dialed: dialed,
+		logger: logger,
+	}
+	conn.socket = &countingConn{Conn: socket, conn: conn}
+	return conn
+}
+
+func (conn *framedConn) Negotiate(local Hello, timeout time.Duration) (Hello, error) {
+	if !conn.dialed {
+		socket, remote, accepted, err := serverHandshake(conn.socket, local, timeout)
+		conn.mux.Lock()
+		conn.socket = socket
+		conn.mux.Unlock()
+		if err != nil {
+			return remote, err
+		}
+		if !accepted {
+			return Hello{}, conn.frame(0, local.MaxChunkSize)
+		}
+		return remote, conn.frame(remote.Features, remote.MaxChunkSize)
+	}
+	if conn.transport == nil || !conn.transport.isLegacy(conn.route) {
+		remote, err := clientHandshake(conn.socket, local, timeout)
+		if err != errLegacyPeer || conn.transport == nil {
+			if err != nil {
+				return remote, err
+			}
+			return remote, conn.frame(remote.Features, remote.MaxChunkSize)
+		}
+		conn.logger.Warn("server did not negotiate, falling back to TLJ chunks",
+			"at", "framedConn.Negotiate",
+			"route", conn.route,
+		)
+		conn.transport.markLegacy(conn.route)
+		if err := conn.redial(); err != nil {
+			return Hello{}, err
+		}
+	}
+	return Hello{}, conn.frame(0, local.MaxChunkSize)
+}
+
+// Replace the socket with a newly dialed one, since a Server that did not
+// answer the hello has already read it as TLJ data
+func (conn *framedConn) redial() error {
+	conn.mux.Lock()
+	if conn.closed {
+		conn.mux.Unlock()
+		return net.ErrClosed
+	}
+	conn.socket.Close()
+	conn.mux.Unlock()
+
+	socket, err := conn.redialer()
+	if err != nil {
+		return err
+	}
+	conn.mux.Lock()
+	defer conn.mux.Unlock()
+	if conn.closed {
+		socket.Close()
+		return net.ErrClosed
+	}
+	conn.socket = &countingConn{Conn: socket, conn: conn}
+	return nil
+}
+
+// Set up the framing for the negotiated features, reading chunks of up to
+// max_chunk_size bytes of data
+func (conn *framedConn) frame(features, max_chunk_size uint32) error {
+	writer, err := newChunkWriter(conn.socket, features, int(max_chunk_size), conn.logger)
+	if err != nil {
+		return err
+	}
+	conn.writer = writer
+	conn.reader = newChunkReader(conn.socket, features, max_chunk_size, conn.logger)
+	return nil
+}
+
+func (conn *framedConn) WriteChunk(chunk Chunk) error {
+	return conn.sent(conn.writer.WriteChunk(chunk))
+}
+
+func (conn *framedConn) WriteAck(ack Ack) error {
+	return conn.sent(conn.writer.WriteAck(ack))
+}
+
+func (conn *framedConn) WriteControl(control Control) error {
+	return conn.sent(conn.writer.WriteControl(control))
+}
+
+func (conn *framedConn) WritePing(nonce uint64) error {
+	return conn.sent(conn.writer.WritePing(nonce))
+}
+
+func (conn *framedConn) WritePong(nonce uint64) error {
+	return conn.sent(conn.writer.WritePong(nonce))
+}
+
+// Count a frame that was written without err
+func (conn *framedConn) sent(err error) error {
+	if err == nil {
+		atomic.AddUint64(&conn.framesSent, 1)
+	}
+	return err
+}
+
+func (conn *framedConn) ReadFrame() (interface{}, error) {
+	frame, err := conn.reader.ReadFrame()
+	if err == nil {
+		atomic.AddUint64(&conn.framesReceived, 1)
+	}
+	return frame, err
+}
+
+func (conn *framedConn) Route() string {
+	return conn.route
+}
+
+func (conn *framedConn) Stats() TransportStats {
+	return TransportStats{
+		FramesSent:     atomic.LoadUint64(&conn.framesSent),
+		FramesReceived: atomic.LoadUint64(&conn.framesReceived),
+		BytesSent:      atomic.LoadUint64(&conn.bytesSent),
+		BytesReceived:  atomic.LoadUint64(&conn.bytesReceived),
+	}
+}
+
+func (conn *framedConn) Close() error {
+	conn.mux.Lock()
+	defer conn.mux.Unlock()
+	conn.closed = true
+	return conn.socket.Close()
+}
+
+// A net.Conn that counts the bytes written to and read from it in the
+// stats of its framedConn
+type countingConn struct {
+	net.Conn
+	conn *framedConn
+}
+
+func (socket *countingConn) Read(b []byte) (int, error) {
+	read, err := socket.Conn.Read(b)
+	atomic.AddUint64(&socket.conn.bytesReceived, uint64(read))
+	return read, err
+}
+
+func (socket *countingConn) Write(b []byte) (int, error) {
+	written, err := socket.Conn.Write(b)
+	atomic.AddUint64(&socket.conn.bytesSent, uint64(written))
+	return written, err
+}
@@ -0,0 +1,254 @@
+package imux
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+)
+
+// Streams are opened, refused, reset and closed with control messages,
+// written separately from the chunks carrying a stream's data.  A client
+// sends ControlOpen for each socket it accepts, and the server answers
+// with ControlOpenAck once its destination, or the address the ControlOpen
+// names, is dialed or ControlOpenFail if dialing failed.  Either side
+// sends ControlReset when a stream dies.  ControlClose carries the
+// sequence ID of a socket's last chunk, marking the end of its data in
+// order with the chunks before it.
+type ControlType byte
+
+const (
+	ControlOpen ControlType = iota + 1
+	ControlOpenAck
+	ControlOpenFail
+	ControlReset
+	ControlClose
+)
+
+func (control_type ControlType) String() string {
+	switch control_type {
+	case ControlOpen:
+		return "open"
+	case ControlOpenAck:
+		return "open-ack"
+	case ControlOpenFail:
+		return "open-fail"
+	case ControlReset:
+		return "reset"
+	case ControlClose:
+		return "close"
+	}
+	return fmt.Sprintf("control(%d)", byte(control_type))
+}
+
+// Why a stream failed to open or was reset
+type ResetCode byte
+
+const (
+	ResetUnknown ResetCode = iota
+	// The destination refused the connection
+	ResetRefused
+	// Dialing or writing to the destination timed out
+	ResetTimeout
+	// No route to the destination
+	ResetUnreachable
+	// The connection was reset or closed abruptly by the other end, such as
+	// a process that crashed
+	ResetAborted
+	// Writing stream data out failed
+	ResetWriteFailed
+)
+
+func (code ResetCode) String() string {
+	switch code {
+	case ResetUnknown:
+		return "unknown"
+	case ResetRefused:
+		return "refused"
+	case ResetTimeout:
+		return "timeout"
+	case ResetUnreachable:
+		return "unreachable"
+	case ResetAborted:
+		return "aborted"
+	case ResetWriteFailed:
+		return "write failed"
+	}
+	return fmt.Sprintf("reset(%d)", byte(code))
+}
+
+// Longest reason or destination carried in a control message
+const maxControlReason = 256
+
+// A control message for one socket in a session.  Sequence is the
+// sequence ID of the last chunk for ControlClose, and Duplicates is the
+// number of routes a ControlOpen's stream is sent over.  Destination is
+// the address a ControlOpen asks the Server to dial, or empty for the
+// Server's own destination.  Code and Reason say why a ControlOpenFail or
+// ControlReset was sent.
+type Control struct {
+	SessionID   string
+	SocketID    string
+	Type        ControlType
+	Sequence    uint64
+	Duplicates  int
+	Code        ResetCode
+	Reason      string
+	Destination string
+}
+
+// A StreamError describes a stream that the peer refused to open or reset
+type StreamError struct {
+	SocketID string
+	Type     ControlType
+	Code     ResetCode
+	Reason   string
+}
+
+func (err *StreamError) Error() string {
+	return fmt.Sprintf("stream %s %s (%s): %s", err.SocketID, err.Type, err.Code, err.Reason)
+}
+
+// Match ErrStreamReset for streams that were reset
+func (err *StreamError) Is(target error) bool {
+	return target == ErrStreamReset && err.Type == ControlReset
+}
+
+// Describe the failure a ControlOpenFail or ControlReset reports
+func controlError(control Control) *StreamError {
+	return &StreamError{
+		SocketID: control.SocketID,
+		Type:     control.Type,
+		Code:     control.Code,
+		Reason:   control.Reason,
+	}
+}
+
+// Describe an error that ended a stream as a control message type
+func newStreamError(socket_id string, control_type ControlType, err error) *StreamError {
+	return &StreamError{
+		SocketID: socket_id,
+		Type:     control_type,
+		Code:     resetCode(err),
+		Reason:   err.Error(),
+	}
+}
+
+// Classify the error that ended a stream
+func resetCode(err error) ResetCode {
+	var stream_err *StreamError
+	var dns_err *net.DNSError
+	var net_err net.Error
+	switch {
+	case errors.As(err, &stream_err):
+		return stream_err.Code
+	case errors.As(err, &dns_err) && dns_err.IsNotFound:
+		return ResetUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ResetRefused
+	case errors.As(err, &net_err) && net_err.Timeout():
+		return ResetTimeout
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return ResetUnreachable
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, syscall.ECONNABORTED):
+		return ResetAborted
+	}
+	return ResetUnknown
+}
+
+// Check if the peer exchanges control messages
+func (data_imux *DataIMUX) controlling() bool {
+	return atomic.LoadUint32(&data_imux.peerFeatures)&FeatureStreamControl != 0
+}
+
+// Queue a control message to be written to the peer, dropping it if the
+// peer does not exchange control messages
+func (data_imux *DataIMUX) queueControl(control Control) {
+	if !data_imux.controlling() {
+		return
+	}
+	control.SessionID = data_imux.SessionID
+	select {
+	case data_imux.Controls <- control:
+	case <-data_imux.lifecycle.done:
+	}
+}
+
+// Queue a control message again after the transport socket it was being
+// written to failed
+func (data_imux *DataIMUX) requeueControl(control Control) {
+	data_imux.lifecycle.run(func() {
+		select {
+		case data_imux.Controls <- control:
+		case <-data_imux.lifecycle.done:
+		}
+	})
+}
+
+// Describe a failure to write a stream's data out
+func writeFailure(socket_id string, err error) *StreamError {
+	stream_err := newStreamError(socket_id, ControlReset, err)
+	if stream_err.Code == ResetUnknown {
+		stream_err.Code = ResetWriteFailed
+	}
+	return stream_err
+}
+
+// Tell the peer a stream died, with a control message carrying the reason
+// if the peer exchanges them or a reset chunk if not
+func (data_imux *DataIMUX) resetStream(socket_id string, err error) {
+	var stream_err *StreamError
+	if !errors.As(err, &stream_err) {
+		stream_err = newStreamError(socket_id, ControlReset, err)
+	}
+	data_imux.logger.Warn("resetting stream",
+		"at", "DataIMUX.resetStream",
+		"session_id", data_imux.SessionID,
+		"socket_id", socket_id,
+		"control", stream_err.Type.String(),
+		"code", stream_err.Code.String(),
+		"reason", stream_err.Reason,
+	)
+	if data_imux.controlling() {
+		data_imux.queueControl(Control{
+			SocketID: socket_id,
+			Type:     stream_err.Type,
+			Code:     stream_err.Code,
+			Reason:   truncateReason(stream_err.Reason),
+		})
+		return
+	}
+	select {
+	case data_imux.Chunks <- Chunk{
+		SessionID:  data_imux.SessionID,
+		SocketID:   socket_id,
+		SequenceID: 0,
+		Close:      true,
+	}:
+	case <-data_imux.lifecycle.done:
+	}
+}
+
+// Report a stream the peer refused or reset, returning the failure for
+// the stream's WriteQueue to close with
+func (data_imux *DataIMUX) streamFailed(control Control) *StreamError {
+	stream_err := controlError(control)
+	data_imux.logger.Warn("peer ended stream",
+		"at", "DataIMUX.streamFailed",
+		"session_id", data_imux.SessionID,
+		"socket_id", control.SocketID,
+		"control", control.Type.String(),
+		"code", control.Code.String(),
+		"reason", control.Reason,
+	)
+	data_imux.reporter.report(stream_err)
+	return stream_err
+}
+
+func truncateReason(reason string) string {
+	if len(reason) > maxControlReason {
+		return reason[:maxControlReason]
+	}
+	return reason
+}
@@ -0,0 +1,115 @@
+package imux
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStreamOpen(t *testing.T) {
+	pair := newLoopback(t, DefaultOptions(), map[string]int{"127.0.0.1": 3})
+	pair.start(t)
+	conn := pair.dial(t)
+	stream := pair.accept(t)
+	go io.Copy(stream, stream)
+
+	payload := randomPayload(t, 200000)
+	go conn.Write(payload)
+	expectPayload(t, conn, payload)
+}
+
+func TestStreamOpenFail(t *testing.T) {
+	pair := newLoopback(t, DefaultOptions(), map[string]int{"127.0.0.1": 1})
+	server, err := NewServerWithOptions(func() (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	}, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair.server = server
+	pair.start(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), loopbackTimeout)
+	defer cancel()
+	_, err = pair.client.DialContext(ctx, "tcp", "loopback")
+	var stream_err *StreamError
+	if !errors.As(err, &stream_err) {
+		t.Fatalf("expected a *StreamError dialing a refused destination, got %v", err)
+	}
+	if stream_err.Type != ControlOpenFail || stream_err.Code != ResetRefused {
+		t.Fatalf("expected the stream to fail to open as refused, got %v", stream_err)
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	pair := newLoopback(t, DefaultOptions(), map[string]int{"127.0.0.1": 1})
+	pair.start(t)
+	conn := pair.dial(t)
+	stream := pair.accept(t)
+	stream.Close()
+
+	deadline := time.After(loopbackTimeout)
+	var reported *StreamError
+	for reported == nil {
+		conn.Write([]byte("written after the stream closed"))
+		select {
+		case err := <-pair.client.Errors:
+			errors.As(err, &reported)
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("timed out waiting for the stream to be reset")
+		}
+	}
+	if reported.Type != ControlReset || reported.Code != ResetWriteFailed {
+		t.Fatalf("expected the stream to be reset after a failed write, got %v", reported)
+	}
+}
+
+// A destination that can be read from but whose writes fail
+type unwritableConn struct {
+	net.Conn
+}
+
+func (conn unwritableConn) Write([]byte) (int, error) {
+	return 0, errDestinationFull
+}
+
+func TestStreamResetClosesStream(t *testing.T) {
+	pair := newLoopback(t, DefaultOptions(), map[string]int{"127.0.0.1": 1})
+	server, err := NewServerWithOptions(func() (net.Conn, error) {
+		local, remote := net.Pipe()
+		t.Cleanup(func() { remote.Close() })
+		return unwritableConn{local}, nil
+	}, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair.server = server
+	observer := &streamClosedRecorder{closed: make(chan StreamEvent, 1)}
+	pair.client.Observer = observer
+	pair.start(t)
+	conn := pair.dial(t)
+	if _, err := conn.Write([]byte("written to a destination that fails")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-observer.closed:
+		var stream_err *StreamError
+		if !errors.As(event.Err, &stream_err) || stream_err.Code != ResetWriteFailed || !errors.Is(event.Err, ErrStreamReset) {
+			t.Fatalf("expected the stream to close with the reset the server sent, closed with %v", event.Err)
+		}
+	case <-time.After(loopbackTimeout):
+		t.Fatal("timed out waiting for the stream to close")
+	}
+	conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pair.server.Shutdown(ctx); err != nil {
+		t.Fatalf("expected nothing to be left in flight for the reset stream, got %v", err)
+	}
+}
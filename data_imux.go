@@ -1,83 +1,669 @@
 package imux
 
 import (
-	log "github.com/Sirupsen/logrus"
+	"errors"
 	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var MaxChunkDataSize = 16384
+// Returned when a transport socket is found closed while waiting to write
+var errTransportClosed = errors.New("transport socket closed")
 
 // A DataIMUX will read data from multiple io.Readers and chunk the data
 // into a chunk chan.  The Stale attribute provides a way to insert chunks
 // back into the chan from external sources.
 type DataIMUX struct {
-	Chunks    chan Chunk
-	Stale     chan Chunk
-	SessionID string
+	Chunks         chan Chunk
+	Stale          chan Chunk
+	Acks           chan Ack
+	Controls       chan Control
+	SessionID      string
+	ChunkSize      int
+	ParityInterval int
+	Duplicates     int
+	retransmit     *retransmitBuffer
+	retaining      bool
+	options        *Options
+	ready          chan struct{}
+	sized          chan struct{}
+	lifecycle      *lifecycle
+	logger         *logger
+	reporter       *reporter
+	pipeline       *pipeline
+	*dataIMUXState
 }
 
-// Create a new DataIMUX for a given session
+// The state of a DataIMUX that changes as it is used, kept behind a
+// pointer so copies of the DataIMUX returned by NewDataIMUX share it.
+// The counter comes first to stay aligned for atomic access.
+type dataIMUXState struct {
+	lastTransportID uint64
+	peerFeatures    uint32
+	chunkLimit      uint32
+	readyOnce       sync.Once
+	sizedOnce       sync.Once
+	transports      map[uint64]*transportSocket
+	transportsMux   sync.Mutex
+	rotation        int
+	sources         map[string]io.Reader
+	sourcesMux      sync.Mutex
+}
+
+// Create a new DataIMUX for a given session with the default Options.
+// Nothing acknowledges the chunks it reads, so they are passed to Chunks
+// without being held for retransmission.
 func NewDataIMUX(session_id string) DataIMUX {
-	log.WithFields(log.Fields{
-		"at":         "NewDataIMUX",
-		"session_id": session_id,
-	}).Debug("creating data imux")
-	return DataIMUX{
-		Chunks:    make(chan Chunk, 10),
-		Stale:     make(chan Chunk, 50),
-		SessionID: session_id,
+	options := DefaultOptions()
+	data_imux := newDataIMUX(session_id, &options, newLifecycle(), newLogger(nil), newReporter(nil), newPipeline())
+	data_imux.retaining = false
+	data_imux.limitChunkSize(0)
+	return *data_imux
+}
+
+// Create a DataIMUX with validated options whose goroutines belong to a
+// lifecycle, that logs to logger, reports failures to reporter and passes
+// chunks it writes through pipeline.  Chunks read are retained until the
+// peer acknowledges them, and retransmitting expired chunks is left to be
+// started with the lifecycle.
+func newDataIMUX(session_id string, options *Options, lifecycle *lifecycle, logger *logger, reporter *reporter, pipeline *pipeline) *DataIMUX {
+	if logger.debugging() {
+		logger.Debug("creating data imux",
+			"at", "NewDataIMUX",
+			"session_id", session_id,
+		)
+	}
+	data_imux := &DataIMUX{
+		Chunks:         make(chan Chunk, options.ChunkQueueDepth),
+		Stale:          make(chan Chunk, options.RetransmitQueueDepth),
+		Acks:           make(chan Ack, options.ControlQueueDepth),
+		Controls:       make(chan Control, options.ControlQueueDepth),
+		SessionID:      session_id,
+		ChunkSize:      options.ChunkSize,
+		ParityInterval: options.ParityInterval,
+		Duplicates:     options.DuplicateSends,
+		retransmit:     newRetransmitBuffer(options.MaxUnacknowledgedChunks),
+		retaining:      true,
+		options:        options,
+		ready:          make(chan struct{}),
+		sized:          make(chan struct{}),
+		lifecycle:      lifecycle,
+		logger:         logger,
+		reporter:       reporter,
+		pipeline:       pipeline,
+		dataIMUXState: &dataIMUXState{
+			transports: make(map[uint64]*transportSocket),
+			sources:    make(map[string]io.Reader),
+		},
 	}
+	lifecycle.atStop(data_imux.retransmit.stop)
+	return data_imux
 }
 
 // Read from a new data source in this DataIMUX, create chunks from it tagged with the
 // provided socket ID.
 func (data_imux *DataIMUX) ReadFrom(id string, conn io.Reader, session_id string) {
-	log.WithFields(log.Fields{
-		"at":        "DataIMUX.ReadFrom",
-		"socket_id": id,
-	}).Debug("reading from new data source")
+	data_imux.readFromDestination(id, conn, "")
+}
+
+// Read from a new data source like ReadFrom, asking the peer to dial
+// destination for it, or its own destination if empty
+func (data_imux *DataIMUX) readFromDestination(id string, conn io.Reader, destination string) {
+	data_imux.queueControl(Control{
+		SocketID:    id,
+		Type:        ControlOpen,
+		Duplicates:  data_imux.Duplicates,
+		Destination: destination,
+	})
+	data_imux.readFrom(id, conn, data_imux.Duplicates)
+}
+
+// Read from a data source, sending each chunk over a number of routes,
+// once the peer's max chunk size is known
+func (data_imux *DataIMUX) readFrom(id string, conn io.Reader, duplicates int) {
+	select {
+	case <-data_imux.sized:
+	case <-data_imux.lifecycle.done:
+		return
+	}
+	if data_imux.logger.debugging() {
+		data_imux.logger.Debug("reading from new data source",
+			"at", "DataIMUX.ReadFrom",
+			"socket_id", id,
+		)
+	}
+	data_imux.retransmit.open(id)
+	defer data_imux.retransmit.close(id)
+	data_imux.addSource(id, conn)
+	defer data_imux.removeSource(id)
 	sequence := uint64(1)
+	compressor := &compressor{}
+	parity := &parityGroup{}
+	closing := false
 	for {
-		chunk_data := make([]byte, MaxChunkDataSize)
-		read, err := conn.Read(chunk_data)
-		log.WithFields(log.Fields{
-			"at":        "DataIMUX.ReadFrom",
-			"socket_id": id,
-			"size":      read,
-		}).Debug("read data from data source")
-		chunk_data = chunk_data[:read]
-		close := false
-		if err != nil {
+		if data_imux.flowControlled() && !data_imux.retransmit.awaitCredit(id, sequence) {
+			if data_imux.logger.debugging() {
+				data_imux.logger.Debug("socket reset while waiting for credit",
+					"at", "DataIMUX.ReadFrom",
+					"socket_id", id,
+				)
+			}
+			return
+		}
+		var chunk_data []byte
+		read := 0
+		err := io.EOF
+		if !closing {
+			chunk_data = make([]byte, data_imux.readSize())
+			read, err = conn.Read(chunk_data)
+			if data_imux.logger.debugging() {
+				data_imux.logger.Debug("read data from data source",
+					"at", "DataIMUX.ReadFrom",
+					"socket_id", id,
+					"size", read,
+				)
+			}
+			chunk_data = chunk_data[:read]
+		}
+		close := closing
+		if err != nil && !closing {
 			if err == io.EOF {
-				log.WithFields(log.Fields{
-					"at":        "DataIMUX.ReadFrom",
-					"error":     err.Error(),
-					"socket_id": id,
-				}).Debug("EOF from data imux source")
-			} else {
-				log.WithFields(log.Fields{
-					"at":        "DataIMUX.ReadFrom",
-					"error":     err.Error(),
-					"socket_id": id,
-				}).Debug("error reading data from imux data source")
+				if data_imux.logger.debugging() {
+					data_imux.logger.Debug("EOF from data imux source",
+						"at", "DataIMUX.ReadFrom",
+						"error", err,
+						"socket_id", id,
+					)
+				}
+			} else if data_imux.logger.debugging() {
+				data_imux.logger.Debug("error reading data from imux data source",
+					"at", "DataIMUX.ReadFrom",
+					"error", err,
+					"socket_id", id,
+				)
 			}
-			close = true
-		}
-		data_imux.Chunks <- Chunk{
-			SequenceID: sequence,
-			SocketID:   id,
-			SessionID:  data_imux.SessionID,
-			Data:       chunk_data,
-			Close:      close,
-		}
-		log.WithFields(log.Fields{
-			"at":        "DataIMUX.ReadFrom",
-			"socket_id": id,
-			"size":      read,
-		}).Debug("write chunk from data source")
+			// With control messages the close is sent in its own chunk
+			// after the last data, written as a ControlClose
+			close = read == 0 || !data_imux.controlling()
+			closing = !close
+		}
+		chunk_data, compression := compressor.compress(data_imux.compression(), chunk_data)
+		chunk := Chunk{
+			SequenceID:  sequence,
+			SocketID:    id,
+			SessionID:   data_imux.SessionID,
+			Data:        chunk_data,
+			Close:       close,
+			Compression: compression,
+			Duplicates:  duplicates,
+		}
+		if data_imux.retaining && !data_imux.retransmit.add(chunk) {
+			return
+		}
+		select {
+		case data_imux.Chunks <- chunk:
+		case <-data_imux.lifecycle.done:
+			return
+		}
+		if data_imux.logger.debugging() {
+			data_imux.logger.Debug("write chunk from data source",
+				"at", "DataIMUX.ReadFrom",
+				"socket_id", id,
+				"size", read,
+			)
+		}
+		if interval := data_imux.parityInterval(); interval > 0 {
+			parity.add(chunk)
+			if parity.count >= interval || close {
+				data_imux.queueParity(parity.flush(data_imux.SessionID, id))
+			}
+		}
 		sequence += 1
 		if close {
 			return
 		}
 	}
 }
+
+// Record the features the peer negotiated on a transport socket, such as
+// whether chunks received from it should be acknowledged through this
+// DataIMUX.  The first time, ready is closed.
+func (data_imux *DataIMUX) negotiated(features uint32) {
+	atomic.StoreUint32(&data_imux.peerFeatures, features)
+	data_imux.readyOnce.Do(func() {
+		close(data_imux.ready)
+	})
+}
+
+// Limit the data in chunks read from now on to the max chunk size
+// negotiated on a transport socket, if it is smaller than the current
+// limit.  Zero sets no limit, for peers that do not negotiate one.  The
+// first time, reading from sockets starts.
+func (data_imux *DataIMUX) limitChunkSize(size int) {
+	for size > 0 {
+		limit := atomic.LoadUint32(&data_imux.chunkLimit)
+		if limit != 0 && limit <= uint32(size) {
+			break
+		}
+		if atomic.CompareAndSwapUint32(&data_imux.chunkLimit, limit, uint32(size)) {
+			break
+		}
+	}
+	data_imux.sizedOnce.Do(func() {
+		close(data_imux.sized)
+	})
+}
+
+// The max chunk size of the chunks sent, ChunkSize or the smaller max
+// chunk size negotiated with the peer
+func (data_imux *DataIMUX) chunkSize() int {
+	if limit := int(atomic.LoadUint32(&data_imux.chunkLimit)); limit != 0 && limit < data_imux.ChunkSize {
+		return limit
+	}
+	return data_imux.ChunkSize
+}
+
+// The most data read into each chunk, leaving room for what Middleware
+// adds to it before it is sent
+func (data_imux *DataIMUX) readSize() int {
+	return max(data_imux.chunkSize()-data_imux.options.MiddlewareOverhead, 1)
+}
+
+// Check if the peer dials destinations named when streams are opened
+func (data_imux *DataIMUX) destinations() bool {
+	features := atomic.LoadUint32(&data_imux.peerFeatures)
+	return features&FeatureStreamControl != 0 && features&FeatureDestinations != 0
+}
+
+// Check if the peer expects acknowledgements for the chunks it sends
+func (data_imux *DataIMUX) acknowledging() bool {
+	return atomic.LoadUint32(&data_imux.peerFeatures)&FeatureAcknowledgements != 0
+}
+
+// The compression algorithm negotiated with the peer for chunk data
+func (data_imux *DataIMUX) compression() Compression {
+	return negotiatedCompression(atomic.LoadUint32(&data_imux.peerFeatures))
+}
+
+// Check if parity chunks are exchanged with the peer
+func (data_imux *DataIMUX) parityNegotiated() bool {
+	return atomic.LoadUint32(&data_imux.peerFeatures)&FeatureParity != 0
+}
+
+// The number of chunks covered by each parity chunk sent to the peer, or
+// 0 if the peer did not negotiate parity
+func (data_imux *DataIMUX) parityInterval() int {
+	if !data_imux.parityNegotiated() {
+		return 0
+	}
+	return data_imux.ParityInterval
+}
+
+// Check if the peer accepts duplicate copies of chunks
+func (data_imux *DataIMUX) duplicating() bool {
+	return atomic.LoadUint32(&data_imux.peerFeatures)&FeatureDuplicates != 0
+}
+
+// Check if close chunks from the peer only mean it finished writing
+func (data_imux *DataIMUX) halfClosing() bool {
+	return atomic.LoadUint32(&data_imux.peerFeatures)&FeatureHalfClose != 0
+}
+
+// Check if the peer advertises receive windows that limit what is sent
+func (data_imux *DataIMUX) flowControlled() bool {
+	features := atomic.LoadUint32(&data_imux.peerFeatures)
+	return features&FeatureAcknowledgements != 0 && features&FeatureFlowControl != 0
+}
+
+// Queue an acknowledgement to be written to the peer.  Acks are cumulative,
+// so one that does not fit is dropped in favor of the next.
+func (data_imux *DataIMUX) queueAck(ack Ack) {
+	select {
+	case data_imux.Acks <- ack:
+	default:
+	}
+}
+
+// Write acknowledgements, control messages and chunks from the DataIMUX to
+// a transport socket until a write fails or the socket is closed.
+// Acknowledgements and control messages are written first, followed by
+// stale chunks being retransmitted and chunks queued for this socket
+// specifically, followed by new chunks, each passed through the pipeline
+// as it is written, dropping chunks the pipeline grows past the socket's
+// max chunk size.  The socket's route lets duplicates of chunks be sent
+// over other routes.  When the peer will not acknowledge chunks written
+// to this socket they are released from the retransmit buffer once
+// written.  When heartbeats were negotiated the socket is kept alive with
+// pings, and errHeartbeatTimeout is returned if it stops answering them.
+func (data_imux *DataIMUX) writeTo(transport *transportSocket) error {
+	id := atomic.AddUint64(&data_imux.lastTransportID, 1)
+	data_imux.addTransport(id, transport)
+	defer data_imux.removeTransport(id)
+	writer := transport.conn
+	if transport.heartbeats() {
+		stop := make(chan struct{})
+		defer close(stop)
+		data_imux.lifecycle.run(func() {
+			transport.keepAlive(stop)
+		})
+	}
+	for {
+		var chunk Chunk
+		direct := false
+		select {
+		case ack := <-data_imux.Acks:
+			if err := writer.WriteAck(ack); err != nil {
+				data_imux.transportFailed(id)
+				return transport.failure(err)
+			}
+			continue
+		case control := <-data_imux.Controls:
+			if err := writer.WriteControl(control); err != nil {
+				data_imux.transportFailed(id)
+				data_imux.requeueControl(control)
+				return transport.failure(err)
+			}
+			continue
+		default:
+		}
+		select {
+		case chunk = <-data_imux.Stale:
+		case chunk = <-transport.queued:
+			direct = true
+		default:
+			select {
+			case ack := <-data_imux.Acks:
+				if err := writer.WriteAck(ack); err != nil {
+					data_imux.transportFailed(id)
+					return transport.failure(err)
+				}
+				continue
+			case control := <-data_imux.Controls:
+				if err := writer.WriteControl(control); err != nil {
+					data_imux.transportFailed(id)
+					data_imux.requeueControl(control)
+					return transport.failure(err)
+				}
+				continue
+			case chunk = <-data_imux.Stale:
+			case chunk = <-transport.queued:
+				direct = true
+			case chunk = <-data_imux.Chunks:
+			case <-transport.closed:
+				data_imux.transportFailed(id)
+				return transport.failure(errTransportClosed)
+			case <-data_imux.lifecycle.done:
+				return ErrShutdown
+			}
+		}
+
+		if !direct && !data_imux.retransmit.sending(chunk, id) {
+			continue
+		}
+		if data_imux.logger.debugging() {
+			data_imux.logger.Debug("writing chunk to transport socket",
+				"at", "DataIMUX.writeTo",
+				"sequence_id", chunk.SequenceID,
+				"socket_id", chunk.SocketID,
+				"session_id", chunk.SessionID,
+			)
+		}
+		wire := chunk
+		if err := data_imux.pipeline.send(&wire); err != nil {
+			data_imux.middlewareFailed(&chunk, false, err)
+		} else if err := transport.fits(&wire); err != nil {
+			data_imux.middlewareFailed(&chunk, false, err)
+		} else {
+			if err := writer.WriteChunk(wire); err != nil {
+				data_imux.transportFailed(id)
+				return transport.failure(err)
+			}
+			if !direct && chunk.Duplicates > 1 && data_imux.duplicating() {
+				data_imux.queueDuplicates(chunk, id)
+			}
+		}
+		if direct {
+			continue
+		}
+		if !transport.reliable() && chunk.SequenceID != 0 {
+			data_imux.retransmit.remove(chunk.SocketID, chunk.SequenceID)
+		}
+	}
+}
+
+// Register a transport socket writing from this DataIMUX
+func (data_imux *DataIMUX) addTransport(id uint64, transport *transportSocket) {
+	data_imux.transportsMux.Lock()
+	defer data_imux.transportsMux.Unlock()
+	data_imux.transports[id] = transport
+}
+
+// Unregister a transport socket, dropping any chunks queued for it
+func (data_imux *DataIMUX) removeTransport(id uint64) {
+	data_imux.transportsMux.Lock()
+	defer data_imux.transportsMux.Unlock()
+	delete(data_imux.transports, id)
+}
+
+// The smoothed round trip times of the transport sockets writing from this
+// DataIMUX, grouped by route.  Transport sockets without heartbeats or
+// without an answered ping yet are left out.
+func (data_imux *DataIMUX) RoundTripTimes() map[string][]time.Duration {
+	data_imux.transportsMux.Lock()
+	defer data_imux.transportsMux.Unlock()
+	rtts := make(map[string][]time.Duration)
+	for _, transport := range data_imux.transports {
+		if rtt := transport.roundTripTime(); rtt > 0 {
+			rtts[transport.route] = append(rtts[transport.route], rtt)
+		}
+	}
+	return rtts
+}
+
+// List the registered transport sockets, rotated by one each call so
+// chunks queued for specific transport sockets are spread between them.
+// Must be called holding transportsMux.
+func (data_imux *DataIMUX) rotatedTransports() []uint64 {
+	transports := make([]uint64, 0, len(data_imux.transports))
+	for transport := range data_imux.transports {
+		transports = append(transports, transport)
+	}
+	if len(transports) == 0 {
+		return transports
+	}
+	sort.Slice(transports, func(i, j int) bool {
+		return transports[i] < transports[j]
+	})
+	data_imux.rotation++
+	offset := data_imux.rotation % len(transports)
+	return append(transports[offset:], transports[:offset]...)
+}
+
+// Queue a chunk for a transport socket, returning false if it has no room
+func (data_imux *DataIMUX) queueFor(transport uint64, chunk Chunk) bool {
+	select {
+	case data_imux.transports[transport].queued <- chunk:
+		return true
+	default:
+		return false
+	}
+}
+
+// Queue a parity chunk for a transport socket, rotating between transport
+// sockets and preferring ones that did not carry chunks from the parity
+// chunk's group, so a transport socket that dies takes as little as
+// possible of any group with it.  Parity chunks are dropped if there is
+// no room for them.
+func (data_imux *DataIMUX) queueParity(parity Chunk) {
+	first, last, err := parityRange(&parity)
+	if err != nil {
+		return
+	}
+	carriers := data_imux.retransmit.carriers(parity.SocketID, first, last)
+
+	data_imux.transportsMux.Lock()
+	defer data_imux.transportsMux.Unlock()
+	transports := data_imux.rotatedTransports()
+	candidates := make([]uint64, 0, len(transports))
+	for _, transport := range transports {
+		if !carriers[transport] {
+			candidates = append(candidates, transport)
+		}
+	}
+	for _, transport := range transports {
+		if carriers[transport] {
+			candidates = append(candidates, transport)
+		}
+	}
+	for _, transport := range candidates {
+		if data_imux.queueFor(transport, parity) {
+			return
+		}
+	}
+	if data_imux.logger.debugging() {
+		data_imux.logger.Debug("dropped parity chunk with no transport socket to write it",
+			"at", "DataIMUX.queueParity",
+			"sequence_id", parity.SequenceID,
+			"socket_id", parity.SocketID,
+		)
+	}
+}
+
+// Queue copies of a chunk written to one transport socket for other
+// transport sockets until the chunk's Duplicates are all being sent.
+// Transport sockets on routes that are not carrying a copy yet are used
+// first so copies take distinct binds, falling back to any other
+// transport socket when there are fewer routes than copies.
+func (data_imux *DataIMUX) queueDuplicates(chunk Chunk, sent_on uint64) {
+	data_imux.transportsMux.Lock()
+	defer data_imux.transportsMux.Unlock()
+	source, ok := data_imux.transports[sent_on]
+	if !ok {
+		return
+	}
+	copies := chunk.Duplicates - 1
+	used := map[uint64]bool{sent_on: true}
+	routes := map[string]bool{source.route: true}
+	transports := data_imux.rotatedTransports()
+	for _, distinct := range []bool{true, false} {
+		for _, transport := range transports {
+			if copies == 0 {
+				return
+			}
+			route := data_imux.transports[transport].route
+			if used[transport] || (distinct && routes[route]) {
+				continue
+			}
+			if data_imux.queueFor(transport, chunk) {
+				copies--
+				used[transport] = true
+				routes[route] = true
+			}
+		}
+	}
+}
+
+// Move every unacknowledged chunk written to a dead transport socket into
+// Stale so it is written again over another transport socket
+func (data_imux *DataIMUX) transportFailed(transport uint64) {
+	chunks := data_imux.retransmit.failed(transport)
+	if len(chunks) > 0 {
+		if data_imux.logger.debugging() {
+			data_imux.logger.Debug("retransmitting chunks from dead transport socket",
+				"at", "DataIMUX.transportFailed",
+				"session_id", data_imux.SessionID,
+				"chunks", len(chunks),
+			)
+		}
+		data_imux.lifecycle.run(func() {
+			data_imux.requeue(chunks)
+		})
+	}
+}
+
+// Move chunks into Stale to be written again, telling the observer about
+// each
+func (data_imux *DataIMUX) requeue(chunks []Chunk) {
+	for _, chunk := range chunks {
+		data_imux.reporter.observer.ChunkRetransmitted(ChunkEvent{
+			SessionID:  chunk.SessionID,
+			SocketID:   chunk.SocketID,
+			SequenceID: chunk.SequenceID,
+			Size:       len(chunk.Data),
+		})
+		select {
+		case data_imux.Stale <- chunk:
+		case <-data_imux.lifecycle.done:
+			return
+		}
+	}
+}
+
+// Periodically retransmit chunks that have gone unacknowledged too long,
+// recovering chunks lost without their transport socket failing, until
+// the lifecycle stops
+func (data_imux *DataIMUX) retransmitExpired() {
+	ticker := time.NewTicker(data_imux.options.RetransmitTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-data_imux.lifecycle.done:
+			return
+		}
+		chunks := data_imux.retransmit.expired(data_imux.options.RetransmitTimeout)
+		if len(chunks) > 0 {
+			if data_imux.logger.debugging() {
+				data_imux.logger.Debug("retransmitting unacknowledged chunks",
+					"at", "DataIMUX.retransmitExpired",
+					"session_id", data_imux.SessionID,
+					"chunks", len(chunks),
+				)
+			}
+			data_imux.requeue(chunks)
+		}
+	}
+}
+
+// Register a socket being read from, so reading can be stopped when the
+// lifecycle starts draining
+func (data_imux *DataIMUX) addSource(id string, conn io.Reader) {
+	data_imux.sourcesMux.Lock()
+	defer data_imux.sourcesMux.Unlock()
+	data_imux.sources[id] = conn
+	if data_imux.lifecycle.isDraining() {
+		stopReading(conn)
+	}
+}
+
+func (data_imux *DataIMUX) removeSource(id string) {
+	data_imux.sourcesMux.Lock()
+	defer data_imux.sourcesMux.Unlock()
+	delete(data_imux.sources, id)
+}
+
+// Stop reading from every socket, so each sends its close after the data
+// already read
+func (data_imux *DataIMUX) stopReading() {
+	data_imux.sourcesMux.Lock()
+	defer data_imux.sourcesMux.Unlock()
+	for _, conn := range data_imux.sources {
+		stopReading(conn)
+	}
+}
+
+// Interrupt reading from a socket by expiring its read deadline, if it
+// has one
+func stopReading(conn io.Reader) {
+	if deadliner, ok := conn.(interface{ SetReadDeadline(time.Time) error }); ok {
+		deadliner.SetReadDeadline(time.Now())
+	}
+}
+
+// Check if nothing read by the DataIMUX is still waiting to be written or
+// acknowledged, and no socket is still being read from
+func (data_imux *DataIMUX) idle() bool {
+	return data_imux.retransmit.idle() && len(data_imux.Acks) == 0 && len(data_imux.Controls) == 0
+}
@@ -0,0 +1,36 @@
+package imux
+
+import (
+	"bytes"
+	"github.com/satori/go.uuid"
+	"testing"
+	"time"
+)
+
+func TestDataIMUXReadFromWithoutAcknowledgements(t *testing.T) {
+	data_imux := NewDataIMUX(uuid.NewV4().String())
+	data_imux.ChunkSize = 16
+	count := DefaultOptions().MaxUnacknowledgedChunks * 2
+	source := bytes.Repeat([]byte{7}, count*data_imux.ChunkSize)
+	socket_id := uuid.NewV4().String()
+	go data_imux.ReadFrom(socket_id, bytes.NewReader(source), data_imux.SessionID)
+
+	read := 0
+	for {
+		select {
+		case chunk := <-data_imux.Chunks:
+			if chunk.SocketID != socket_id || chunk.SequenceID != uint64(read+1) {
+				t.Fatalf("expected chunk %d of %s, read %+v", read+1, socket_id, chunk)
+			}
+			read++
+			if chunk.Close {
+				if read != count+1 {
+					t.Fatalf("expected %d chunks and a close, read %d", count, read)
+				}
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("reading stalled after %d chunks", read)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package imux
+
+// Largest allowed Options.DuplicateSends, the most copies a chunk frame
+// describes
+const maxDuplicateSends = 4
+
+// Keep a number of copies within what a chunk frame can describe
+func clampDuplicates(duplicates int) int {
+	if duplicates < 1 {
+		return 1
+	}
+	if duplicates > maxDuplicateSends {
+		return maxDuplicateSends
+	}
+	return duplicates
+}
+
+// The chunk frame flag bits describing a number of copies
+func duplicatesFlags(duplicates int) byte {
+	return byte(clampDuplicates(duplicates)-1) << chunkDuplicatesShift & chunkFlagDuplicates
+}
+
+// The number of copies described by a chunk frame's flags
+func flaggedDuplicates(flags byte) int {
+	return int(flags&chunkFlagDuplicates>>chunkDuplicatesShift) + 1
+}
@@ -0,0 +1,68 @@
+package imux
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+)
+
+// Counts the copies of each data chunk received
+type receiveCounter struct {
+	mux    sync.Mutex
+	counts map[uint64]int
+}
+
+func (middleware *receiveCounter) Send(*Chunk) error {
+	return nil
+}
+
+func (middleware *receiveCounter) Receive(chunk *Chunk) error {
+	if chunk.Parity || len(chunk.Data) == 0 {
+		return nil
+	}
+	middleware.mux.Lock()
+	defer middleware.mux.Unlock()
+	middleware.counts[chunk.SequenceID]++
+	return nil
+}
+
+func (middleware *receiveCounter) duplicated() bool {
+	middleware.mux.Lock()
+	defer middleware.mux.Unlock()
+	for _, count := range middleware.counts {
+		if count > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDuplicatesWrittenOutOnce(t *testing.T) {
+	options := DefaultOptions()
+	options.ChunkSize = 1024
+	options.DuplicateSends = 2
+	pair := newLoopback(t, options, map[string]int{"127.0.0.1": 2})
+	counter := &receiveCounter{counts: make(map[uint64]int)}
+	pair.server.Middleware = []Middleware{counter}
+	pair.start(t)
+	pair.awaitTransports(t, 2)
+	conn := pair.dial(t)
+	stream := pair.accept(t)
+
+	payload := randomPayload(t, 32*1024)
+	go func() {
+		conn.Write(payload)
+		conn.(halfCloser).CloseWrite()
+	}()
+	received, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, payload) {
+		t.Fatal("stream data does not match what was written, each chunk must be written out once")
+	}
+	if !counter.duplicated() {
+		t.Fatal("expected copies of chunks to be received")
+	}
+}
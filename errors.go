@@ -0,0 +1,98 @@
+package imux
+
+import (
+	"fmt"
+)
+
+// Operations on a transport socket that can fail
+const (
+	TransportDial      = "dial"
+	TransportNegotiate = "negotiate"
+	TransportWrite     = "write"
+)
+
+// A TransportError describes a transport socket that failed.  Route is the
+// bind a Client dialed it from, or the address of the Client a Server
+// accepted it from, and Op is the operation that failed.  Clients redial
+// failed transport sockets after a cooldown.
+type TransportError struct {
+	SessionID string
+	Route     string
+	Op        string
+	Err       error
+}
+
+func (err *TransportError) Error() string {
+	return fmt.Sprintf("transport %s %s: %s", err.Route, err.Op, err.Err)
+}
+
+func (err *TransportError) Unwrap() error {
+	return err.Err
+}
+
+// A DestinationError describes a Server failing to open the destination
+// of a stream.  The stream is refused.
+type DestinationError struct {
+	SessionID string
+	SocketID  string
+	Err       error
+}
+
+func (err *DestinationError) Error() string {
+	return fmt.Sprintf("destination for stream %s: %s", err.SocketID, err.Err)
+}
+
+func (err *DestinationError) Unwrap() error {
+	return err.Err
+}
+
+// A ChunkError describes a chunk dropped because a Middleware failed on
+// it while it was being sent, or received if Received is set, or because
+// a Middleware grew its data past the max chunk size while sending it
+type ChunkError struct {
+	SessionID  string
+	SocketID   string
+	SequenceID uint64
+	Received   bool
+	Err        error
+}
+
+func (err *ChunkError) Error() string {
+	direction := "sending"
+	if err.Received {
+		direction = "receiving"
+	}
+	return fmt.Sprintf("%s chunk %d of stream %s: %s", direction, err.SequenceID, err.SocketID, err.Err)
+}
+
+func (err *ChunkError) Unwrap() error {
+	return err.Err
+}
+
+// Reports failures inside a Client or Server to its Errors without
+// blocking, dropping them if nothing is reading, and events to its
+// Observer.  A reporter without a channel drops every failure.
+type reporter struct {
+	errors   chan error
+	observer Observer
+}
+
+func newReporter(failures chan error) *reporter {
+	return &reporter{errors: failures, observer: NopObserver{}}
+}
+
+// Switch to an Observer, or NopObserver if it is nil.  Must be called
+// before any goroutine reports.
+func (reporter *reporter) use(observer Observer) {
+	if observer == nil {
+		observer = NopObserver{}
+	}
+	reporter.observer = observer
+}
+
+func (reporter *reporter) report(err error) {
+	select {
+	case reporter.errors <- err:
+	default:
+	}
+}
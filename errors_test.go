@@ -0,0 +1,79 @@
+package imux
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReporterDropsWhenFull(t *testing.T) {
+	failures := make(chan error, 1)
+	reporter := newReporter(failures)
+	first := errors.New("first failure")
+	reporter.report(first)
+	reporter.report(errors.New("second failure"))
+	if len(failures) != 1 || <-failures != first {
+		t.Fatal("expected the first failure to be kept and the second dropped")
+	}
+	newReporter(nil).report(first)
+}
+
+func TestFailuresUnwrap(t *testing.T) {
+	for _, failure := range []error{
+		&TransportError{Route: "127.0.0.1", Op: TransportDial, Err: syscall.ECONNREFUSED},
+		&DestinationError{SocketID: "socket", Err: syscall.ECONNREFUSED},
+		&ChunkError{SocketID: "socket", SequenceID: 3, Err: syscall.ECONNREFUSED},
+	} {
+		if !errors.Is(failure, syscall.ECONNREFUSED) {
+			t.Errorf("expected %T to wrap the error it describes", failure)
+		}
+	}
+}
+
+func TestFailureMessages(t *testing.T) {
+	for _, test := range []struct {
+		failure error
+		message string
+	}{
+		{
+			&TransportError{Route: "10.0.0.1", Op: TransportNegotiate, Err: errors.New("bad hello")},
+			"transport 10.0.0.1 negotiate: bad hello",
+		},
+		{
+			&DestinationError{SocketID: "socket", Err: errors.New("refused")},
+			"destination for stream socket: refused",
+		},
+		{
+			&ChunkError{SocketID: "socket", SequenceID: 7, Received: true, Err: errors.New("bad tag")},
+			"receiving chunk 7 of stream socket: bad tag",
+		},
+		{
+			&StreamError{SocketID: "socket", Type: ControlReset, Code: ResetWriteFailed, Reason: "disk full"},
+			"stream socket reset (write failed): disk full",
+		},
+	} {
+		if message := test.failure.Error(); message != test.message {
+			t.Errorf("expected %q, got %q", test.message, message)
+		}
+	}
+}
+
+func TestClientReportsTransportDialFailures(t *testing.T) {
+	client := startClient(t, func() (net.Conn, error) {
+		return nil, syscall.ECONNREFUSED
+	})
+	select {
+	case err := <-client.Errors:
+		var transport_err *TransportError
+		if !errors.As(err, &transport_err) || transport_err.Op != TransportDial || transport_err.SessionID != client.SessionID {
+			t.Fatalf("expected a *TransportError for the failed dial, got %v", err)
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatalf("expected the failure to wrap the dial error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("failed dial was never reported")
+	}
+}
@@ -0,0 +1,356 @@
+package imux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"io"
+	"net"
+	"sync"
+)
+
+// Transport sockets that negotiate FeatureBinaryFraming exchange chunks
+// as length prefixed binary frames instead of TLJ encoded JSON.  Each
+// frame is a fixed size header followed by the raw frame data:
+//
+//	type       1 byte   frameChunk, frameAck, frameControl, framePing or framePong
+//	flags      1 byte   chunkFlag bits
+//	session id 16 bytes raw session UUID
+//	socket id  16 bytes raw socket UUID
+//	sequence   8 bytes  big endian sequence ID, or cumulative ack
+//	length     4 bytes  big endian length of data
+//	data       length bytes, chunk data or selective acks
+//
+// Ack frames with the ackFlagWindow flag begin their data with the 8 byte
+// big endian receive window, followed by any selective acks.  Ping and
+// pong frames carry no data and nil IDs, and their sequence is the nonce
+// a pong echoes back from the ping it answers.  Control frames carry the
+// ControlType and duplicate bits in their flags, and a data byte holding
+// the ResetCode followed by the reason, or the destination of a
+// ControlOpen.  When control messages are negotiated, close chunks
+// without data are written as ControlClose frames.
+const frameHeaderSize = 46
+
+const (
+	frameChunk   byte = 1
+	frameAck     byte = 2
+	framePing    byte = 3
+	framePong    byte = 4
+	frameControl byte = 5
+)
+
+const (
+	chunkFlagClose byte = 1 << iota
+	chunkFlagDeflate
+	chunkFlagParity
+)
+
+// Chunk frame flag bits holding one less than the number of copies of the
+// chunk being sent over distinct routes
+const (
+	chunkDuplicatesShift      = 3
+	chunkFlagDuplicates  byte = 3 << chunkDuplicatesShift
+)
+
+const (
+	ackFlagWindow byte = 1 << iota
+)
+
+// Largest number of out of order sequence IDs sent in one Ack
+const maxSelectiveAcks = 32
+
+// Returned when a frame declares more data than the max chunk size
+// negotiated for its transport socket
+var ErrFrameTooLarge = errors.New("frame data exceeds negotiated max chunk size")
+
+// Returned when writing a frame that the socket's framing cannot carry
+var errUnsupportedFrame = errors.New("frame type requires binary framing")
+
+// A Heartbeat read from a transport socket, a ping to be answered or a
+// pong answering one
+type Heartbeat struct {
+	Pong  bool
+	Nonce uint64
+}
+
+// A chunkWriter writes chunks, acknowledgements and heartbeats to a
+// transport socket using whichever framing was negotiated for that socket
+type chunkWriter interface {
+	WriteChunk(Chunk) error
+	WriteAck(Ack) error
+	WriteControl(Control) error
+	WritePing(uint64) error
+	WritePong(uint64) error
+}
+
+// Create a chunkWriter for a transport socket with the negotiated features
+// that writes chunks of up to max_chunk_size bytes of data
+func newChunkWriter(socket net.Conn, features uint32, max_chunk_size int, logger *logger) (chunkWriter, error) {
+	if features&FeatureBinaryFraming != 0 {
+		return &frameWriter{socket: socket, features: features}, nil
+	}
+	return newTLJChunkWriter(socket, max_chunk_size, logger)
+}
+
+// A chunkReader reads the frames written by a chunkWriter on the other
+// end of a transport socket
+type chunkReader interface {
+	ReadFrame() (interface{}, error)
+}
+
+// Create a chunkReader for a transport socket with the negotiated features
+// that reads chunks of up to max_chunk_size bytes of data
+func newChunkReader(socket net.Conn, features uint32, max_chunk_size uint32, logger *logger) chunkReader {
+	if features&FeatureBinaryFraming != 0 {
+		return newFrameReader(socket, max_chunk_size)
+	}
+	return newTLJChunkReader(socket, logger)
+}
+
+// Writes binary frames to a socket.  A single buffer is reused so each
+// frame is written with one call to the underlying socket.
+type frameWriter struct {
+	socket   net.Conn
+	features uint32
+	buffer   []byte
+	mux      sync.Mutex
+}
+
+func (writer *frameWriter) WriteChunk(chunk Chunk) error {
+	if writer.features&FeatureStreamControl != 0 && chunk.Close && len(chunk.Data) == 0 && chunk.SequenceID != 0 && !chunk.Parity {
+		return writer.WriteControl(Control{
+			SessionID:  chunk.SessionID,
+			SocketID:   chunk.SocketID,
+			Type:       ControlClose,
+			Sequence:   chunk.SequenceID,
+			Duplicates: chunk.Duplicates,
+		})
+	}
+	flags := chunk.frameFlags()
+	if chunk.Parity {
+		flags |= chunkFlagParity
+	}
+	return writer.writeFrame(frameChunk, flags, chunk.SessionID, chunk.SocketID, chunk.SequenceID, len(chunk.Data), func(data []byte) {
+		copy(data, chunk.Data)
+	})
+}
+
+func (writer *frameWriter) WriteAck(ack Ack) error {
+	selective := ack.Selective
+	if len(selective) > maxSelectiveAcks {
+		selective = selective[:maxSelectiveAcks]
+	}
+	flags := byte(0)
+	offset := 0
+	if writer.features&FeatureFlowControl != 0 {
+		flags |= ackFlagWindow
+		offset = 8
+	}
+	return writer.writeFrame(frameAck, flags, ack.SessionID, ack.SocketID, ack.Cumulative, offset+8*len(selective), func(data []byte) {
+		if offset > 0 {
+			binary.BigEndian.PutUint64(data, ack.Window)
+		}
+		for i, sequence_id := range selective {
+			binary.BigEndian.PutUint64(data[offset+8*i:], sequence_id)
+		}
+	})
+}
+
+func (writer *frameWriter) WriteControl(control Control) error {
+	reason := truncateReason(control.Reason)
+	if control.Type == ControlOpen {
+		reason = control.Destination
+	}
+	flags := byte(control.Type) | duplicatesFlags(control.Duplicates)
+	return writer.writeFrame(frameControl, flags, control.SessionID, control.SocketID, control.Sequence, 1+len(reason), func(data []byte) {
+		data[0] = byte(control.Code)
+		copy(data[1:], reason)
+	})
+}
+
+func (writer *frameWriter) WritePing(nonce uint64) error {
+	return writer.writeFrame(framePing, 0, uuid.Nil.String(), uuid.Nil.String(), nonce, 0, func([]byte) {})
+}
+
+func (writer *frameWriter) WritePong(nonce uint64) error {
+	return writer.writeFrame(framePong, 0, uuid.Nil.String(), uuid.Nil.String(), nonce, 0, func([]byte) {})
+}
+
+// The frame flags describing a chunk's data
+func (chunk Chunk) frameFlags() byte {
+	flags := chunk.Compression.chunkFlag() | duplicatesFlags(chunk.Duplicates)
+	if chunk.Close {
+		flags |= chunkFlagClose
+	}
+	return flags
+}
+
+// Write one frame, using fill to place the frame data after the header
+func (writer *frameWriter) writeFrame(frame_type, flags byte, session, socket string, sequence uint64, length int, fill func([]byte)) error {
+	session_id, err := uuid.FromString(session)
+	if err != nil {
+		return fmt.Errorf("invalid session id in frame: %s", err.Error())
+	}
+	socket_id, err := uuid.FromString(socket)
+	if err != nil {
+		return fmt.Errorf("invalid socket id in frame: %s", err.Error())
+	}
+
+	writer.mux.Lock()
+	defer writer.mux.Unlock()
+	size := frameHeaderSize + length
+	if cap(writer.buffer) < size {
+		writer.buffer = make([]byte, size)
+	}
+	frame := writer.buffer[:size]
+	frame[0] = frame_type
+	frame[1] = flags
+	copy(frame[2:18], session_id.Bytes())
+	copy(frame[18:34], socket_id.Bytes())
+	binary.BigEndian.PutUint64(frame[34:42], sequence)
+	binary.BigEndian.PutUint32(frame[42:46], uint32(length))
+	fill(frame[frameHeaderSize:])
+	_, err = writer.socket.Write(frame)
+	return err
+}
+
+// Reads binary frames from a socket, refusing frames with more data
+// than the negotiated max chunk size
+type frameReader struct {
+	reader  *bufio.Reader
+	header  [frameHeaderSize]byte
+	maxSize uint32
+}
+
+func newFrameReader(socket net.Conn, max_size uint32) *frameReader {
+	return &frameReader{
+		reader:  bufio.NewReader(socket),
+		maxSize: max_size,
+	}
+}
+
+// Read the next frame, returning a *Chunk, an *Ack, a *Control or a
+// *Heartbeat.  ControlClose frames are returned as close chunks.
+func (reader *frameReader) ReadFrame() (interface{}, error) {
+	header := reader.header[:]
+	if _, err := io.ReadFull(reader.reader, header); err != nil {
+		return nil, err
+	}
+	frame_type := header[0]
+	flags := header[1]
+	length := binary.BigEndian.Uint32(header[42:46])
+	switch frame_type {
+	case frameChunk:
+		max_length := reader.maxSize
+		if flags&chunkFlagParity != 0 {
+			max_length += parityHeaderSize
+		}
+		if length > max_length {
+			return nil, ErrFrameTooLarge
+		}
+	case frameAck:
+		max_length := uint32(8 * maxSelectiveAcks)
+		if flags&ackFlagWindow != 0 {
+			max_length += 8
+			if length < 8 {
+				return nil, fmt.Errorf("invalid ack frame length %d", length)
+			}
+		}
+		if length > max_length || length%8 != 0 {
+			return nil, fmt.Errorf("invalid ack frame length %d", length)
+		}
+	case frameControl:
+		if length < 1 || length > 1+maxControlReason {
+			return nil, fmt.Errorf("invalid control frame length %d", length)
+		}
+	case framePing, framePong:
+		if length != 0 {
+			return nil, fmt.Errorf("invalid heartbeat frame length %d", length)
+		}
+		return &Heartbeat{
+			Pong:  frame_type == framePong,
+			Nonce: binary.BigEndian.Uint64(header[34:42]),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown frame type %d", frame_type)
+	}
+	session_id, err := uuid.FromBytes(header[2:18])
+	if err != nil {
+		return nil, err
+	}
+	socket_id, err := uuid.FromBytes(header[18:34])
+	if err != nil {
+		return nil, err
+	}
+	sequence := binary.BigEndian.Uint64(header[34:42])
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader.reader, data); err != nil {
+		return nil, err
+	}
+
+	if frame_type == frameAck {
+		window := uint64(0)
+		if flags&ackFlagWindow != 0 {
+			window = binary.BigEndian.Uint64(data)
+			data = data[8:]
+		}
+		selective := make([]uint64, len(data)/8)
+		for i := range selective {
+			selective[i] = binary.BigEndian.Uint64(data[8*i:])
+		}
+		return &Ack{
+			SessionID:  session_id.String(),
+			SocketID:   socket_id.String(),
+			Cumulative: sequence,
+			Selective:  selective,
+			Window:     window,
+		}, nil
+	}
+	if frame_type == frameControl {
+		control_type := ControlType(flags &^ chunkFlagDuplicates)
+		if control_type == ControlClose {
+			return &Chunk{
+				SessionID:  session_id.String(),
+				SocketID:   socket_id.String(),
+				SequenceID: sequence,
+				Data:       []byte{},
+				Close:      true,
+				Duplicates: flaggedDuplicates(flags),
+			}, nil
+		}
+		control := &Control{
+			SessionID:  session_id.String(),
+			SocketID:   socket_id.String(),
+			Type:       control_type,
+			Sequence:   sequence,
+			Duplicates: flaggedDuplicates(flags),
+			Code:       ResetCode(data[0]),
+		}
+		if control_type == ControlOpen {
+			control.Destination = string(data[1:])
+		} else {
+			control.Reason = string(data[1:])
+		}
+		return control, nil
+	}
+	if flags&chunkFlagParity != 0 {
+		return &Chunk{
+			SessionID:  session_id.String(),
+			SocketID:   socket_id.String(),
+			SequenceID: sequence,
+			Data:       data,
+			Parity:     true,
+		}, nil
+	}
+	return &Chunk{
+		SessionID:   session_id.String(),
+		SocketID:    socket_id.String(),
+		SequenceID:  sequence,
+		Data:        data,
+		Close:       flags&chunkFlagClose != 0,
+		Compression: flaggedCompression(flags),
+		Duplicates:  flaggedDuplicates(flags),
+	}, nil
+}
@@ -0,0 +1,241 @@
+package imux
+
+import (
+	"bytes"
+	"errors"
+	"github.com/satori/go.uuid"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// Write one frame to one end of a pipe and read it back from the other
+func roundTrip(t *testing.T, features uint32, max_size uint32, write func(*frameWriter) error) (interface{}, error) {
+	t.Helper()
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	written := make(chan error, 1)
+	go func() {
+		written <- write(&frameWriter{socket: local, features: features})
+	}()
+	frame, err := newFrameReader(remote, max_size).ReadFrame()
+	if err != nil {
+		remote.Close()
+	}
+	if write_err := <-written; write_err != nil && err == nil {
+		t.Fatalf("error writing frame: %v", write_err)
+	}
+	return frame, err
+}
+
+func TestFrameChunkRoundTrip(t *testing.T) {
+	sent := Chunk{
+		SessionID:   uuid.NewV4().String(),
+		SocketID:    uuid.NewV4().String(),
+		SequenceID:  42,
+		Data:        []byte("some chunk data"),
+		Close:       true,
+		Compression: CompressionDeflate,
+		Duplicates:  2,
+	}
+	frame, err := roundTrip(t, supportedFeatures, 64, func(writer *frameWriter) error {
+		return writer.WriteChunk(sent)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, ok := frame.(*Chunk)
+	if !ok {
+		t.Fatalf("expected *Chunk, read %T", frame)
+	}
+	if !reflect.DeepEqual(*received, sent) {
+		t.Fatalf("expected %+v, read %+v", sent, *received)
+	}
+}
+
+func TestFrameParityChunkRoundTrip(t *testing.T) {
+	sent := Chunk{
+		SessionID:  uuid.NewV4().String(),
+		SocketID:   uuid.NewV4().String(),
+		SequenceID: 5,
+		Data:       bytes.Repeat([]byte{1}, 16+parityHeaderSize),
+		Parity:     true,
+	}
+	frame, err := roundTrip(t, supportedFeatures, 16, func(writer *frameWriter) error {
+		return writer.WriteChunk(sent)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, ok := frame.(*Chunk)
+	if !ok || !received.Parity || !bytes.Equal(received.Data, sent.Data) || received.SequenceID != sent.SequenceID {
+		t.Fatalf("expected parity chunk %+v, read %+v", sent, frame)
+	}
+}
+
+func TestFrameCloseChunkAsControl(t *testing.T) {
+	sent := Chunk{
+		SessionID:  uuid.NewV4().String(),
+		SocketID:   uuid.NewV4().String(),
+		SequenceID: 9,
+		Data:       []byte{},
+		Close:      true,
+		Duplicates: 1,
+	}
+	frame, err := roundTrip(t, supportedFeatures, 64, func(writer *frameWriter) error {
+		return writer.WriteChunk(sent)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, ok := frame.(*Chunk)
+	if !ok {
+		t.Fatalf("expected *Chunk, read %T", frame)
+	}
+	if !reflect.DeepEqual(*received, sent) {
+		t.Fatalf("expected %+v, read %+v", sent, *received)
+	}
+}
+
+func TestFrameAckRoundTrip(t *testing.T) {
+	sent := Ack{
+		SessionID:  uuid.NewV4().String(),
+		SocketID:   uuid.NewV4().String(),
+		Cumulative: 7,
+		Selective:  []uint64{9, 12},
+		Window:     71,
+	}
+	frame, err := roundTrip(t, supportedFeatures, 64, func(writer *frameWriter) error {
+		return writer.WriteAck(sent)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, ok := frame.(*Ack)
+	if !ok {
+		t.Fatalf("expected *Ack, read %T", frame)
+	}
+	if !reflect.DeepEqual(*received, sent) {
+		t.Fatalf("expected %+v, read %+v", sent, *received)
+	}
+}
+
+func TestFrameAckWithoutFlowControl(t *testing.T) {
+	sent := Ack{
+		SessionID:  uuid.NewV4().String(),
+		SocketID:   uuid.NewV4().String(),
+		Cumulative: 3,
+		Selective:  []uint64{},
+		Window:     10,
+	}
+	frame, err := roundTrip(t, FeatureBinaryFraming|FeatureAcknowledgements, 64, func(writer *frameWriter) error {
+		return writer.WriteAck(sent)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, ok := frame.(*Ack)
+	if !ok {
+		t.Fatalf("expected *Ack, read %T", frame)
+	}
+	if received.Window != 0 || received.Cumulative != sent.Cumulative {
+		t.Fatalf("expected cumulative ack %d without a window, read %+v", sent.Cumulative, *received)
+	}
+}
+
+func TestFrameControlRoundTrip(t *testing.T) {
+	for _, sent := range []Control{
+		{
+			SessionID:   uuid.NewV4().String(),
+			SocketID:    uuid.NewV4().String(),
+			Type:        ControlOpen,
+			Duplicates:  2,
+			Destination: "example.com:443",
+		},
+		{
+			SessionID:  uuid.NewV4().String(),
+			SocketID:   uuid.NewV4().String(),
+			Type:       ControlOpenFail,
+			Duplicates: 1,
+			Code:       ResetRefused,
+			Reason:     "connection refused",
+		},
+		{
+			SessionID:  uuid.NewV4().String(),
+			SocketID:   uuid.NewV4().String(),
+			Type:       ControlReset,
+			Sequence:   30,
+			Duplicates: 1,
+			Code:       ResetUnknown,
+			Reason:     "stream reset",
+		},
+	} {
+		frame, err := roundTrip(t, supportedFeatures, 64, func(writer *frameWriter) error {
+			return writer.WriteControl(sent)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		received, ok := frame.(*Control)
+		if !ok {
+			t.Fatalf("expected *Control, read %T", frame)
+		}
+		if !reflect.DeepEqual(*received, sent) {
+			t.Fatalf("expected %+v, read %+v", sent, *received)
+		}
+	}
+}
+
+func TestFrameHeartbeatRoundTrip(t *testing.T) {
+	frame, err := roundTrip(t, supportedFeatures, 64, func(writer *frameWriter) error {
+		return writer.WritePing(1234)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if heartbeat, ok := frame.(*Heartbeat); !ok || heartbeat.Pong || heartbeat.Nonce != 1234 {
+		t.Fatalf("expected ping 1234, read %+v", frame)
+	}
+	frame, err = roundTrip(t, supportedFeatures, 64, func(writer *frameWriter) error {
+		return writer.WritePong(1234)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if heartbeat, ok := frame.(*Heartbeat); !ok || !heartbeat.Pong || heartbeat.Nonce != 1234 {
+		t.Fatalf("expected pong 1234, read %+v", frame)
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	chunk := Chunk{
+		SessionID:  uuid.NewV4().String(),
+		SocketID:   uuid.NewV4().String(),
+		SequenceID: 1,
+		Data:       make([]byte, 65),
+	}
+	_, err := roundTrip(t, supportedFeatures, 64, func(writer *frameWriter) error {
+		return writer.WriteChunk(chunk)
+	})
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("expected ErrFrameTooLarge, read %v", err)
+	}
+
+	chunk.Parity = true
+	chunk.Data = make([]byte, 64+parityHeaderSize+1)
+	_, err = roundTrip(t, supportedFeatures, 64, func(writer *frameWriter) error {
+		return writer.WriteChunk(chunk)
+	})
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("expected ErrFrameTooLarge for parity chunk, read %v", err)
+	}
+}
+
+func TestFrameInvalidIDs(t *testing.T) {
+	writer := &frameWriter{features: supportedFeatures}
+	err := writer.WriteChunk(Chunk{SessionID: "not a uuid", SocketID: uuid.NewV4().String()})
+	if err == nil {
+		t.Fatal("expected an error writing a chunk with an invalid session id")
+	}
+}
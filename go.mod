@@ -0,0 +1,25 @@
+module github.com/hkparker/imux
+
+go 1.23
+
+// github.com/hkparker/TLJ, used for the legacy TLJ framing, has no tagged
+// release and is not served by proxy.golang.org; add it from GitHub with
+// "GOPRIVATE=github.com/hkparker/TLJ go get github.com/hkparker/TLJ"
+// before the first build.
+
+require (
+	github.com/coder/websocket v1.8.15
+	github.com/quic-go/quic-go v0.53.0
+	github.com/satori/go.uuid v1.2.0
+	golang.org/x/net v0.28.0
+)
+
+require (
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/crypto v0.26.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sys v0.23.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
+	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
+)
@@ -0,0 +1,59 @@
+package imux
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// Sockets whose write side can be shut down on its own, such as TCP and
+// unix sockets
+type halfCloser interface {
+	CloseWrite() error
+}
+
+// A socket at either end of a logical stream that half-closes.  When the
+// peer finishes writing, only the write side of the socket is shut down,
+// and the socket is fully closed once reading from it has also reached
+// EOF, so each direction of the stream finishes on its own.
+type halfClosingConn struct {
+	net.Conn
+	mux         sync.Mutex
+	readClosed  bool
+	writeClosed bool
+}
+
+// Wrap a socket so its stream can half-close
+func newHalfClosingConn(socket net.Conn) *halfClosingConn {
+	return &halfClosingConn{Conn: socket}
+}
+
+// Read from the socket, closing it if reading reaches EOF after the write
+// side was already shut down
+func (conn *halfClosingConn) Read(data []byte) (int, error) {
+	read, err := conn.Conn.Read(data)
+	if err == io.EOF {
+		conn.mux.Lock()
+		conn.readClosed = true
+		done := conn.writeClosed
+		conn.mux.Unlock()
+		if done {
+			conn.Conn.Close()
+		}
+	}
+	return read, err
+}
+
+// Shut down the write side of the socket, closing it if reading already
+// reached EOF or the socket cannot be half-closed
+func (conn *halfClosingConn) CloseWrite() error {
+	conn.mux.Lock()
+	conn.writeClosed = true
+	done := conn.readClosed
+	conn.mux.Unlock()
+	closer, ok := conn.Conn.(halfCloser)
+	if done || !ok {
+		return conn.Conn.Close()
+	}
+	return closer.CloseWrite()
+}
@@ -0,0 +1,39 @@
+package imux
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestHalfClose(t *testing.T) {
+	pair := newLoopback(t, DefaultOptions(), map[string]int{"127.0.0.1": 2})
+	pair.start(t)
+	conn := pair.dial(t)
+	stream := pair.accept(t)
+
+	request := randomPayload(t, 50000)
+	reply := randomPayload(t, 50000)
+	go func() {
+		conn.Write(request)
+		conn.(halfCloser).CloseWrite()
+	}()
+	received, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, request) {
+		t.Fatal("stream data does not match what was written before the write side closed")
+	}
+	if _, err := stream.Write(reply); err != nil {
+		t.Fatalf("expected the stream to stay writable after the peer closed its write side, got %v", err)
+	}
+	stream.Close()
+	received, err = io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, reply) {
+		t.Fatal("reply does not match what was written after the write side closed")
+	}
+}
@@ -0,0 +1,259 @@
+package imux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"io"
+	"net"
+	"time"
+)
+
+// Transport sockets begin with a hello/hello-ack exchange so both peers
+// know each other's protocol version, session, chunk size limit and
+// supported features before any chunks are sent.  The dialing side sends
+// a hello and the accepting side answers with a hello-ack that either
+// accepts the socket with the features both sides share and the smaller
+// of both chunk size limits, or rejects it with a reason.  Peers that
+// predate the handshake start writing TLJ data right away, which the
+// accepting side detects by the missing magic.
+//
+//	magic       4 bytes "IMUX"
+//	version     2 bytes big endian protocol version
+//	status      1 byte  helloAccepted or helloRejected, always accepted in a hello
+//	features    4 bytes big endian feature bitmap
+//	max chunk   4 bytes big endian largest chunk data the sender will accept
+//	session id  16 bytes raw session UUID
+//	reason len  2 bytes big endian length of reason
+//	reason      reason len bytes, why a hello was rejected
+var handshakeMagic = []byte("IMUX")
+
+const helloHeaderSize = 33
+
+// Version of the transport protocol spoken after the handshake.  Peers
+// with a different version are rejected.
+const ProtocolVersion uint16 = 1
+
+const (
+	helloAccepted byte = iota
+	helloRejected
+)
+
+// Optional protocol features negotiated per transport socket
+const (
+	// Chunks are written as binary frames instead of TLJ encoded JSON
+	FeatureBinaryFraming uint32 = 1 << iota
+	// Received chunks are acknowledged so lost chunks can be retransmitted
+	FeatureAcknowledgements
+	// Acknowledgements advertise a receive window that senders wait on
+	FeatureFlowControl
+	// Chunk data may be compressed with DEFLATE
+	FeatureDeflate
+	// Groups of chunks are followed by parity chunks to rebuild lost chunks
+	FeatureParity
+	// Chunks may be sent over several routes at once, with copies dropped
+	FeatureDuplicates
+	// Transport sockets are pinged to measure round trip times and
+	// detect sockets that stopped delivering
+	FeatureHeartbeats
+	// Close chunks shut down only the write side of the peer's socket
+	FeatureHalfClose
+	// Streams are opened, reset and closed with typed control messages
+	FeatureStreamControl
+	// Streams may be opened to an address named by the Client instead of
+	// the Server's own destination
+	FeatureDestinations
+)
+
+// All features supported by this version of imux
+const supportedFeatures = FeatureBinaryFraming | FeatureAcknowledgements | FeatureFlowControl | FeatureDeflate | FeatureParity | FeatureDuplicates | FeatureHeartbeats | FeatureHalfClose | FeatureStreamControl | FeatureDestinations
+
+// Returned when the accepting side does not answer a hello, indicating
+// it predates the handshake and only understands TLJ chunks
+var errLegacyPeer = errors.New("peer does not support transport handshake")
+
+// A HandshakeError is returned when a peer rejects a transport socket
+// during the handshake, such as for an incompatible protocol version
+type HandshakeError struct {
+	Reason string
+}
+
+func (err HandshakeError) Error() string {
+	return "transport handshake rejected: " + err.Reason
+}
+
+// The parameters a transport socket negotiates: the protocol version, the
+// session it carries, the largest chunk data the sender will accept and
+// the features it supports.  Once negotiated, MaxChunkSize is the largest
+// chunk data both sides accept, which both chunk their data to fit.
+type Hello struct {
+	Version      uint16
+	Features     uint32
+	MaxChunkSize uint32
+	SessionID    string
+}
+
+// A hello or hello-ack as written during the handshake
+type hello struct {
+	Hello
+	Status byte
+	Reason string
+}
+
+func (message hello) marshal() ([]byte, error) {
+	session_id, err := uuid.FromString(message.SessionID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session id in hello: %s", err.Error())
+	}
+	data := make([]byte, helloHeaderSize+len(message.Reason))
+	copy(data[0:4], handshakeMagic)
+	binary.BigEndian.PutUint16(data[4:6], message.Version)
+	data[6] = message.Status
+	binary.BigEndian.PutUint32(data[7:11], message.Features)
+	binary.BigEndian.PutUint32(data[11:15], message.MaxChunkSize)
+	copy(data[15:31], session_id.Bytes())
+	binary.BigEndian.PutUint16(data[31:33], uint16(len(message.Reason)))
+	copy(data[helloHeaderSize:], message.Reason)
+	return data, nil
+}
+
+// Read the remainder of a hello or hello-ack after its magic
+func readHello(reader io.Reader) (hello, error) {
+	message := hello{}
+	data := make([]byte, helloHeaderSize-len(handshakeMagic))
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return message, err
+	}
+	session_id, err := uuid.FromBytes(data[11:27])
+	if err != nil {
+		return message, err
+	}
+	reason := make([]byte, binary.BigEndian.Uint16(data[27:29]))
+	if _, err := io.ReadFull(reader, reason); err != nil {
+		return message, err
+	}
+	message.Version = binary.BigEndian.Uint16(data[0:2])
+	message.Status = data[2]
+	message.Features = binary.BigEndian.Uint32(data[3:7])
+	message.MaxChunkSize = binary.BigEndian.Uint32(data[7:11])
+	message.SessionID = session_id.String()
+	message.Reason = string(reason)
+	return message, nil
+}
+
+// Send a hello on a newly dialed transport socket and return the
+// hello-ack, with the features and max chunk size both sides agreed to.
+// The server has timeout to answer.
+func clientHandshake(socket net.Conn, local Hello, timeout time.Duration) (Hello, error) {
+	socket.SetDeadline(time.Now().Add(timeout))
+	defer socket.SetDeadline(time.Time{})
+
+	data, err := hello{Hello: local}.marshal()
+	if err != nil {
+		return Hello{}, err
+	}
+	if _, err := socket.Write(data); err != nil {
+		return Hello{}, err
+	}
+	magic := make([]byte, len(handshakeMagic))
+	if _, err := io.ReadFull(socket, magic); err != nil {
+		if net_err, ok := err.(net.Error); ok && net_err.Timeout() {
+			return Hello{}, errLegacyPeer
+		}
+		return Hello{}, err
+	}
+	if !bytes.Equal(magic, handshakeMagic) {
+		return Hello{}, errLegacyPeer
+	}
+	ack, err := readHello(socket)
+	if err != nil {
+		return ack.Hello, err
+	}
+	if ack.Status != helloAccepted {
+		return ack.Hello, HandshakeError{Reason: ack.Reason}
+	}
+	if ack.Version != local.Version {
+		return ack.Hello, HandshakeError{
+			Reason: fmt.Sprintf("server answered with protocol version %d, expected %d", ack.Version, local.Version),
+		}
+	}
+	if ack.MaxChunkSize == 0 {
+		return ack.Hello, HandshakeError{Reason: "server answered with a max chunk size of zero"}
+	}
+	ack.Features &= local.Features
+	ack.MaxChunkSize = min(ack.MaxChunkSize, local.MaxChunkSize)
+	return ack.Hello, nil
+}
+
+// Read the hello from a newly accepted transport socket and answer with
+// a hello-ack.  Sockets from peers that predate the handshake are
+// returned wrapped so the bytes already consumed are read again by TLJ,
+// along with a false accepted value.  Once the magic is read the peer has
+// timeout to complete the handshake, while peers that predate it may stay
+// idle as long as they like before sending their first TLJ data.
+func serverHandshake(socket net.Conn, local Hello, timeout time.Duration) (net.Conn, Hello, bool, error) {
+	magic := make([]byte, len(handshakeMagic))
+	read, err := io.ReadFull(socket, magic)
+	if err != nil {
+		return socket, Hello{}, false, err
+	}
+	if !bytes.Equal(magic, handshakeMagic) {
+		return &replayConn{
+			Conn:   socket,
+			reader: io.MultiReader(bytes.NewReader(magic[:read]), socket),
+		}, Hello{}, false, nil
+	}
+	socket.SetDeadline(time.Now().Add(timeout))
+	defer socket.SetDeadline(time.Time{})
+
+	remote, err := readHello(socket)
+	if err != nil {
+		return socket, remote.Hello, false, err
+	}
+	ack := hello{Hello: local}
+	ack.SessionID = remote.SessionID
+	ack.Features = local.Features & remote.Features
+	ack.MaxChunkSize = min(local.MaxChunkSize, remote.MaxChunkSize)
+	if reason := incompatibility(local, remote.Hello); reason != "" {
+		ack.Status = helloRejected
+		ack.Reason = reason
+	}
+	data, err := ack.marshal()
+	if err != nil {
+		return socket, remote.Hello, false, err
+	}
+	if _, err := socket.Write(data); err != nil {
+		return socket, remote.Hello, false, err
+	}
+	if ack.Status != helloAccepted {
+		return socket, remote.Hello, false, HandshakeError{Reason: ack.Reason}
+	}
+	remote.Features = ack.Features
+	remote.MaxChunkSize = ack.MaxChunkSize
+	return socket, remote.Hello, true, nil
+}
+
+// Describe why a remote hello cannot be accepted, or return an empty
+// string if it is compatible
+func incompatibility(local, remote Hello) string {
+	if remote.Version != local.Version {
+		return fmt.Sprintf("unsupported protocol version %d, server speaks version %d", remote.Version, local.Version)
+	}
+	if remote.MaxChunkSize == 0 {
+		return "max chunk size must be greater than zero"
+	}
+	return ""
+}
+
+// A net.Conn that reads from an alternate reader, used to put back data
+// consumed while checking for a hello
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (conn *replayConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
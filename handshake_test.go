@@ -0,0 +1,207 @@
+package imux
+
+import (
+	"errors"
+	"github.com/satori/go.uuid"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// The result of a serverHandshake run alongside a test
+type serverResult struct {
+	socket   net.Conn
+	remote   Hello
+	accepted bool
+	err      error
+}
+
+func startServerHandshake(socket net.Conn, local Hello, timeout time.Duration) chan serverResult {
+	results := make(chan serverResult, 1)
+	go func() {
+		conn, remote, accepted, err := serverHandshake(socket, local, timeout)
+		results <- serverResult{conn, remote, accepted, err}
+	}()
+	return results
+}
+
+func TestHandshakeAccepted(t *testing.T) {
+	client_socket, server_socket := net.Pipe()
+	defer client_socket.Close()
+	defer server_socket.Close()
+	results := startServerHandshake(server_socket, Hello{
+		Version:      ProtocolVersion,
+		Features:     FeatureBinaryFraming | FeatureAcknowledgements | FeatureParity,
+		MaxChunkSize: 512,
+		SessionID:    uuid.Nil.String(),
+	}, time.Second)
+	session_id := uuid.NewV4().String()
+	ack, err := clientHandshake(client_socket, Hello{
+		Version:      ProtocolVersion,
+		Features:     FeatureBinaryFraming | FeatureAcknowledgements | FeatureHeartbeats,
+		MaxChunkSize: 1024,
+		SessionID:    session_id,
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := <-results
+	if result.err != nil || !result.accepted {
+		t.Fatalf("expected server to accept the hello, got %v", result.err)
+	}
+
+	features := FeatureBinaryFraming | FeatureAcknowledgements
+	if ack.Features != features || result.remote.Features != features {
+		t.Fatalf("expected features %b on both sides, client has %b and server has %b", features, ack.Features, result.remote.Features)
+	}
+	if ack.MaxChunkSize != 512 || result.remote.MaxChunkSize != 512 {
+		t.Fatalf("expected max chunk size 512 on both sides, client has %d and server has %d", ack.MaxChunkSize, result.remote.MaxChunkSize)
+	}
+	if ack.SessionID != session_id || result.remote.SessionID != session_id {
+		t.Fatalf("expected session %s on both sides, client has %s and server has %s", session_id, ack.SessionID, result.remote.SessionID)
+	}
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	client_socket, server_socket := net.Pipe()
+	defer client_socket.Close()
+	defer server_socket.Close()
+	results := startServerHandshake(server_socket, Hello{
+		Version:      ProtocolVersion,
+		Features:     supportedFeatures,
+		MaxChunkSize: 512,
+		SessionID:    uuid.Nil.String(),
+	}, time.Second)
+	_, err := clientHandshake(client_socket, Hello{
+		Version:      ProtocolVersion + 1,
+		Features:     supportedFeatures,
+		MaxChunkSize: 512,
+		SessionID:    uuid.NewV4().String(),
+	}, time.Second)
+	var handshake_err HandshakeError
+	if !errors.As(err, &handshake_err) || handshake_err.Reason == "" {
+		t.Fatalf("expected client to read a HandshakeError with a reason, got %v", err)
+	}
+	result := <-results
+	if result.accepted || !errors.As(result.err, &handshake_err) {
+		t.Fatalf("expected server to reject the hello with a HandshakeError, got %v", result.err)
+	}
+}
+
+func TestHandshakeLegacyClient(t *testing.T) {
+	client_socket, server_socket := net.Pipe()
+	defer client_socket.Close()
+	defer server_socket.Close()
+	results := startServerHandshake(server_socket, Hello{
+		Version:      ProtocolVersion,
+		Features:     supportedFeatures,
+		MaxChunkSize: 512,
+		SessionID:    uuid.Nil.String(),
+	}, time.Second)
+	legacy := []byte(`{"a":"session","b":"socket"}`)
+	go client_socket.Write(legacy)
+
+	result := <-results
+	if result.err != nil || result.accepted {
+		t.Fatalf("expected server to pass a legacy socket on unaccepted, got %v", result.err)
+	}
+	if _, ok := result.socket.(*replayConn); !ok {
+		t.Fatalf("expected legacy socket to be a *replayConn, got %T", result.socket)
+	}
+	replayed := make([]byte, len(legacy))
+	if _, err := io.ReadFull(result.socket, replayed); err != nil {
+		t.Fatal(err)
+	}
+	if string(replayed) != string(legacy) {
+		t.Fatalf("expected the legacy data to be replayed, read %q", replayed)
+	}
+}
+
+func TestHandshakeIdleLegacyClient(t *testing.T) {
+	client_socket, server_socket := net.Pipe()
+	defer client_socket.Close()
+	defer server_socket.Close()
+	results := startServerHandshake(server_socket, Hello{
+		Version:      ProtocolVersion,
+		Features:     supportedFeatures,
+		MaxChunkSize: 512,
+		SessionID:    uuid.Nil.String(),
+	}, 20*time.Millisecond)
+	legacy := []byte(`{"a":"session","b":"socket"}`)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		client_socket.Write(legacy)
+	}()
+
+	result := <-results
+	if result.err != nil || result.accepted {
+		t.Fatalf("expected a legacy socket idle past the handshake timeout to be passed on, got %v", result.err)
+	}
+	replayed := make([]byte, len(legacy))
+	if _, err := io.ReadFull(result.socket, replayed); err != nil {
+		t.Fatal(err)
+	}
+	if string(replayed) != string(legacy) {
+		t.Fatalf("expected the legacy data to be replayed, read %q", replayed)
+	}
+}
+
+func TestHandshakeTimeoutAfterMagic(t *testing.T) {
+	client_socket, server_socket := net.Pipe()
+	defer client_socket.Close()
+	defer server_socket.Close()
+	results := startServerHandshake(server_socket, Hello{
+		Version:      ProtocolVersion,
+		Features:     supportedFeatures,
+		MaxChunkSize: 512,
+		SessionID:    uuid.Nil.String(),
+	}, 20*time.Millisecond)
+	go client_socket.Write(handshakeMagic)
+
+	select {
+	case result := <-results:
+		var net_err net.Error
+		if !errors.As(result.err, &net_err) || !net_err.Timeout() {
+			t.Fatalf("expected a hello stalled after its magic to time out, got %v", result.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handshake stalled after the magic never timed out")
+	}
+}
+
+func TestHandshakeLegacyServer(t *testing.T) {
+	client_socket, server_socket := net.Pipe()
+	defer client_socket.Close()
+	defer server_socket.Close()
+	go io.Copy(io.Discard, server_socket)
+	_, err := clientHandshake(client_socket, Hello{
+		Version:      ProtocolVersion,
+		Features:     supportedFeatures,
+		MaxChunkSize: 512,
+		SessionID:    uuid.NewV4().String(),
+	}, 50*time.Millisecond)
+	if !errors.Is(err, errLegacyPeer) {
+		t.Fatalf("expected errLegacyPeer from a server that never answers, got %v", err)
+	}
+}
+
+func TestHandshakeLegacyServerAnswer(t *testing.T) {
+	client_socket, server_socket := net.Pipe()
+	defer client_socket.Close()
+	defer server_socket.Close()
+	go func() {
+		hello := make([]byte, helloHeaderSize)
+		io.ReadFull(server_socket, hello)
+		server_socket.Write([]byte(`{"a":`))
+	}()
+	_, err := clientHandshake(client_socket, Hello{
+		Version:      ProtocolVersion,
+		Features:     supportedFeatures,
+		MaxChunkSize: 512,
+		SessionID:    uuid.NewV4().String(),
+	}, time.Second)
+	if !errors.Is(err, errLegacyPeer) {
+		t.Fatalf("expected errLegacyPeer from a server answering without the magic, got %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package imux
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Returned when a transport socket stops answering pings
+var errHeartbeatTimeout = errors.New("transport socket stopped answering heartbeats")
+
+// The state of one transport socket shared by the goroutines reading from
+// and writing to it.  Route names the bind or peer address the socket
+// travels over, and chunks written to it may carry up to maxChunkSize
+// bytes of data.  Closed is closed once reading from the socket fails.
+// Heartbeat times are measured on the monotonic clock since start, so
+// wall clock changes do not skew round trip times or time out sockets.
+// The times come first to stay aligned for atomic access.
+type transportSocket struct {
+	lastPong     int64
+	rtt          int64
+	conn         TransportConn
+	route        string
+	features     uint32
+	maxChunkSize int
+	closed       chan struct{}
+	queued       chan Chunk
+	start        time.Time
+	timedOut     int32
+	options      *Options
+	logger       *logger
+}
+
+// Create the state for a transport socket with the negotiated features and
+// max chunk size, or the ChunkSize option for peers that predate the
+// handshake
+func newTransportSocket(conn TransportConn, features uint32, max_chunk_size uint32, options *Options, logger *logger) *transportSocket {
+	if max_chunk_size == 0 {
+		max_chunk_size = uint32(options.ChunkSize)
+	}
+	return &transportSocket{
+		conn:         conn,
+		route:        conn.Route(),
+		features:     features,
+		maxChunkSize: int(max_chunk_size),
+		closed:       make(chan struct{}),
+		queued:       make(chan Chunk, options.TransportQueueDepth),
+		start:        time.Now(),
+		options:      options,
+		logger:       logger,
+	}
+}
+
+// The route of a transport socket accepted by a server, the address of
+// the peer that dialed it
+func peerRoute(socket net.Conn) string {
+	route, _, err := net.SplitHostPort(socket.RemoteAddr().String())
+	if err != nil {
+		return socket.RemoteAddr().String()
+	}
+	return route
+}
+
+// Check if the peer acknowledges chunks written to this transport socket
+func (transport *transportSocket) reliable() bool {
+	return transport.features&FeatureAcknowledgements != 0
+}
+
+// Check that a chunk's data fits the transport socket's max chunk size,
+// along with the parity header of parity chunks
+func (transport *transportSocket) fits(chunk *Chunk) error {
+	limit := transport.maxChunkSize
+	if chunk.Parity {
+		limit += parityHeaderSize
+	}
+	if len(chunk.Data) > limit {
+		return ErrFrameTooLarge
+	}
+	return nil
+}
+
+// Check if pings are exchanged over this transport socket
+func (transport *transportSocket) heartbeats() bool {
+	return transport.features&FeatureHeartbeats != 0
+}
+
+// Ping the transport socket every HeartbeatInterval until stop is closed,
+// closing the socket if a ping goes unanswered for HeartbeatTimeout.  The
+// socket is closed rather than left to its writer, which may be blocked
+// on a socket that stopped delivering.  Pings are written from their own
+// goroutine so one stuck behind that writer doesn't hold up the check,
+// and no new ping is written until the last one is out.
+func (transport *transportSocket) keepAlive(stop chan struct{}) {
+	ticker := time.NewTicker(transport.options.HeartbeatInterval)
+	defer ticker.Stop()
+	pinged := make(chan error, 1)
+	pinging := false
+	for {
+		select {
+		case <-stop:
+			return
+		case err := <-pinged:
+			pinging = false
+			if err != nil {
+				return
+			}
+		case <-ticker.C:
+			now := transport.elapsed()
+			since_pong := now - time.Duration(atomic.LoadInt64(&transport.lastPong))
+			if since_pong > transport.options.HeartbeatTimeout {
+				transport.logger.Warn("transport socket stopped answering heartbeats",
+					"at", "transportSocket.keepAlive",
+					"route", transport.route,
+					"since_pong", since_pong.String(),
+				)
+				atomic.StoreInt32(&transport.timedOut, 1)
+				transport.conn.Close()
+				return
+			}
+			if !pinging {
+				pinging = true
+				go func() {
+					pinged <- transport.conn.WritePing(uint64(now))
+				}()
+			}
+		}
+	}
+}
+
+// How long ago the transport socket was created, on the monotonic clock
+func (transport *transportSocket) elapsed() time.Duration {
+	return time.Since(transport.start)
+}
+
+// The error a transport socket failed with, replaced by errHeartbeatTimeout
+// if it was closed for not answering heartbeats
+func (transport *transportSocket) failure(err error) error {
+	if atomic.LoadInt32(&transport.timedOut) != 0 {
+		return errHeartbeatTimeout
+	}
+	return err
+}
+
+// Handle a heartbeat read from the transport socket, answering pings and
+// recording pongs
+func (transport *transportSocket) heartbeat(frame *Heartbeat) {
+	if frame.Pong {
+		transport.pong(frame.Nonce)
+		return
+	}
+	if err := transport.conn.WritePong(frame.Nonce); err != nil {
+		if transport.logger.debugging() {
+			transport.logger.Debug("error answering heartbeat",
+				"at", "transportSocket.heartbeat",
+				"route", transport.route,
+				"error", err,
+			)
+		}
+	}
+}
+
+// Record a pong read from the transport socket, sampling the round trip
+// time from the elapsed time carried in the ping it answers
+func (transport *transportSocket) pong(nonce uint64) {
+	now := int64(transport.elapsed())
+	if nonce == 0 || int64(nonce) > now {
+		return
+	}
+	atomic.StoreInt64(&transport.lastPong, now)
+	sample := now - int64(nonce)
+	smoothed := atomic.LoadInt64(&transport.rtt)
+	if smoothed != 0 {
+		sample = smoothed + (sample-smoothed)/8
+	}
+	atomic.StoreInt64(&transport.rtt, sample)
+	if transport.logger.debugging() {
+		transport.logger.Debug("heartbeat answered",
+			"at", "transportSocket.pong",
+			"route", transport.route,
+			"rtt", time.Duration(sample).String(),
+		)
+	}
+}
+
+// The smoothed round trip time of the transport socket, or 0 if no
+// ping has been answered yet
+func (transport *transportSocket) roundTripTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&transport.rtt))
+}
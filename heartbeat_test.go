@@ -0,0 +1,57 @@
+package imux
+
+import (
+	"github.com/satori/go.uuid"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKeepAliveBehindBlockedWriter(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := newFramedConn(local, "pipe", true, newLogger(nil))
+	if err := conn.frame(supportedFeatures, 64); err != nil {
+		t.Fatal(err)
+	}
+	options := DefaultOptions()
+	options.HeartbeatInterval = 10 * time.Millisecond
+	options.HeartbeatTimeout = 30 * time.Millisecond
+	transport := newTransportSocket(conn, supportedFeatures, 64, &options, newLogger(nil))
+
+	// The peer never reads, so this write holds the writer until the
+	// socket is closed
+	written := make(chan error, 1)
+	go func() {
+		written <- conn.WriteChunk(Chunk{
+			SessionID:  uuid.NewV4().String(),
+			SocketID:   uuid.NewV4().String(),
+			SequenceID: 1,
+			Data:       []byte("stuck"),
+		})
+	}()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	stopped := make(chan struct{})
+	go func() {
+		transport.keepAlive(stop)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("heartbeat check was held up by the blocked writer")
+	}
+	if transport.failure(nil) != errHeartbeatTimeout {
+		t.Fatal("expected the transport socket to be timed out")
+	}
+	select {
+	case err := <-written:
+		if err == nil {
+			t.Fatal("expected the blocked write to fail once the socket was closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked write was not released by closing the socket")
+	}
+}
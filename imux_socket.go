@@ -1,138 +1,230 @@
 package imux
 
 import (
-	log "github.com/Sirupsen/logrus"
-	"github.com/hkparker/TLJ"
 	"net"
-	"reflect"
-	"sync"
-	"time"
 )
 
-// A function that can be called by an IMUXSocket to reconnect after an error
+// A function that can be called by a ConnTransport to dial a transport
+// socket, again after each error
 type Redialer func() (net.Conn, error)
 
 // A function that generates Redialers for specific bind addresses
 type RedialerGenerator func(string) Redialer
 
-// A map of all TLJ servers used to read chunks back from sessions
-var sessionResponsesTLJServers = make(map[string]tlj.Server)
-var srtsMux sync.Mutex
-
-// A client socket that transports data in an imux session, autoreconnecting
+// A client socket that transports data in an imux session, autoreconnecting.
+// Bind names the route the socket is dialed over with Transport, and
+// responses read from it are delivered to the client's sockets.
 type IMUXSocket struct {
-	IMUXer   DataIMUX
-	Redialer Redialer
+	IMUXer    *DataIMUX
+	Transport Transport
+	Bind      string
+	client    *Client
 }
 
-// Dial a new connection in an imux session, creating a TLJ server for
-// responses if needed.  Read data from the sockets IMUXer and write it up.
+// Dial a new connection in an imux session.  Read data from the sockets
+// IMUXer and write it up, until the IMUXer's lifecycle stops.  A socket
+// that fails is redialed after the IMUXer's RedialBackoff, doubled for
+// each failure in a row.
 func (imux_socket *IMUXSocket) init(session_id string) {
-	log.WithFields(log.Fields{
-		"at": "IMUXSocket.init",
-	}).Debug("starting imux socket")
-	tlj_server := imuxClientSocketTLJServer(session_id)
-	cooldown := 10 * time.Second
+	if imux_socket.IMUXer.logger.debugging() {
+		imux_socket.IMUXer.logger.Debug("starting imux socket", "at", "IMUXSocket.init")
+	}
+	lifecycle := imux_socket.IMUXer.lifecycle
+	options := imux_socket.IMUXer.options
+	ctx := lifecycle.context()
+	failures := 0
 	for {
-		log.WithFields(log.Fields{
-			"at": "IMUXSocket.init",
-		}).Debug("dialing imux socket")
-		socket, err := imux_socket.Redialer()
+		if imux_socket.IMUXer.logger.debugging() {
+			imux_socket.IMUXer.logger.Debug("dialing imux socket", "at", "IMUXSocket.init")
+		}
+		conn, err := imux_socket.Transport.Dial(ctx, imux_socket.Bind)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"at":    "IMUXSocket.init",
-				"error": err.Error(),
-			}).Error("error dialing imux socket, entering cooldown")
-			time.Sleep(cooldown)
+			imux_socket.IMUXer.logger.Error("error dialing imux socket, entering cooldown",
+				"at", "IMUXSocket.init",
+				"error", err,
+			)
+			imux_socket.failed(TransportDial, err)
+			failures++
+			if !lifecycle.sleep(options.redialBackoff(failures)) {
+				return
+			}
 			continue
 		}
-		tlj_server.Insert(socket)
-		writer, err := tlj.NewStreamWriter(socket, type_store(), reflect.TypeOf(Chunk{}))
+		if !lifecycle.track(conn) {
+			conn.Close()
+			return
+		}
+		remote, err := conn.Negotiate(Hello{
+			Version:      ProtocolVersion,
+			Features:     options.features(),
+			MaxChunkSize: uint32(imux_socket.IMUXer.chunkSize()),
+			SessionID:    session_id,
+		}, options.HandshakeTimeout)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"at":    "IMUXSocket.init",
-				"error": err.Error(),
-			}).Error("error creating stream writer, entering cooldown")
-			time.Sleep(cooldown)
+			imux_socket.IMUXer.logger.Error("error negotiating imux socket, entering cooldown",
+				"at", "IMUXSocket.init",
+				"error", err,
+			)
+			imux_socket.failed(TransportNegotiate, err)
+			lifecycle.close(conn)
+			failures++
+			if !lifecycle.sleep(options.redialBackoff(failures)) {
+				return
+			}
 			continue
 		}
+		if imux_socket.IMUXer.logger.debugging() {
+			imux_socket.IMUXer.logger.Debug("negotiated imux socket",
+				"at", "IMUXSocket.init",
+				"version", remote.Version,
+				"features", remote.Features,
+				"max_chunk_size", remote.MaxChunkSize,
+			)
+		}
+		imux_socket.IMUXer.limitChunkSize(int(remote.MaxChunkSize))
+		if remote.Features&FeatureAcknowledgements != 0 {
+			imux_socket.IMUXer.negotiated(remote.Features)
+		}
+		transport := newTransportSocket(conn, remote.Features, remote.MaxChunkSize, imux_socket.IMUXer.options, imux_socket.IMUXer.logger)
+		failures = 0
+		imux_socket.IMUXer.reporter.observer.TransportUp(TransportEvent{
+			SessionID: session_id,
+			Route:     imux_socket.Bind,
+		})
+		lifecycle.run(func() {
+			imux_socket.client.readResponseFrames(conn, transport)
+		})
+
+		err = imux_socket.IMUXer.writeTo(transport)
+		lifecycle.close(conn)
+		imux_socket.IMUXer.reporter.observer.TransportDown(TransportEvent{
+			SessionID: session_id,
+			Route:     imux_socket.Bind,
+			Err:       err,
+			Stats:     conn.Stats(),
+		})
+		if err == ErrShutdown {
+			if imux_socket.IMUXer.logger.debugging() {
+				imux_socket.IMUXer.logger.Debug("stopped imux socket", "at", "IMUXSocket.init")
+			}
+			return
+		}
+		imux_socket.IMUXer.logger.Error("error writing chunk up transport socket",
+			"at", "IMUXSocket.init",
+			"error", err,
+		)
+		imux_socket.failed(TransportWrite, err)
+		if err == errHeartbeatTimeout {
+			if imux_socket.IMUXer.logger.debugging() {
+				imux_socket.IMUXer.logger.Debug("transport socket stopped answering heartbeats, redialing", "at", "IMUXSocket.init")
+			}
+			continue
+		}
+		if imux_socket.IMUXer.logger.debugging() {
+			imux_socket.IMUXer.logger.Debug("transport socket dies, redailing after cooldown", "at", "IMUXSocket.init")
+		}
+		failures++
+		if !lifecycle.sleep(options.redialBackoff(failures)) {
+			return
+		}
+	}
+}
+
+// Report an operation on the socket's transport socket that failed
+func (imux_socket *IMUXSocket) failed(op string, err error) {
+	imux_socket.IMUXer.reporter.report(&TransportError{
+		SessionID: imux_socket.IMUXer.SessionID,
+		Route:     imux_socket.Bind,
+		Op:        op,
+		Err:       err,
+	})
+}
 
-		for {
-			chunk := <-imux_socket.IMUXer.Chunks
-			log.WithFields(log.Fields{
-				"at":          "IMUXSocket.init",
-				"sequence_id": chunk.SequenceID,
-				"socket_id":   chunk.SocketID,
-				"session_id":  chunk.SessionID,
-			}).Debug("writing chunk up transport socket")
-			err := writer.Write(chunk)
-			if err != nil {
-				imux_socket.IMUXer.Stale <- chunk
-				log.WithFields(log.Fields{
-					"at":          "IMUXSocket.init",
-					"error":       err.Error(),
-					"sequence_id": chunk.SequenceID,
-					"socket_id":   chunk.SocketID,
-					"session_id":  chunk.SessionID,
-				}).Error("error writing chunk up transport socket")
-				break
+// Read frames coming back down a transport socket, delivering chunks to
+// their write queues and acknowledgements to the DataIMUX and answering
+// heartbeats, until the socket fails
+func (client *Client) readResponseFrames(conn TransportConn, transport *transportSocket) {
+	defer close(transport.closed)
+	imuxer := client.imuxer
+	for {
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			if client.logger.debugging() {
+				client.logger.Debug("stopped reading response frames",
+					"at", "readResponseFrames",
+					"session_id", imuxer.SessionID,
+					"error", err,
+				)
 			}
+			conn.Close()
+			return
+		}
+		switch frame := frame.(type) {
+		case *Ack:
+			imuxer.retransmit.acknowledge(frame)
+		case *Chunk:
+			client.deliverResponseChunk(frame)
+		case *Control:
+			client.acceptResponseControl(frame)
+		case *Heartbeat:
+			transport.heartbeat(frame)
 		}
-		log.WithFields(log.Fields{
-			"at": "IMUXSocket.init",
-		}).Debug("transport socket dies, redailing after cooldown")
-		time.Sleep(cooldown)
 	}
 }
 
-// Create a TLJ server for a session if needed, or return the already existing server
-func imuxClientSocketTLJServer(session_id string) tlj.Server {
-	srtsMux.Lock()
-	defer srtsMux.Unlock()
-	if server, exists := sessionResponsesTLJServers[session_id]; exists {
-		return server
+// Pass a response chunk through the pipeline to the write queue for its
+// socket, acknowledging chunks for sockets that have already closed
+func (client *Client) deliverResponseChunk(chunk *Chunk) {
+	if err := client.pipeline.receive(chunk); err != nil {
+		client.imuxer.middlewareFailed(chunk, true, err)
+		return
 	}
-	tlj_server := tlj.Server{
-		TypeStore:       type_store(),
-		Tag:             tag_socket,
-		Tags:            make(map[net.Conn][]string),
-		Sockets:         make(map[string][]net.Conn),
-		Events:          make(map[string]map[uint16][]func(interface{}, tlj.TLJContext)),
-		Requests:        make(map[string]map[uint16][]func(interface{}, tlj.TLJContext)),
-		FailedServer:    make(chan error, 1),
-		FailedSockets:   make(chan net.Conn, 200),
-		TagManipulation: &sync.Mutex{},
-		InsertRequests:  &sync.Mutex{},
-		InsertEvents:    &sync.Mutex{},
+	writer, ok := client.writeQueues.get(chunk.SocketID)
+	if ok && writer.deliver(chunk) {
+		if client.logger.debugging() {
+			client.logger.Debug("accepting response chunk from transport socket",
+				"at", "Client.deliverResponseChunk",
+				"session_id", client.SessionID,
+			)
+		}
+	} else if ok || client.writeQueues.isClosed(chunk.SocketID) {
+		acknowledgeClosed(client.imuxer, chunk)
+	} else {
+		client.logger.Error("could not find write queue for response chunk",
+			"at", "Client.deliverResponseChunk",
+			"session_id", client.SessionID,
+			"socket_id", chunk.SocketID,
+		)
 	}
-	go func(server tlj.Server) {
-		for {
-			<-server.FailedSockets
+}
+
+// Handle a control message from the server about one of the session's
+// sockets, closing sockets whose destination could not be opened or was
+// reset
+func (client *Client) acceptResponseControl(control *Control) {
+	switch control.Type {
+	case ControlOpenAck:
+		if client.logger.debugging() {
+			client.logger.Debug("server opened destination",
+				"at", "Client.acceptResponseControl",
+				"session_id", client.SessionID,
+				"socket_id", control.SocketID,
+			)
 		}
-	}(tlj_server)
-	tlj_server.Accept("all", reflect.TypeOf(Chunk{}), func(iface interface{}, context tlj.TLJContext) {
-		if chunk, ok := iface.(*Chunk); ok {
-			cwqMux.Lock()
-			if writer, ok := client_write_queues[chunk.SocketID]; ok {
-				log.WithFields(log.Fields{
-					"at":         "imuxClientSocketTLJServer",
-					"session_id": session_id,
-				}).Debug("accepting response chunk in transport socket TLJ server")
-				writer.Chunks <- chunk
-			} else {
-				log.WithFields(log.Fields{
-					"at":         "imuxClientSocketTLJServer",
-					"session_id": session_id,
-					"socket_id":  chunk.SocketID,
-				}).Error("could not find write queue for response chunk")
-			}
-			cwqMux.Unlock()
+		client.opened(control.SocketID, nil)
+	case ControlOpenFail, ControlReset:
+		stream_err := client.imuxer.streamFailed(*control)
+		client.opened(control.SocketID, stream_err)
+		client.imuxer.retransmit.release(control.SocketID)
+		if writer, ok := client.writeQueues.get(control.SocketID); ok {
+			writer.reset(stream_err)
 		}
-	})
-	sessionResponsesTLJServers[session_id] = tlj_server
-	log.WithFields(log.Fields{
-		"at":         "imuxClientSocketTLJServer",
-		"session_id": session_id,
-	}).Debug("created new TLJ server for session")
-	return tlj_server
+	default:
+		client.logger.Warn("dropped unexpected control message",
+			"at", "Client.acceptResponseControl",
+			"session_id", client.SessionID,
+			"socket_id", control.SocketID,
+			"control", control.Type.String(),
+		)
+	}
 }
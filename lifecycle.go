@@ -0,0 +1,259 @@
+package imux
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Returned by Serve once a Client or Server has been shut down, and by
+// Start after it was shut down
+var ErrShutdown = errors.New("imux: shut down")
+
+// Returned by Start when a Client or Server was already started
+var errStarted = errors.New("imux: already started")
+
+// Returned when opening streams on a Client that has not been started
+var errNotStarted = errors.New("imux: not started")
+
+// How often Shutdown checks if in-flight chunks have drained
+var shutdownPollInterval = 50 * time.Millisecond
+
+// The goroutines of a Client or Server and the sockets they block on, so
+// they can all be stopped and waited on together.  Draining is closed
+// once shutting down begins and no new sockets should be opened, and done
+// once every goroutine should stop.  Stopping closes every tracked socket
+// and runs the hooks that wake goroutines waiting on anything else, and
+// once every goroutine has returned the finishers are told how shutting
+// down went.
+type lifecycle struct {
+	group     sync.WaitGroup
+	draining  chan struct{}
+	done      chan struct{}
+	finished  chan struct{}
+	sockets   map[io.Closer]int
+	listeners []io.Closer
+	hooks     []func()
+	finishers []func(error)
+	mux       sync.Mutex
+	started   bool
+	stopped   bool
+	stopping  sync.Once
+	unwatch   func() bool
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{
+		draining: make(chan struct{}),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+		sockets:  make(map[io.Closer]int),
+		unwatch:  func() bool { return false },
+	}
+}
+
+// Mark the lifecycle started, accepting from listener if there is one,
+// and arrange for shutdown to be called without draining once ctx is done
+func (lifecycle *lifecycle) start(ctx context.Context, listener io.Closer, shutdown func(context.Context) error) error {
+	lifecycle.mux.Lock()
+	defer lifecycle.mux.Unlock()
+	if lifecycle.isDraining() {
+		return ErrShutdown
+	}
+	if lifecycle.started {
+		return errStarted
+	}
+	lifecycle.started = true
+	if listener != nil {
+		lifecycle.listeners = append(lifecycle.listeners, listener)
+	}
+	lifecycle.unwatch = context.AfterFunc(ctx, func() {
+		cancelled, cancel := context.WithCancel(context.Background())
+		cancel()
+		shutdown(cancelled)
+	})
+	return nil
+}
+
+// Run a goroutine, tracking the sockets it uses until it returns.  Returns
+// false without running it if the lifecycle has stopped.
+func (lifecycle *lifecycle) run(routine func(), sockets ...io.Closer) bool {
+	lifecycle.mux.Lock()
+	defer lifecycle.mux.Unlock()
+	if lifecycle.stopped {
+		return false
+	}
+	for _, socket := range sockets {
+		lifecycle.sockets[socket]++
+	}
+	lifecycle.group.Add(1)
+	go func() {
+		defer lifecycle.group.Done()
+		defer lifecycle.untrack(sockets...)
+		routine()
+	}()
+	return true
+}
+
+// Track a socket so it is closed if the lifecycle stops while it is in
+// use.  Returns false if the lifecycle has already stopped.
+func (lifecycle *lifecycle) track(socket io.Closer) bool {
+	lifecycle.mux.Lock()
+	defer lifecycle.mux.Unlock()
+	if lifecycle.stopped {
+		return false
+	}
+	lifecycle.sockets[socket]++
+	return true
+}
+
+// Stop tracking sockets that are no longer in use
+func (lifecycle *lifecycle) untrack(sockets ...io.Closer) {
+	lifecycle.mux.Lock()
+	defer lifecycle.mux.Unlock()
+	for _, socket := range sockets {
+		lifecycle.sockets[socket]--
+		if lifecycle.sockets[socket] <= 0 {
+			delete(lifecycle.sockets, socket)
+		}
+	}
+}
+
+// Close a tracked socket and stop tracking it
+func (lifecycle *lifecycle) close(socket io.Closer) {
+	socket.Close()
+	lifecycle.untrack(socket)
+}
+
+// Call a hook when the lifecycle stops, or now if it already has
+func (lifecycle *lifecycle) atStop(hook func()) {
+	lifecycle.mux.Lock()
+	if !lifecycle.stopped {
+		lifecycle.hooks = append(lifecycle.hooks, hook)
+		lifecycle.mux.Unlock()
+		return
+	}
+	lifecycle.mux.Unlock()
+	hook()
+}
+
+// Call a finisher with the error shutting down returned once every
+// goroutine has returned.  Must be called before shutting down begins.
+func (lifecycle *lifecycle) atFinish(finisher func(error)) {
+	lifecycle.mux.Lock()
+	defer lifecycle.mux.Unlock()
+	lifecycle.finishers = append(lifecycle.finishers, finisher)
+}
+
+// A context that is done once the lifecycle stops
+func (lifecycle *lifecycle) context() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	lifecycle.atStop(cancel)
+	return ctx
+}
+
+// Check if the lifecycle has been started
+func (lifecycle *lifecycle) isStarted() bool {
+	lifecycle.mux.Lock()
+	defer lifecycle.mux.Unlock()
+	return lifecycle.started
+}
+
+// Check if shutting down has begun
+func (lifecycle *lifecycle) isDraining() bool {
+	select {
+	case <-lifecycle.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait for a duration, returning false early if the lifecycle stops
+func (lifecycle *lifecycle) sleep(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-lifecycle.done:
+		return false
+	}
+}
+
+// Shut down once: close the listeners and stop reading new data, wait
+// until drained reports in-flight chunks have been delivered or ctx is
+// done, then stop every goroutine and wait for them to return.  Later
+// calls wait for the first to finish.
+func (lifecycle *lifecycle) stopAll(ctx context.Context, stop_reading func(), drained func() bool) error {
+	first := false
+	lifecycle.stopping.Do(func() {
+		first = true
+	})
+	if !first {
+		select {
+		case <-lifecycle.finished:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	defer close(lifecycle.finished)
+
+	lifecycle.mux.Lock()
+	close(lifecycle.draining)
+	listeners := lifecycle.listeners
+	lifecycle.mux.Unlock()
+	lifecycle.unwatch()
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	stop_reading()
+
+	err := lifecycle.drain(ctx, drained)
+	lifecycle.stop()
+	lifecycle.group.Wait()
+	lifecycle.mux.Lock()
+	finishers := lifecycle.finishers
+	lifecycle.mux.Unlock()
+	for _, finisher := range finishers {
+		finisher(err)
+	}
+	return err
+}
+
+// Wait until drained reports nothing is in flight, or ctx is done
+func (lifecycle *lifecycle) drain(ctx context.Context, drained func() bool) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for !drained() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Tell every goroutine to stop, closing the sockets they use and waking
+// them with the stop hooks
+func (lifecycle *lifecycle) stop() {
+	lifecycle.mux.Lock()
+	lifecycle.stopped = true
+	close(lifecycle.done)
+	sockets := make([]io.Closer, 0, len(lifecycle.sockets))
+	for socket := range lifecycle.sockets {
+		sockets = append(sockets, socket)
+	}
+	hooks := lifecycle.hooks
+	lifecycle.mux.Unlock()
+	for _, socket := range sockets {
+		socket.Close()
+	}
+	for _, hook := range hooks {
+		hook()
+	}
+}
@@ -0,0 +1,35 @@
+package imux
+
+import (
+	"context"
+	"log/slog"
+)
+
+// The logger shared by a Client or Server and everything it creates.  Debug
+// messages are checked with debugging before their attributes are built,
+// so chunks are read and written without allocating for logging unless
+// debug logging is enabled.
+type logger struct {
+	*slog.Logger
+}
+
+// Wrap a slog.Logger, or slog's default logger if it is nil
+func newLogger(slog_logger *slog.Logger) *logger {
+	logger := &logger{}
+	logger.use(slog_logger)
+	return logger
+}
+
+// Switch to a slog.Logger, or slog's default logger if it is nil.  Must be
+// called before any goroutine logs.
+func (logger *logger) use(slog_logger *slog.Logger) {
+	if slog_logger == nil {
+		slog_logger = slog.Default()
+	}
+	logger.Logger = slog_logger
+}
+
+// Check if debug messages are written
+func (logger *logger) debugging() bool {
+	return logger.Enabled(context.Background(), slog.LevelDebug)
+}
@@ -0,0 +1,150 @@
+package imux
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// How long a loopback test waits on anything before failing
+const loopbackTimeout = 10 * time.Second
+
+// A Client and Server connected over loopback TCP.  The Server passes its
+// streams to streams unless it is replaced before the pair is started,
+// and wrap, if set, wraps each transport socket the Client dials.
+type loopback struct {
+	client   *Client
+	server   *Server
+	streams  *StreamListener
+	listener net.Listener
+	wrap     func(net.Conn) net.Conn
+}
+
+// Create a Client dialing transport sockets for binds and a Server with a
+// StreamListener, both tuned by options
+func newLoopback(t *testing.T, options Options, binds map[string]int) *loopback {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair := &loopback{listener: listener}
+	pair.server, pair.streams, err = NewStreamServerWithOptions(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair.client, err = NewClientWithOptions(binds, func(bind string) Redialer {
+		return func() (net.Conn, error) {
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil || pair.wrap == nil {
+				return conn, err
+			}
+			return pair.wrap(conn), nil
+		}
+	}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+// Start the Server and Client, waiting until a transport socket has been
+// negotiated, and shut both down when the test finishes
+func (pair *loopback) start(t *testing.T) {
+	t.Helper()
+	if err := pair.server.Start(context.Background(), pair.listener); err != nil {
+		t.Fatal(err)
+	}
+	if err := pair.client.Start(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		pair.client.Shutdown(ctx)
+		pair.server.Shutdown(ctx)
+	})
+	select {
+	case <-pair.client.imuxer.ready:
+	case <-time.After(loopbackTimeout):
+		t.Fatal("timed out waiting for a transport socket to negotiate")
+	}
+}
+
+// Wait until the Client is writing to count transport sockets
+func (pair *loopback) awaitTransports(t *testing.T, count int) {
+	t.Helper()
+	deadline := time.Now().Add(loopbackTimeout)
+	for {
+		pair.client.imuxer.transportsMux.Lock()
+		up := len(pair.client.imuxer.transports)
+		pair.client.imuxer.transportsMux.Unlock()
+		if up >= count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d transport sockets, %d are up", count, up)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Open a stream from the Client
+func (pair *loopback) dial(t *testing.T) net.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), loopbackTimeout)
+	defer cancel()
+	conn, err := pair.client.DialContext(ctx, "tcp", "loopback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(loopbackTimeout))
+	return conn
+}
+
+// Accept the Server's end of the next stream
+func (pair *loopback) accept(t *testing.T) net.Conn {
+	t.Helper()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		stream, err := pair.streams.Accept()
+		if err == nil {
+			accepted <- stream
+		}
+	}()
+	select {
+	case stream := <-accepted:
+		t.Cleanup(func() { stream.Close() })
+		stream.SetDeadline(time.Now().Add(loopbackTimeout))
+		return stream
+	case <-time.After(loopbackTimeout):
+		t.Fatal("timed out accepting a stream")
+	}
+	return nil
+}
+
+func randomPayload(t *testing.T, size int) []byte {
+	t.Helper()
+	payload := make([]byte, size)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+// Read exactly len(expected) bytes from a stream and compare them
+func expectPayload(t *testing.T, stream net.Conn, expected []byte) {
+	t.Helper()
+	received := make([]byte, len(expected))
+	if _, err := io.ReadFull(stream, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, expected) {
+		t.Fatal("stream data does not match what was written")
+	}
+}
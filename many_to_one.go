@@ -1,206 +1,656 @@
 package imux
 
 import (
-	log "github.com/Sirupsen/logrus"
-	"github.com/hkparker/TLJ"
+	"context"
+	"log/slog"
 	"net"
-	"reflect"
 	"sync"
 )
 
-// Chan of failures to write to destinations
-var FailedSocketOuts = make(map[string]chan bool)
-var fsoMux sync.Mutex
+// A Server accepts transport sockets from Clients, dialing a destination
+// for each socket in their sessions and writing the socket's data out to
+// it, or passing each socket to a StreamListener.  Data read back from
+// destinations is written down the transport sockets of their session.
+type Server struct {
+	// Where the Server logs, set before it is started.  Nil uses slog's
+	// default logger.
+	Logger *slog.Logger
+	// Failures of transport sockets are reported as *TransportError,
+	// destinations that could not be dialed as *DestinationError,
+	// streams that failed to write out or were reset by the Client as
+	// *StreamError and chunks dropped by Middleware as *ChunkError.
+	// Failures are dropped while Errors is full.
+	Errors chan error
+	// Told about transport sockets, streams and chunks, set before the
+	// Server is started
+	Observer Observer
+	// Transforms chunks sent and received, set before the Server is
+	// started
+	Middleware []Middleware
+	// Dials the addresses Clients name as the destinations of their
+	// streams, such as a SOCKS5 Client, set before the Server is started.
+	// Nil refuses streams that name an address.
+	DialAddress     func(address string) (net.Conn, error)
+	dialDestination destinationDialer
+	writeQueues     *writeQueues
+	// DataIMUX objects to read responses from each outgoing destination
+	// socket, by session
+	responders    map[string]*DataIMUX
+	respondersMux sync.Mutex
+	lifecycle     *lifecycle
+	logger        *logger
+	reporter      *reporter
+	pipeline      *pipeline
+	options       *Options
+	served        chan error
+}
+
+// Dials the destination of a new socket in a session
+type destinationDialer func(session_id, socket_id string) (net.Conn, error)
 
-// WriteQueues for each outgoing socket on the server
-var server_write_queues = make(map[string]*WriteQueue)
-var swqMux sync.Mutex
+// Create a new Server that dials destinations with dial_destination
+func NewServer(dial_destination Redialer) *Server {
+	server, _ := NewServerWithOptions(dial_destination, DefaultOptions())
+	return server
+}
 
-// DataIMUX objects to read responses from each outgoing destination socket
-var responders = make(map[string]DataIMUX)
-var respondersMux sync.Mutex
+// Create a new Server like NewServer, tuned by options.  Returns an error
+// wrapping ErrInvalidOptions if options are not valid.
+func NewServerWithOptions(dial_destination Redialer, options Options) (*Server, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	return newServer(func(_, _ string) (net.Conn, error) {
+		return dial_destination()
+	}, &options), nil
+}
 
-// Tracks if goroutines have been created for each socket to read from the
-// DataIMUXer for its session and write responses down
-var loopers = make(map[net.Conn]bool)
-var loopersMux sync.Mutex
+// Create a Server with validated options
+func newServer(dial_destination destinationDialer, options *Options) *Server {
+	lifecycle := newLifecycle()
+	failures := make(chan error, options.ErrorQueueDepth)
+	return &Server{
+		Errors:          failures,
+		dialDestination: dial_destination,
+		writeQueues:     newWriteQueues(lifecycle, options.ClosedSocketMemory),
+		responders:      make(map[string]*DataIMUX),
+		lifecycle:       lifecycle,
+		logger:          newLogger(nil),
+		reporter:        newReporter(failures),
+		pipeline:        newPipeline(),
+		options:         options,
+		served:          make(chan error, 1),
+	}
+}
 
-// Create a new TLJ server to accept chunks from anywhere and order them, writing them to corresponding sockets
+// Create a new Server to accept chunks from anywhere and order them, writing them to corresponding sockets.
 func ManyToOne(listener net.Listener, dial_destination Redialer) {
-	tlj_server := tlj.NewServer(listener, tag_socket, type_store())
-	tlj_server.Accept("all", reflect.TypeOf(Chunk{}), func(iface interface{}, context tlj.TLJContext) {
-		if chunk, ok := iface.(*Chunk); ok {
-			log.WithFields(log.Fields{
-				"at":          "ManyToOne",
-				"sequence_id": chunk.SequenceID,
-				"socket_id":   chunk.SocketID,
-				"session_id":  chunk.SessionID,
-			}).Debug("received chunk")
-			createFailReporterIfNeeded(chunk.SocketID, chunk.SessionID)
-			createResponderIMUXIfNeeded(chunk.SessionID)
-			writeResponseChunksIfNeeded(context.Socket, chunk.SessionID)
-			queue, err := queueForDestinationDialIfNeeded(chunk.SocketID, chunk.SessionID, dial_destination)
-			if err == nil {
-				queue.Chunks <- chunk
-				log.WithFields(log.Fields{
-					"at":          "ManyToOne",
-					"sequence_id": chunk.SequenceID,
-					"socket_id":   chunk.SocketID,
-					"session_id":  chunk.SessionID,
-				}).Debug("wrote chunk")
-			} else {
-				log.WithFields(log.Fields{
-					"at":          "ManyToOne",
-					"error":       err.Error(),
-					"sequence_id": chunk.SequenceID,
-					"socket_id":   chunk.SocketID,
-					"session_id":  chunk.SessionID,
-				}).Error("dropped chunk")
-				if reporter, ok := FailedSocketOuts[chunk.SocketID]; ok {
-					reporter <- true
-				} else {
-					log.WithFields(log.Fields{
-						"at":        "ManyToOne",
-						"socket_id": chunk.SocketID,
-					}).Error("unable to lookup fail socket out channel")
-				}
-			}
-		}
+	server := NewServer(dial_destination)
+	err := server.Serve(listener)
+	server.logger.Error("Server failed for ManyToOne", "error", err)
+}
+
+// Start the Server and accept transport sockets from the listener until it
+// fails, returning ErrShutdown once the Server is shut down
+func (server *Server) Serve(listener net.Listener) error {
+	if err := server.Start(context.Background(), listener); err != nil {
+		return err
+	}
+	return <-server.served
+}
+
+// Start the Server like Serve, accepting transport sockets from a
+// TransportListener
+func (server *Server) ServeTransport(listener TransportListener) error {
+	if err := server.StartTransport(context.Background(), listener); err != nil {
+		return err
+	}
+	return <-server.served
+}
+
+// Accept transport sockets from the listener in the background, carrying
+// frames over them with a ConnTransport.  Once ctx is done the Server is
+// shut down without draining.
+func (server *Server) Start(ctx context.Context, listener net.Listener) error {
+	transport := &ConnTransport{
+		Listener: listener,
+		Logger:   server.Logger,
+	}
+	transport_listener, err := transport.Listen()
+	if err != nil {
+		return err
+	}
+	return server.StartTransport(ctx, transport_listener)
+}
+
+// Accept transport sockets from a TransportListener in the background,
+// negotiating and reading each in a goroutine of its own.  Once ctx is
+// done the Server is shut down without draining.
+func (server *Server) StartTransport(ctx context.Context, listener TransportListener) error {
+	if err := server.lifecycle.start(ctx, listener, server.Shutdown); err != nil {
+		return err
+	}
+	server.logger.use(server.Logger)
+	server.reporter.use(server.Observer)
+	server.pipeline.use(server.Middleware)
+	server.lifecycle.atFinish(server.sessionsShutdown)
+	local := Hello{
+		Version:      ProtocolVersion,
+		Features:     server.options.features(),
+		MaxChunkSize: uint32(server.options.ChunkSize),
+	}
+	server.lifecycle.run(func() {
+		server.served <- server.acceptTransports(listener, local)
 	})
+	if server.logger.debugging() {
+		server.logger.Debug("created new Server", "at", "Server.StartTransport")
+	}
+	return nil
+}
+
+// Stop accepting transport sockets and streams and reading from
+// destinations, wait for the data already read and chunks already received
+// to be delivered until ctx is done, then close every socket and wait for
+// the Server's goroutines to return.  Returns ctx's error if it was done
+// before the data drained.
+func (server *Server) Shutdown(ctx context.Context) error {
+	if server.logger.debugging() {
+		server.logger.Debug("shutting down Server", "at", "Server.Shutdown")
+	}
+	return server.lifecycle.stopAll(ctx, server.stopReading, server.drained)
+}
+
+// Stop reading from every destination
+func (server *Server) stopReading() {
+	server.respondersMux.Lock()
+	defer server.respondersMux.Unlock()
+	for _, responder := range server.responders {
+		responder.stopReading()
+	}
+}
 
-	log.WithFields(log.Fields{
-		"at": "ManyToOne",
-	}).Debug("created new ManyToOne")
-	err := <-tlj_server.FailedServer
-	log.WithFields(log.Fields{
-		"error": err.Error(),
-	}).Error("TLJ server failed for ManyToOne")
-}
-
-// Create a chan if needed to pass events about this socket failing
-func createFailReporterIfNeeded(socket_id, session_id string) {
-	fsoMux.Lock()
-	if _, present := FailedSocketOuts[socket_id]; !present {
-		FailedSocketOuts[socket_id] = make(chan bool, 0)
-		go func(socket_id, session_id string) {
-			for {
-				<-FailedSocketOuts[socket_id]
-				responders[session_id].Chunks <- Chunk{
-					SessionID:  session_id,
-					SocketID:   socket_id,
-					SequenceID: 0,
-					Close:      true,
-				}
+// Check if every stream has finished and nothing read from destinations is
+// waiting to be written or acknowledged
+func (server *Server) drained() bool {
+	if !server.writeQueues.empty() {
+		return false
+	}
+	server.respondersMux.Lock()
+	defer server.respondersMux.Unlock()
+	for _, responder := range server.responders {
+		if !responder.idle() {
+			return false
+		}
+	}
+	return true
+}
+
+// Accept transport sockets from the listener until it fails
+func (server *Server) acceptTransports(listener TransportListener, local Hello) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if server.lifecycle.isDraining() {
+				return ErrShutdown
 			}
-		}(socket_id, session_id)
+			server.logger.Error("error accepting transport socket",
+				"at", "Server.acceptTransports",
+				"error", err,
+			)
+			return err
+		}
+		started := server.lifecycle.run(func() {
+			server.serveTransport(conn, local)
+		}, conn)
+		if !started {
+			conn.Close()
+		}
 	}
-	fsoMux.Unlock()
 }
 
-// If it does not exist, create a DataIMUX to read data from
-// outgoing destination sockets with a common session
-func createResponderIMUXIfNeeded(session_id string) {
-	respondersMux.Lock()
-	if _, present := responders[session_id]; !present {
-		responders[session_id] = NewDataIMUX(session_id)
-		log.WithFields(log.Fields{
-			"at":         "createResponderIMUXIfNeeded",
-			"session_id": session_id,
-		}).Debug("created new responder imux for session")
-	}
-	respondersMux.Unlock()
-}
-
-// If it is not already happening, ensure that response chunks for a specified
-// session_id are written back down this socket.
-func writeResponseChunksIfNeeded(socket net.Conn, session_id string) {
-	loopersMux.Lock()
-	if _, looping := loopers[socket]; !looping {
-		log.WithFields(log.Fields{
-			"at":         "writeResponseChunksIfNeeded",
-			"session_id": session_id,
-		}).Debug("creating write back routine for socket")
-		go func() {
-			writer, err := tlj.NewStreamWriter(socket, type_store(), reflect.TypeOf(Chunk{}))
-			if err != nil {
-				log.WithFields(log.Fields{
-					"at":         "writeResponseChunksIfNeeded",
-					"session_id": session_id,
-					"error":      err.Error(),
-				}).Error("error create return stream writer")
-				return
+// Negotiate a transport socket, then read frames from it until it fails
+// while writing the session's responses back down it.  Transport sockets
+// from peers that predate the handshake carry the session of the first
+// chunk read from them.
+func (server *Server) serveTransport(conn TransportConn, local Hello) {
+	remote, err := conn.Negotiate(local, server.options.HandshakeTimeout)
+	if err != nil {
+		server.logger.Error("error negotiating transport socket",
+			"at", "Server.serveTransport",
+			"session_id", remote.SessionID,
+			"error", err,
+		)
+		server.reporter.report(&TransportError{
+			SessionID: remote.SessionID,
+			Route:     conn.Route(),
+			Op:        TransportNegotiate,
+			Err:       err,
+		})
+		conn.Close()
+		return
+	}
+	if server.logger.debugging() {
+		server.logger.Debug("negotiated transport socket",
+			"at", "Server.serveTransport",
+			"session_id", remote.SessionID,
+			"version", remote.Version,
+			"features", remote.Features,
+			"max_chunk_size", remote.MaxChunkSize,
+		)
+	}
+	transport := newTransportSocket(conn, remote.Features, remote.MaxChunkSize, server.options, server.logger)
+	defer close(transport.closed)
+	session_id := remote.SessionID
+	var responder *DataIMUX
+	if session_id != "" {
+		responder = server.respond(session_id, int(remote.MaxChunkSize), transport)
+	}
+
+	for {
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			if server.logger.debugging() {
+				server.logger.Debug("stopped reading frames",
+					"at", "Server.serveTransport",
+					"session_id", session_id,
+					"error", err,
+				)
+			}
+			conn.Close()
+			if responder != nil {
+				server.transportDown(session_id, transport, err)
 			}
-			respondersMux.Lock()
-			chunk_stream, ok := responders[session_id]
-			if !ok {
-				log.WithFields(log.Fields{
-					"at":         "writeResponseChunksIfNeeded",
-					"session_id": session_id,
-				}).Error("error looking up responder imux for session_id")
-				return
+			return
+		}
+		switch frame := frame.(type) {
+		case *Ack:
+			if responder != nil {
+				responder.retransmit.acknowledge(frame)
+			}
+		case *Heartbeat:
+			transport.heartbeat(frame)
+		case *Control:
+			if frame.SessionID != session_id {
+				server.logger.Error("dropped control message for a session not negotiated on this socket",
+					"at", "Server.serveTransport",
+					"session_id", session_id,
+					"socket_id", frame.SocketID,
+				)
+				continue
 			}
-			respondersMux.Unlock()
-			for {
-				new_chunk := <-chunk_stream.Chunks
-				err := writer.Write(new_chunk)
-				if err != nil {
-					responders[session_id].Stale <- new_chunk
-					log.WithFields(log.Fields{
-						"at":         "writeResponseChunksIfNeeded",
-						"session_id": session_id,
-						"data_len":   len(new_chunk.Data),
-						"error":      err.Error(),
-					}).Error("error writing a chunk down transport socket")
-					break
-				} else {
-					log.WithFields(log.Fields{
-						"at":         "writeResponseChunksIfNeeded",
-						"session_id": session_id,
-						"data_len":   len(new_chunk.Data),
-					}).Debug("wrote a chunk down transport socket")
-				}
+			server.acceptControl(frame)
+		case *Chunk:
+			if responder == nil {
+				session_id = frame.SessionID
+				responder = server.respond(session_id, server.options.ChunkSize, transport)
 			}
-		}()
-		loopers[socket] = true
+			if frame.SessionID != session_id {
+				server.logger.Error("dropped chunk for a session not negotiated on this socket",
+					"at", "Server.serveTransport",
+					"session_id", session_id,
+					"socket_id", frame.SocketID,
+				)
+				continue
+			}
+			server.acceptChunk(frame)
+		}
+	}
+}
+
+// Start writing a session's responses down a transport socket, creating
+// the session's responder if it is the first transport socket of the
+// session.  Responses are chunked to fit chunk_size.
+func (server *Server) respond(session_id string, chunk_size int, transport *transportSocket) *DataIMUX {
+	responder := server.createResponderIMUXIfNeeded(session_id)
+	responder.limitChunkSize(chunk_size)
+	if transport.reliable() {
+		responder.negotiated(transport.features)
+	}
+	server.transportUp(session_id, transport)
+	server.lifecycle.run(func() {
+		writeResponseChunks(responder, transport)
+	})
+	return responder
+}
+
+// Queue a chunk received on a transport socket for its destination, after
+// passing it through the pipeline.  Chunks for sockets that have already
+// closed are acknowledged and dropped.
+func (server *Server) acceptChunk(chunk *Chunk) {
+	if server.logger.debugging() {
+		server.logger.Debug("received chunk",
+			"at", "Server.acceptChunk",
+			"sequence_id", chunk.SequenceID,
+			"socket_id", chunk.SocketID,
+			"session_id", chunk.SessionID,
+		)
+	}
+	if err := server.pipeline.receive(chunk); err != nil {
+		server.responder(chunk.SessionID).middlewareFailed(chunk, true, err)
+		return
+	}
+	queue, err := server.queueForDestinationDialIfNeeded(chunk.SocketID, chunk.SessionID, chunk.Duplicates)
+	if err == nil && queue.deliver(chunk) {
+		if server.logger.debugging() {
+			server.logger.Debug("wrote chunk",
+				"at", "Server.acceptChunk",
+				"sequence_id", chunk.SequenceID,
+				"socket_id", chunk.SocketID,
+				"session_id", chunk.SessionID,
+			)
+		}
+	} else if err == nil || err == errSocketClosed {
+		acknowledgeClosed(server.responder(chunk.SessionID), chunk)
+	} else if err == errSocketOpening {
+		if server.logger.debugging() {
+			server.logger.Debug("dropped chunk for socket still opening, awaiting retransmission",
+				"at", "Server.acceptChunk",
+				"sequence_id", chunk.SequenceID,
+				"socket_id", chunk.SocketID,
+				"session_id", chunk.SessionID,
+			)
+		}
+	} else {
+		server.logger.Error("dropped chunk",
+			"at", "Server.acceptChunk",
+			"error", err,
+			"sequence_id", chunk.SequenceID,
+			"socket_id", chunk.SocketID,
+			"session_id", chunk.SessionID,
+		)
+		server.refuseStream(chunk.SocketID, chunk.SessionID, err)
 	}
-	loopersMux.Unlock()
+}
+
+// Handle a control message from a client about one of its sockets,
+// dialing the destination for sockets being opened and closing sockets
+// the client reset
+func (server *Server) acceptControl(control *Control) {
+	if server.logger.debugging() {
+		server.logger.Debug("received control message",
+			"at", "Server.acceptControl",
+			"socket_id", control.SocketID,
+			"session_id", control.SessionID,
+			"control", control.Type.String(),
+		)
+	}
+	switch control.Type {
+	case ControlOpen:
+		if control.Destination != "" {
+			server.openAddress(*control)
+			return
+		}
+		_, err := server.queueForDestinationDialIfNeeded(control.SocketID, control.SessionID, control.Duplicates)
+		if err != nil && err != errSocketClosed && err != errSocketOpening {
+			server.refuseStream(control.SocketID, control.SessionID, err)
+		}
+	case ControlReset:
+		responder := server.responder(control.SessionID)
+		stream_err := responder.streamFailed(*control)
+		responder.retransmit.release(control.SocketID)
+		if queue, ok := server.writeQueues.get(control.SocketID); ok {
+			queue.reset(stream_err)
+		} else {
+			server.writeQueues.markClosed(control.SocketID)
+		}
+	default:
+		server.logger.Warn("dropped unexpected control message",
+			"at", "Server.acceptControl",
+			"socket_id", control.SocketID,
+			"session_id", control.SessionID,
+			"control", control.Type.String(),
+		)
+	}
+}
+
+// Tell the client a socket could not be opened because dialing its
+// destination failed
+func (server *Server) refuseStream(socket_id, session_id string, err error) {
+	responder := server.responder(session_id)
+	server.lifecycle.run(func() {
+		responder.resetStream(socket_id, newStreamError(socket_id, ControlOpenFail, err))
+	})
+}
+
+// Get the responder DataIMUX for a session, or nil if no transport
+// socket has been accepted for it
+func (server *Server) responder(session_id string) *DataIMUX {
+	server.respondersMux.Lock()
+	defer server.respondersMux.Unlock()
+	return server.responders[session_id]
+}
+
+// If it does not exist, create a DataIMUX to read data from
+// outgoing destination sockets with a common session, chunking
+// data to fit the session's max chunk size
+func (server *Server) createResponderIMUXIfNeeded(session_id string) *DataIMUX {
+	server.respondersMux.Lock()
+	defer server.respondersMux.Unlock()
+	responder, present := server.responders[session_id]
+	if !present {
+		responder = newDataIMUX(session_id, server.options, server.lifecycle, server.logger, server.reporter, server.pipeline)
+		server.lifecycle.run(responder.retransmitExpired)
+		server.responders[session_id] = responder
+		server.reporter.observer.SessionStarted(SessionEvent{SessionID: session_id})
+		if server.logger.debugging() {
+			server.logger.Debug("created new responder imux for session",
+				"at", "Server.createResponderIMUXIfNeeded",
+				"session_id", session_id,
+			)
+		}
+	}
+	return responder
+}
+
+// Tell the observer every session ended with the Server shutting down
+func (server *Server) sessionsShutdown(err error) {
+	server.respondersMux.Lock()
+	defer server.respondersMux.Unlock()
+	for session_id := range server.responders {
+		server.reporter.observer.SessionShutdown(SessionEvent{
+			SessionID: session_id,
+			Err:       err,
+		})
+	}
+}
+
+// Write response chunks from a session's responder DataIMUX down a transport
+// socket using its negotiated framing, until the socket fails or is closed.
+// Returns the error writing stopped with.
+func writeResponseChunks(responder *DataIMUX, transport *transportSocket) error {
+	err := responder.writeTo(transport)
+	transport.conn.Close()
+	if err == ErrShutdown {
+		return err
+	}
+	responder.logger.Error("error writing a chunk down transport socket",
+		"at", "writeResponseChunks",
+		"session_id", responder.SessionID,
+		"error", err,
+	)
+	responder.reporter.report(&TransportError{
+		SessionID: responder.SessionID,
+		Route:     transport.route,
+		Op:        TransportWrite,
+		Err:       err,
+	})
+	return err
+}
+
+// Tell the observer a transport socket accepted for a session is carrying
+// chunks
+func (server *Server) transportUp(session_id string, transport *transportSocket) {
+	server.reporter.observer.TransportUp(TransportEvent{
+		SessionID: session_id,
+		Route:     transport.route,
+	})
+}
+
+// Tell the observer a transport socket accepted for a session stopped
+func (server *Server) transportDown(session_id string, transport *transportSocket, err error) {
+	server.reporter.observer.TransportDown(TransportEvent{
+		SessionID: session_id,
+		Route:     transport.route,
+		Err:       err,
+		Stats:     transport.conn.Stats(),
+	})
 }
 
 // Get the queue a new chunk should go to, dialing the outgoing destination socket if this is the first time
-// a socket ID has been observed.
-func queueForDestinationDialIfNeeded(socket_id, session_id string, dial_destination func() (net.Conn, error)) (*WriteQueue, error) {
-	swqMux.Lock()
-	queue, present := server_write_queues[socket_id]
+// a socket ID has been observed.  Responses are sent with as many
+// duplicates as the socket's chunks.
+func (server *Server) queueForDestinationDialIfNeeded(socket_id, session_id string, duplicates int) (*WriteQueue, error) {
+	write_queues := server.writeQueues
+	write_queues.mux.Lock()
+	defer write_queues.mux.Unlock()
+	queue, present := write_queues.queues[socket_id]
 	if !present {
-		log.WithFields(log.Fields{
-			"at":         "queueForDestinationDialIfNeeded",
-			"session_id": session_id,
-			"socket_id":  socket_id,
-		}).Debug("dialing destination")
-		destination, err := dial_destination()
+		if _, closed := write_queues.closed[socket_id]; closed {
+			return nil, errSocketClosed
+		}
+		if write_queues.opening[socket_id] {
+			return nil, errSocketOpening
+		}
+		if server.lifecycle.isDraining() {
+			return nil, ErrShutdown
+		}
+		if server.logger.debugging() {
+			server.logger.Debug("dialing destination",
+				"at", "Server.queueForDestinationDialIfNeeded",
+				"session_id", session_id,
+				"socket_id", socket_id,
+			)
+		}
+		destination, err := server.dialDestination(session_id, socket_id)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"at":         "queueForDestinationDialIfNeeded",
-				"session_id": session_id,
-				"socket_id":  socket_id,
-				"error":      err.Error(),
-			}).Error("error dialing destination")
+			server.destinationFailed(session_id, socket_id, err)
+			write_queues.markClosedLocked(socket_id)
 			return queue, err
 		}
-		queue = NewWriteQueue(destination)
-		server_write_queues[socket_id] = queue
-		respondersMux.Lock()
-		if imuxer, ok := responders[session_id]; ok {
-			go imuxer.ReadFrom(socket_id, destination, session_id)
+		return server.addDestinationLocked(socket_id, session_id, duplicates, destination)
+	}
+	return queue, nil
+}
+
+// Dial the address a ControlOpen names for a new socket in the background,
+// so a slow dial does not hold up the transport socket it arrived on.
+// Chunks for the socket are dropped until the dial finishes, and a socket
+// reset meanwhile closes the destination once it is dialed.
+func (server *Server) openAddress(control Control) {
+	socket_id, session_id := control.SocketID, control.SessionID
+	write_queues := server.writeQueues
+	write_queues.mux.Lock()
+	_, present := write_queues.queues[socket_id]
+	_, closed := write_queues.closed[socket_id]
+	if present || closed || write_queues.opening[socket_id] {
+		write_queues.mux.Unlock()
+		return
+	}
+	write_queues.opening[socket_id] = true
+	write_queues.mux.Unlock()
+	server.lifecycle.run(func() {
+		if server.logger.debugging() {
+			server.logger.Debug("dialing address",
+				"at", "Server.openAddress",
+				"session_id", session_id,
+				"socket_id", socket_id,
+				"address", control.Destination,
+			)
+		}
+		destination, err := server.dialAddress(control.Destination)
+		write_queues.mux.Lock()
+		delete(write_queues.opening, socket_id)
+		if _, closed := write_queues.closed[socket_id]; closed {
+			write_queues.mux.Unlock()
+			if destination != nil {
+				destination.Close()
+			}
+			return
+		}
+		if err == nil && server.lifecycle.isDraining() {
+			destination.Close()
+			err = ErrShutdown
+		}
+		if err != nil {
+			server.destinationFailed(session_id, socket_id, err)
+			write_queues.markClosedLocked(socket_id)
 		} else {
-			log.WithFields(log.Fields{
-				"at":         "queueForDestinationDialIfNeeded",
-				"session_id": session_id,
-				"socket_id":  socket_id,
-			}).Fatal("no responding reader exists, should not be possible")
+			_, err = server.addDestinationLocked(socket_id, session_id, control.Duplicates, destination)
+		}
+		write_queues.mux.Unlock()
+		if err != nil {
+			server.refuseStream(socket_id, session_id, err)
 		}
-		respondersMux.Unlock()
+	})
+}
+
+// Dial an address a Client named as the destination of a stream
+func (server *Server) dialAddress(address string) (net.Conn, error) {
+	if server.DialAddress == nil {
+		return nil, errNoDestinations
 	}
-	swqMux.Unlock()
+	return server.DialAddress(address)
+}
+
+// Report a destination that could not be dialed for a new socket
+func (server *Server) destinationFailed(session_id, socket_id string, err error) {
+	server.logger.Error("error dialing destination",
+		"at", "Server.destinationFailed",
+		"session_id", session_id,
+		"socket_id", socket_id,
+		"error", err,
+	)
+	server.reporter.report(&DestinationError{
+		SessionID: session_id,
+		SocketID:  socket_id,
+		Err:       err,
+	})
+	server.reporter.observer.DialFailed(StreamEvent{
+		SessionID: session_id,
+		SocketID:  socket_id,
+		Err:       err,
+	})
+}
+
+// Start writing a new socket's chunks out to its dialed destination and
+// reading responses back from it into the session's responder, telling
+// the client it opened.  The caller must hold the write queues' mux.
+func (server *Server) addDestinationLocked(socket_id, session_id string, duplicates int, destination net.Conn) (*WriteQueue, error) {
+	write_queues := server.writeQueues
+	destination = newHalfClosingConn(destination)
+	imuxer := server.responder(session_id)
+	if imuxer == nil {
+		server.logger.Error("no responding reader exists, should not be possible",
+			"at", "Server.addDestinationLocked",
+			"session_id", session_id,
+			"socket_id", socket_id,
+		)
+		server.reporter.report(&DestinationError{
+			SessionID: session_id,
+			SocketID:  socket_id,
+			Err:       errNoResponder,
+		})
+		server.reporter.observer.DialFailed(StreamEvent{
+			SessionID: session_id,
+			SocketID:  socket_id,
+			Err:       errNoResponder,
+		})
+		destination.Close()
+		write_queues.markClosedLocked(socket_id)
+		return nil, errNoResponder
+	}
+	server.reporter.observer.StreamOpened(StreamEvent{
+		SessionID: session_id,
+		SocketID:  socket_id,
+	})
+	queue := newWriteQueue(socket_id, destination, imuxer, write_queues)
+	write_queues.queues[socket_id] = queue
+	server.lifecycle.run(func() {
+		imuxer.readFrom(socket_id, destination, duplicates)
+	}, destination)
+	imuxer.queueControl(Control{
+		SocketID: socket_id,
+		Type:     ControlOpenAck,
+	})
 	return queue, nil
 }
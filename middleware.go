@@ -0,0 +1,80 @@
+package imux
+
+// A Middleware transforms chunks on their way between a DataIMUX and the
+// transport sockets, to inspect, tag or encrypt chunk data or to inject
+// faults.  Send is called with a copy of each chunk just before it is
+// written to a transport socket, including retransmissions, duplicates
+// and parity chunks, after its data was compressed.  Receive is called
+// with each chunk read from a transport socket before it is queued to be
+// written out, before its data is decompressed.  Chunks that Send or
+// Receive return an error for are dropped, to be retransmitted if the
+// peer acknowledges chunks.  Neither may modify the chunk's Data in place,
+// since it is shared with chunks held for retransmission, but may replace
+// it.  Data returned by Send must still fit the max chunk size negotiated
+// for the transport socket, plus the parity header for parity chunks, or
+// the chunk is dropped and reported as a *ChunkError wrapping
+// ErrFrameTooLarge.  Middleware that grows chunk data, such as to add an
+// authentication tag, needs the MiddlewareOverhead option set to the most
+// bytes it adds, so chunks are read that much smaller.  Both are called
+// from many goroutines at once.
+type Middleware interface {
+	Send(chunk *Chunk) error
+	Receive(chunk *Chunk) error
+}
+
+// The Middleware of a Client or Server.  Chunks being sent pass through
+// the stages in order and chunks being received in reverse order, so each
+// stage receives chunks as the same stage sent them.
+type pipeline struct {
+	stages []Middleware
+}
+
+func newPipeline() *pipeline {
+	return &pipeline{}
+}
+
+// Switch to a list of Middleware.  Must be called before any goroutine
+// sends or receives chunks.
+func (pipeline *pipeline) use(stages []Middleware) {
+	pipeline.stages = append([]Middleware(nil), stages...)
+}
+
+// Pass a chunk being sent through every stage
+func (pipeline *pipeline) send(chunk *Chunk) error {
+	for _, stage := range pipeline.stages {
+		if err := stage.Send(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pass a chunk being received through every stage in reverse
+func (pipeline *pipeline) receive(chunk *Chunk) error {
+	for i := len(pipeline.stages) - 1; i >= 0; i-- {
+		if err := pipeline.stages[i].Receive(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Report a chunk dropped because a Middleware failed on it while it was
+// being sent or received
+func (data_imux *DataIMUX) middlewareFailed(chunk *Chunk, received bool, err error) {
+	data_imux.logger.Warn("middleware dropped chunk",
+		"at", "DataIMUX.middlewareFailed",
+		"session_id", chunk.SessionID,
+		"socket_id", chunk.SocketID,
+		"sequence_id", chunk.SequenceID,
+		"received", received,
+		"error", err,
+	)
+	data_imux.reporter.report(&ChunkError{
+		SessionID:  chunk.SessionID,
+		SocketID:   chunk.SocketID,
+		SequenceID: chunk.SequenceID,
+		Received:   received,
+		Err:        err,
+	})
+}
@@ -0,0 +1,166 @@
+package imux
+
+import (
+	"bytes"
+	"errors"
+	"github.com/satori/go.uuid"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Appends the calls made to it to a shared log
+type loggingMiddleware struct {
+	name  string
+	calls *[]string
+}
+
+func (middleware loggingMiddleware) Send(chunk *Chunk) error {
+	*middleware.calls = append(*middleware.calls, middleware.name+" send")
+	return nil
+}
+
+func (middleware loggingMiddleware) Receive(chunk *Chunk) error {
+	*middleware.calls = append(*middleware.calls, middleware.name+" receive")
+	return nil
+}
+
+// Appends a tag to the data of chunks sent and strips it from chunks
+// received
+type tagMiddleware struct {
+	tag []byte
+}
+
+func (middleware tagMiddleware) Send(chunk *Chunk) error {
+	chunk.Data = append(append([]byte(nil), chunk.Data...), middleware.tag...)
+	return nil
+}
+
+func (middleware tagMiddleware) Receive(chunk *Chunk) error {
+	if !bytes.HasSuffix(chunk.Data, middleware.tag) {
+		return errors.New("chunk is missing its tag")
+	}
+	chunk.Data = chunk.Data[:len(chunk.Data)-len(middleware.tag)]
+	return nil
+}
+
+func TestPipelineOrder(t *testing.T) {
+	calls := []string{}
+	pipeline := newPipeline()
+	pipeline.use([]Middleware{
+		loggingMiddleware{name: "first", calls: &calls},
+		loggingMiddleware{name: "second", calls: &calls},
+	})
+	pipeline.send(&Chunk{})
+	pipeline.receive(&Chunk{})
+	expected := []string{"first send", "second send", "second receive", "first receive"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected calls %v, made %v", expected, calls)
+	}
+}
+
+func TestReadSizeLeavesMiddlewareOverhead(t *testing.T) {
+	options := DefaultOptions()
+	options.ChunkSize = 128
+	options.MiddlewareOverhead = 16
+	lifecycle := newLifecycle()
+	defer lifecycle.stop()
+	data_imux := newDataIMUX(uuid.NewV4().String(), &options, lifecycle, newLogger(nil), newReporter(nil), newPipeline())
+	if size := data_imux.readSize(); size != 112 {
+		t.Fatalf("expected chunks read 112 bytes at a time, read %d", size)
+	}
+	data_imux.limitChunkSize(64)
+	if size := data_imux.readSize(); size != 48 {
+		t.Fatalf("expected chunks read 48 bytes at a time under the negotiated limit, read %d", size)
+	}
+}
+
+// Read a payload through a DataIMUX whose Middleware adds tag_size bytes
+// to each chunk, writing it to a transport socket with a max chunk size
+// of 64, and return the chunks written along with the failures reported
+func sendThroughMiddleware(t *testing.T, payload []byte, overhead, tag_size int) (chan *Chunk, chan error) {
+	t.Helper()
+	options := DefaultOptions()
+	options.ChunkSize = 64
+	options.MiddlewareOverhead = overhead
+	lifecycle := newLifecycle()
+	t.Cleanup(lifecycle.stop)
+	failures := make(chan error, 16)
+	pipeline := newPipeline()
+	pipeline.use([]Middleware{tagMiddleware{tag: bytes.Repeat([]byte{0xff}, tag_size)}})
+	data_imux := newDataIMUX(uuid.NewV4().String(), &options, lifecycle, newLogger(nil), newReporter(failures), pipeline)
+	data_imux.negotiated(supportedFeatures)
+	data_imux.limitChunkSize(64)
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+	features := uint32(supportedFeatures &^ FeatureHeartbeats)
+	conn := newFramedConn(local, "pipe", true, newLogger(nil))
+	if err := conn.frame(features, 64); err != nil {
+		t.Fatal(err)
+	}
+	go data_imux.writeTo(newTransportSocket(conn, features, 64, &options, newLogger(nil)))
+	go data_imux.ReadFrom(uuid.NewV4().String(), bytes.NewReader(payload), data_imux.SessionID)
+
+	chunks := make(chan *Chunk, 64)
+	reader := newFrameReader(remote, 1024)
+	go func() {
+		for {
+			frame, err := reader.ReadFrame()
+			if err != nil {
+				return
+			}
+			if chunk, ok := frame.(*Chunk); ok {
+				select {
+				case chunks <- chunk:
+				default:
+				}
+			}
+		}
+	}()
+	return chunks, failures
+}
+
+func TestMiddlewareOverheadFitsChunks(t *testing.T) {
+	// Within the credit the stream has before any acknowledgement
+	payload := randomPayload(t, initialStreamCredit*48)
+	chunks, failures := sendThroughMiddleware(t, payload, 16, 16)
+	received := []byte{}
+	for len(received) < len(payload) {
+		select {
+		case chunk := <-chunks:
+			if len(chunk.Data) > 64 || !bytes.HasSuffix(chunk.Data, bytes.Repeat([]byte{0xff}, 16)) {
+				t.Fatalf("expected tagged chunks of at most 64 bytes, read %d bytes", len(chunk.Data))
+			}
+			received = append(received, chunk.Data[:len(chunk.Data)-16]...)
+		case err := <-failures:
+			t.Fatalf("expected every chunk to fit, reported %v", err)
+		case <-time.After(time.Second):
+			t.Fatalf("only %d of %d bytes were written", len(received), len(payload))
+		}
+	}
+	if !bytes.Equal(received, payload) {
+		t.Fatal("expected the payload to be written in order")
+	}
+}
+
+func TestMiddlewareGrowingChunksTooLarge(t *testing.T) {
+	chunks, failures := sendThroughMiddleware(t, randomPayload(t, initialStreamCredit*48), 16, 17)
+	select {
+	case err := <-failures:
+		var chunk_err *ChunkError
+		if !errors.As(err, &chunk_err) || chunk_err.Received || !errors.Is(err, ErrFrameTooLarge) {
+			t.Fatalf("expected a sent chunk dropped as too large, reported %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("chunk grown past the max chunk size was not reported")
+	}
+	select {
+	case chunk := <-chunks:
+		if len(chunk.Data) > 0 {
+			t.Fatalf("expected chunks grown too large to be dropped, read %d bytes", len(chunk.Data))
+		}
+	default:
+	}
+}
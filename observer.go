@@ -0,0 +1,84 @@
+package imux
+
+import (
+	"errors"
+)
+
+// Reported to an Observer for a stream reset by either peer before it
+// finished
+var ErrStreamReset = errors.New("imux: stream reset")
+
+// An Observer is told about transport sockets, streams and chunks as a
+// Client or Server handles them.  Callbacks are made from the goroutine
+// handling the event, possibly many at once, and should return quickly.
+// Embed NopObserver to implement only some of them.
+type Observer interface {
+	// A Client started its session, or a Server accepted the first
+	// transport socket of a session
+	SessionStarted(SessionEvent)
+	// A session ended with the Client or Server shutting down, once every
+	// goroutine handling it has returned
+	SessionShutdown(SessionEvent)
+	// A transport socket negotiated and began carrying chunks
+	TransportUp(TransportEvent)
+	// A transport socket stopped carrying chunks, with the error it
+	// failed with
+	TransportDown(TransportEvent)
+	// A stream was accepted or dialed by a Client, or its destination
+	// dialed by a Server
+	StreamOpened(StreamEvent)
+	// A stream stopped writing data out to its socket, with the number
+	// of bytes written and the error it ended with, nil if the peer
+	// closed it
+	StreamClosed(StreamEvent)
+	// A Server failed to dial the destination of a stream
+	DialFailed(StreamEvent)
+	// A chunk is being written again after it went unacknowledged or its
+	// transport socket failed
+	ChunkRetransmitted(ChunkEvent)
+}
+
+// A session of a Client or Server.  Err is the error shutting down
+// returned, nil if everything in flight was delivered first.
+type SessionEvent struct {
+	SessionID string
+	Err       error
+}
+
+// A transport socket of a session.  Route is the bind a Client dialed it
+// from, or the address of the Client a Server accepted it from.  Stats
+// are what the transport socket carried, once it is down.
+type TransportEvent struct {
+	SessionID string
+	Route     string
+	Err       error
+	Stats     TransportStats
+}
+
+// A stream of a session
+type StreamEvent struct {
+	SessionID string
+	SocketID  string
+	Bytes     uint64
+	Err       error
+}
+
+// A chunk of a stream, with the size of its data
+type ChunkEvent struct {
+	SessionID  string
+	SocketID   string
+	SequenceID uint64
+	Size       int
+}
+
+// An Observer that ignores everything
+type NopObserver struct{}
+
+func (NopObserver) SessionStarted(SessionEvent)   {}
+func (NopObserver) SessionShutdown(SessionEvent)  {}
+func (NopObserver) TransportUp(TransportEvent)    {}
+func (NopObserver) TransportDown(TransportEvent)  {}
+func (NopObserver) StreamOpened(StreamEvent)      {}
+func (NopObserver) StreamClosed(StreamEvent)      {}
+func (NopObserver) DialFailed(StreamEvent)        {}
+func (NopObserver) ChunkRetransmitted(ChunkEvent) {}
@@ -0,0 +1,141 @@
+package imux
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Passes the name of every event and the session it belongs to on to a
+// channel, dropping them once it is full
+type eventRecorder struct {
+	events chan string
+}
+
+func newEventRecorder() *eventRecorder {
+	return &eventRecorder{events: make(chan string, 64)}
+}
+
+func (observer *eventRecorder) record(name, session_id string) {
+	select {
+	case observer.events <- name + " " + session_id:
+	default:
+	}
+}
+
+func (observer *eventRecorder) SessionStarted(event SessionEvent) {
+	observer.record("SessionStarted", event.SessionID)
+}
+
+func (observer *eventRecorder) SessionShutdown(event SessionEvent) {
+	if event.Err != nil {
+		observer.record("SessionShutdown with error", event.SessionID)
+		return
+	}
+	observer.record("SessionShutdown", event.SessionID)
+}
+
+func (observer *eventRecorder) TransportUp(event TransportEvent) {
+	observer.record("TransportUp", event.SessionID)
+}
+
+func (observer *eventRecorder) TransportDown(event TransportEvent) {
+	observer.record("TransportDown", event.SessionID)
+}
+
+func (observer *eventRecorder) StreamOpened(event StreamEvent) {
+	observer.record("StreamOpened", event.SessionID)
+}
+
+func (observer *eventRecorder) StreamClosed(event StreamEvent) {
+	observer.record("StreamClosed", event.SessionID)
+}
+
+func (observer *eventRecorder) DialFailed(event StreamEvent) {
+	observer.record("DialFailed", event.SessionID)
+}
+
+func (observer *eventRecorder) ChunkRetransmitted(event ChunkEvent) {
+	observer.record("ChunkRetransmitted", event.SessionID)
+}
+
+// Wait for the next events to be exactly expected, in order
+func (observer *eventRecorder) expect(t *testing.T, expected ...string) {
+	t.Helper()
+	for _, event := range expected {
+		select {
+		case recorded := <-observer.events:
+			if recorded != event {
+				t.Fatalf("expected %q, observed %q", event, recorded)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %q", event)
+		}
+	}
+}
+
+func TestClientSessionEvents(t *testing.T) {
+	client, err := NewClientWithOptions(map[string]int{"127.0.0.1": 1}, func(string) Redialer {
+		return func() (net.Conn, error) {
+			return nil, syscall.ECONNREFUSED
+		}
+	}, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	observer := newEventRecorder()
+	client.Observer = observer
+	if err := client.Start(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	observer.expect(t, "SessionStarted "+client.SessionID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	observer.expect(t, "SessionShutdown "+client.SessionID)
+}
+
+func TestServerDialFailedEvents(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServerWithOptions(func() (net.Conn, error) {
+		return nil, syscall.ECONNREFUSED
+	}, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	observer := newEventRecorder()
+	server.Observer = observer
+	if err := server.Start(context.Background(), listener); err != nil {
+		t.Fatal(err)
+	}
+	client := startClient(t, func() (net.Conn, error) {
+		return net.Dial("tcp", listener.Addr().String())
+	})
+	if _, err := client.Dial("tcp", "refused"); err == nil {
+		t.Fatal("expected the stream to be refused")
+	}
+	observer.expect(t,
+		"SessionStarted "+client.SessionID,
+		"TransportUp "+client.SessionID,
+		"DialFailed "+client.SessionID,
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	client.Shutdown(ctx)
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	observer.expect(t,
+		"TransportDown "+client.SessionID,
+		"SessionShutdown "+client.SessionID,
+	)
+}
@@ -1,94 +1,372 @@
 package imux
 
 import (
-	log "github.com/Sirupsen/logrus"
+	"context"
 	"github.com/satori/go.uuid"
+	"log/slog"
 	"net"
 	"sync"
 )
 
-// Write Queues for all chunks coming back in response
-var client_write_queues = make(map[string]*WriteQueue)
-var cwqMux sync.Mutex
+// A Client accepts sockets and inverse multiplexes their data over
+// transport sockets dialed to a Server from each bind address, writing
+// responses back into them.  Streams can also be opened in-process with
+// Dial.  All sockets of a Client share one session.
+type Client struct {
+	SessionID string
+	// Where the Client logs, set before it is started.  Nil uses slog's
+	// default logger.
+	Logger *slog.Logger
+	// Failures of transport sockets are reported as *TransportError,
+	// streams that failed to write out or were refused or reset by the
+	// Server as *StreamError and chunks dropped by Middleware as
+	// *ChunkError.  Failures are dropped while Errors is full.
+	Errors chan error
+	// Told about transport sockets, streams and chunks, set before the
+	// Client is started
+	Observer Observer
+	// Transforms chunks sent and received, set before the Client is
+	// started
+	Middleware []Middleware
+	// Carries frames to the Server, set before the Client is started.
+	// Nil carries them over connections dialed by the Client's
+	// RedialerGenerator.
+	Transport Transport
+	// Sockets accepted from the listener speak SOCKS5, each naming the
+	// address the Server dials for its stream, set before the Client is
+	// started.  The Server must dial addresses with DialAddress.
+	SOCKS5            bool
+	imuxer            *DataIMUX
+	binds             map[string]int
+	redialerGenerator RedialerGenerator
+	transport         Transport
+	writeQueues       *writeQueues
+	lifecycle         *lifecycle
+	logger            *logger
+	reporter          *reporter
+	pipeline          *pipeline
+	options           *Options
+	served            chan error
+	opening           map[string]chan error
+	openingMux        sync.Mutex
+}
+
+// Create a new Client with a new session that dials count transport
+// sockets for each bind using Redialers from redialer_generator
+func NewClient(binds map[string]int, redialer_generator RedialerGenerator) *Client {
+	client, _ := NewClientWithOptions(binds, redialer_generator, DefaultOptions())
+	return client
+}
+
+// Create a new Client like NewClient, tuned by options.  Returns an error
+// wrapping ErrInvalidOptions if options are not valid.
+func NewClientWithOptions(binds map[string]int, redialer_generator RedialerGenerator, options Options) (*Client, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	session_id := uuid.NewV4().String()
+	lifecycle := newLifecycle()
+	logger := newLogger(nil)
+	failures := make(chan error, options.ErrorQueueDepth)
+	reporter := newReporter(failures)
+	pipeline := newPipeline()
+	client := &Client{
+		SessionID:         session_id,
+		Errors:            failures,
+		imuxer:            newDataIMUX(session_id, &options, lifecycle, logger, reporter, pipeline),
+		binds:             binds,
+		redialerGenerator: redialer_generator,
+		writeQueues:       newWriteQueues(lifecycle, options.ClosedSocketMemory),
+		lifecycle:         lifecycle,
+		logger:            logger,
+		reporter:          reporter,
+		pipeline:          pipeline,
+		options:           &options,
+		served:            make(chan error, 1),
+		opening:           make(map[string]chan error),
+	}
+	if client.logger.debugging() {
+		client.logger.Debug("creating new Client",
+			"at", "NewClient",
+			"session_id", session_id,
+			"binds", binds,
+		)
+	}
+	return client, nil
+}
 
 // Provide a net.Listener, for which any accepted sockets will have their data
 // inverse multiplexed to a corresponding socket on the server.
 func OneToMany(listener net.Listener, binds map[string]int, redialer_generator RedialerGenerator) error {
-	// Create a new SessionID shared by all sockets accepted by this OneToMany
-	session_id := uuid.NewV4().String()
-	log.WithFields(log.Fields{
-		"at":         "OneToMany",
-		"session_id": session_id,
-		"binds":      binds,
-	}).Debug("creating new OneToMany")
-
-	// Create a new DataIMUX to read data from accepted connections and
-	// chunk all data.  Create IMUXSockets to read chunks from the DataIMUX
-	// and write them to connections to the server.
-	imuxer := NewDataIMUX(session_id)
-	for bind, count := range binds {
-		for i := 0; i < count; i++ {
-			go func(bind_addr string) {
-				log.WithFields(log.Fields{
-					"at":         "OneToMany",
-					"bind":       bind,
-					"session_id": session_id,
-				}).Debug("creating new imux socket")
-				imux_socket := IMUXSocket{
-					IMUXer:   imuxer,
-					Redialer: redialer_generator(bind_addr),
-				}
-				imux_socket.init(session_id)
-			}(bind)
+	return NewClient(binds, redialer_generator).Serve(listener)
+}
+
+// Start the Client and accept sockets from the listener until it fails,
+// returning ErrShutdown once the Client is shut down
+func (client *Client) Serve(listener net.Listener) error {
+	if err := client.Start(context.Background(), listener); err != nil {
+		return err
+	}
+	return <-client.served
+}
+
+// Dial transport sockets and accept sockets from the listener in the
+// background, reading their data into the session.  The listener may be
+// nil for a Client that only opens streams with Dial.  Once ctx is done
+// the Client is shut down without draining.
+func (client *Client) Start(ctx context.Context, listener net.Listener) error {
+	if err := client.lifecycle.start(ctx, listener, client.Shutdown); err != nil {
+		return err
+	}
+	client.logger.use(client.Logger)
+	client.reporter.use(client.Observer)
+	client.pipeline.use(client.Middleware)
+	client.reporter.observer.SessionStarted(SessionEvent{SessionID: client.SessionID})
+	client.lifecycle.atFinish(func(err error) {
+		client.reporter.observer.SessionShutdown(SessionEvent{
+			SessionID: client.SessionID,
+			Err:       err,
+		})
+	})
+	client.transport = client.Transport
+	if client.transport == nil {
+		client.transport = &ConnTransport{
+			Redialers: client.redialerGenerator,
+			Logger:    client.Logger,
 		}
 	}
+	client.lifecycle.run(client.imuxer.retransmitExpired)
+	client.dialTransports()
+	if listener != nil {
+		client.lifecycle.run(func() {
+			client.served <- client.acceptSockets(listener)
+		})
+	}
+	return nil
+}
+
+// Open a stream to the Server's destination, returning this end of it as
+// a net.Conn.  The Server decides the destination, so network and address
+// only name the remote end of the stream.
+func (client *Client) Dial(network, address string) (net.Conn, error) {
+	return client.DialContext(context.Background(), network, address)
+}
+
+// Open a stream to the Server's destination like Dial, once a transport
+// socket has been negotiated.  When the Server exchanges control
+// messages, DialContext waits until the Server has dialed the
+// destination, returning the *StreamError it failed with or ctx's error
+// if ctx is done first.
+func (client *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return client.dialStream(ctx, address, "")
+}
+
+// Open a stream like DialContext to an address the Server dials for it,
+// instead of the Server's own destination, resolving any host name on the
+// Server.  Waits until a transport socket has been negotiated, and fails
+// if the Server does not dial addresses named by Clients.
+func (client *Client) DialAddress(ctx context.Context, address string) (net.Conn, error) {
+	if len(address) > maxControlReason {
+		return nil, errDestinationTooLong
+	}
+	if err := client.awaitDestinations(ctx); err != nil {
+		return nil, err
+	}
+	return client.dialStream(ctx, address, address)
+}
 
-	// In an infinite loop, accept new connections to this listener
-	// and read data into the session DataIMUX.  Create a WriteQueue
-	// to write out return chunks.
+// Open a stream whose remote end is named address, asking the Server to
+// dial destination for it, or its own destination if empty
+func (client *Client) dialStream(ctx context.Context, address, destination string) (net.Conn, error) {
+	if !client.lifecycle.isStarted() {
+		return nil, errNotStarted
+	}
+	if client.lifecycle.isDraining() {
+		return nil, ErrShutdown
+	}
+	if err := client.awaitReady(ctx); err != nil {
+		return nil, err
+	}
+	socket_id := uuid.NewV4().String()
+	local, remote := newStreamPipe(streamAddr(socket_id), streamAddr(address))
+	var opened chan error
+	if client.imuxer.controlling() {
+		opened = client.expectOpen(socket_id)
+	}
+	if client.logger.debugging() {
+		client.logger.Debug("dialing new stream",
+			"at", "Client.dialStream",
+			"session_id", client.SessionID,
+			"socket_id", socket_id,
+			"address", address,
+			"destination", destination,
+		)
+	}
+	client.open(socket_id, remote, destination)
+	if opened == nil {
+		return local, nil
+	}
+	select {
+	case err := <-opened:
+		if err != nil {
+			local.Close()
+			return nil, err
+		}
+		return local, nil
+	case <-ctx.Done():
+		client.opened(socket_id, nil)
+		local.Close()
+		return nil, ctx.Err()
+	case <-client.lifecycle.done:
+		local.Close()
+		return nil, ErrShutdown
+	}
+}
+
+// Wait until a transport socket has been negotiated, so the features the
+// Server supports are known, returning ctx's error if ctx is done first
+func (client *Client) awaitReady(ctx context.Context) error {
+	if !client.lifecycle.isStarted() {
+		return errNotStarted
+	}
+	select {
+	case <-client.imuxer.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-client.lifecycle.done:
+		return ErrShutdown
+	}
+}
+
+// Wait until a transport socket has been negotiated like awaitReady,
+// returning errNoDestinations if the Server does not dial addresses named
+// by Clients
+func (client *Client) awaitDestinations(ctx context.Context) error {
+	if err := client.awaitReady(ctx); err != nil {
+		return err
+	}
+	if !client.imuxer.destinations() {
+		return errNoDestinations
+	}
+	return nil
+}
+
+// Stop accepting sockets and reading from the sockets already accepted,
+// wait for the data already read and the responses to it to be delivered
+// until ctx is done, then close every socket and wait for the Client's
+// goroutines to return.  Returns ctx's error if it was done before the
+// data drained.
+func (client *Client) Shutdown(ctx context.Context) error {
+	if client.logger.debugging() {
+		client.logger.Debug("shutting down Client",
+			"at", "Client.Shutdown",
+			"session_id", client.SessionID,
+		)
+	}
+	return client.lifecycle.stopAll(ctx, client.imuxer.stopReading, func() bool {
+		return client.imuxer.idle() && client.writeQueues.empty()
+	})
+}
+
+// Accept sockets from the listener until it fails
+func (client *Client) acceptSockets(listener net.Listener) error {
 	for {
 		socket, err := listener.Accept()
 		if err != nil {
-			log.WithFields(log.Fields{
-				"at":         "OneToMany",
-				"session_id": session_id,
-				"error":      err.Error(),
-			}).Error("error accepting new inbound connection to imux")
+			if client.lifecycle.isDraining() {
+				return ErrShutdown
+			}
+			client.logger.Error("error accepting new inbound connection to imux",
+				"at", "Client.acceptSockets",
+				"session_id", client.SessionID,
+				"error", err,
+			)
 			return err
 		}
-		socket_id := uuid.NewV4().String()
-		log.WithFields(log.Fields{
-			"at":         "OneToMany",
-			"session_id": session_id,
-			"socket_id":  socket_id,
-		}).Debug("accepted new inbound connection to imux")
-
-		// Create a new WriteQueue addressed by the socket ID to
-		// take return chunks and write them into this socket
-		cwqMux.Lock()
-		client_write_queues[socket_id] = NewWriteQueue(socket)
-		cwqMux.Unlock()
-		createFailClientReporter(socket_id, session_id, imuxer)
-
-		go imuxer.ReadFrom(socket_id, socket, session_id)
-	}
-}
-
-func createFailClientReporter(socket_id, session_id string, mux DataIMUX) {
-	fsoMux.Lock()
-	if _, present := FailedSocketOuts[socket_id]; !present {
-		FailedSocketOuts[socket_id] = make(chan bool, 0)
-		go func(socket_id, session_id string) {
-			for {
-				<-FailedSocketOuts[socket_id]
-				mux.Chunks <- Chunk{
-					SessionID:  session_id,
-					SocketID:   socket_id,
-					SequenceID: 0,
-					Close:      true,
+		if client.SOCKS5 {
+			accepted := socket
+			client.lifecycle.run(func() {
+				client.acceptSOCKS5(accepted)
+			}, accepted)
+		} else {
+			client.accept(socket)
+		}
+	}
+}
+
+// Create IMUXSockets to read chunks from the DataIMUX and write them to
+// connections to the server
+func (client *Client) dialTransports() {
+	for bind, count := range client.binds {
+		for i := 0; i < count; i++ {
+			bind_addr := bind
+			client.lifecycle.run(func() {
+				if client.logger.debugging() {
+					client.logger.Debug("creating new imux socket",
+						"at", "Client.dialTransports",
+						"bind", bind_addr,
+						"session_id", client.SessionID,
+					)
 				}
-			}
-		}(socket_id, session_id)
+				imux_socket := IMUXSocket{
+					IMUXer:    client.imuxer,
+					Transport: client.transport,
+					Bind:      bind_addr,
+					client:    client,
+				}
+				imux_socket.init(client.SessionID)
+			})
+		}
+	}
+}
+
+// Open a stream for an accepted socket under a new socket ID
+func (client *Client) accept(socket net.Conn) {
+	socket_id := uuid.NewV4().String()
+	if client.logger.debugging() {
+		client.logger.Debug("accepted new inbound connection to imux",
+			"at", "Client.accept",
+			"session_id", client.SessionID,
+			"socket_id", socket_id,
+		)
+	}
+	client.open(socket_id, socket, "")
+}
+
+// Read data from a socket into the session DataIMUX, creating a WriteQueue
+// addressed by the socket ID to take return chunks and write them into the
+// socket.  The Server dials destination for the socket, or its own
+// destination if empty.
+func (client *Client) open(socket_id string, socket net.Conn, destination string) {
+	socket = newHalfClosingConn(socket)
+	client.reporter.observer.StreamOpened(StreamEvent{
+		SessionID: client.SessionID,
+		SocketID:  socket_id,
+	})
+	client.writeQueues.add(socket_id, newWriteQueue(socket_id, socket, client.imuxer, client.writeQueues))
+	client.lifecycle.run(func() {
+		client.imuxer.readFromDestination(socket_id, socket, destination)
+	}, socket)
+}
+
+// Start waiting for the Server to answer a stream being opened
+func (client *Client) expectOpen(socket_id string) chan error {
+	opened := make(chan error, 1)
+	client.openingMux.Lock()
+	client.opening[socket_id] = opened
+	client.openingMux.Unlock()
+	return opened
+}
+
+// Pass the Server's answer to a stream being opened to its dialer, if it
+// is still waiting
+func (client *Client) opened(socket_id string, err error) {
+	client.openingMux.Lock()
+	opened, ok := client.opening[socket_id]
+	delete(client.opening, socket_id)
+	client.openingMux.Unlock()
+	if ok {
+		opened <- err
 	}
-	fsoMux.Unlock()
 }
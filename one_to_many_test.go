@@ -0,0 +1,74 @@
+package imux
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Start a Client dialing transport sockets with redialer, shut down when
+// the test finishes
+func startClient(t *testing.T, redialer Redialer) *Client {
+	t.Helper()
+	client, err := NewClientWithOptions(map[string]int{"127.0.0.1": 1}, func(string) Redialer {
+		return redialer
+	}, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Start(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		client.Shutdown(ctx)
+	})
+	return client
+}
+
+func TestDialContextBeforeTransportNegotiated(t *testing.T) {
+	client := startClient(t, func() (net.Conn, error) {
+		return nil, syscall.ECONNREFUSED
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.DialContext(ctx, "tcp", "unreachable"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected dialing without a transport socket to wait for ctx, got %v", err)
+	}
+}
+
+func TestDialWaitsForOpenAck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServerWithOptions(func() (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	}, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(context.Background(), listener); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	client := startClient(t, func() (net.Conn, error) {
+		return net.Dial("tcp", listener.Addr().String())
+	})
+
+	// Dialed straight after starting, before the Client knows the Server
+	// answers opens
+	_, err = client.Dial("tcp", "refused")
+	var stream_err *StreamError
+	if !errors.As(err, &stream_err) || stream_err.Code != ResetRefused {
+		t.Fatalf("expected Dial to wait for the Server to refuse the stream, got %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package imux
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Options tune a Client or Server.  Start from DefaultOptions and change
+// only what is needed, since zero values are invalid.
+type Options struct {
+	// Most bytes of data in each chunk.  Each transport socket negotiates
+	// the smaller of the Client's and Server's.  Default 16384.
+	ChunkSize int
+	// Most bytes of data Middleware adds to each chunk it sends, left free
+	// when reading data into chunks so they still fit the negotiated max
+	// chunk size once sent.  Default 0.
+	MiddlewareOverhead int
+	// Most bytes of chunk data held for one socket while it waits on a
+	// slow destination or on missing chunks.  Peers that negotiate flow
+	// control are only granted credit to send as many chunks as fit.
+	// Default 1MiB.
+	StreamWindowSize int
+	// Compression algorithm offered to peers for chunk data.  Default
+	// CompressionNone.
+	Compression Compression
+	// Number of data chunks covered by each parity chunk, up to 16, or 0
+	// to send no parity chunks.  Smaller intervals recover more losses
+	// for more overhead.  Default 0.
+	ParityInterval int
+	// Number of distinct routes each chunk of a socket is written over at
+	// the same time, up to 4, trading bandwidth for latency on
+	// interactive streams.  The receiver uses whichever copy arrives
+	// first and drops the rest.  Servers send responses to a socket with
+	// the same number of copies as the socket's chunks.  Default 1.
+	DuplicateSends int
+	// Largest number of chunks from a single socket that may be waiting
+	// for acknowledgement before reading from the socket pauses.
+	// Default 256.
+	MaxUnacknowledgedChunks int
+	// How long a chunk written to a transport socket may go
+	// unacknowledged before it is written again.  Default 5s.
+	RetransmitTimeout time.Duration
+	// How often a ping is written to each transport socket that
+	// negotiated heartbeats.  Default 5s.
+	HeartbeatInterval time.Duration
+	// How long a transport socket may go without answering a ping before
+	// it is considered dead, torn down, and redialed.  Must be longer
+	// than HeartbeatInterval.  Default 15s.
+	HeartbeatTimeout time.Duration
+	// How long a transport socket may take to negotiate.  Default 10s.
+	HandshakeTimeout time.Duration
+	// How long a Client waits before redialing a transport socket that
+	// failed, doubled after each failure in a row up to MaxRedialBackoff.
+	// Default 10s.
+	RedialBackoff time.Duration
+	// Longest wait before redialing a transport socket.  Default 2m.
+	MaxRedialBackoff time.Duration
+	// How long a closed socket is remembered, so chunks arriving late for
+	// it are dropped instead of opening it again.  Default 10m.
+	ClosedSocketMemory time.Duration
+	// Number of chunks read from sockets that are held until a transport
+	// socket writes them.  Default 10.
+	ChunkQueueDepth int
+	// Number of chunks waiting to be written again that are held until a
+	// transport socket writes them.  Default 50.
+	RetransmitQueueDepth int
+	// Number of acknowledgements and control messages held until a
+	// transport socket writes them, at least 1 since acknowledgements that
+	// do not fit are dropped.  Default 200.
+	ControlQueueDepth int
+	// Number of chunks queued for a specific transport socket, such as
+	// duplicates and parity chunks, at least 1 since chunks that do not
+	// fit are dropped.  Default 64.
+	TransportQueueDepth int
+	// Number of failures held for Errors before more are dropped.  Default 50.
+	ErrorQueueDepth int
+	// Number of streams a StreamListener holds until they are accepted,
+	// after which new streams are refused.  Default 128.
+	StreamBacklog int
+}
+
+// The Options used by NewClient, NewServer and NewStreamServer
+func DefaultOptions() Options {
+	return Options{
+		ChunkSize:               16384,
+		StreamWindowSize:        1 << 20,
+		Compression:             CompressionNone,
+		ParityInterval:          0,
+		DuplicateSends:          1,
+		MaxUnacknowledgedChunks: 256,
+		RetransmitTimeout:       5 * time.Second,
+		HeartbeatInterval:       5 * time.Second,
+		HeartbeatTimeout:        15 * time.Second,
+		HandshakeTimeout:        10 * time.Second,
+		RedialBackoff:           10 * time.Second,
+		MaxRedialBackoff:        2 * time.Minute,
+		ClosedSocketMemory:      10 * time.Minute,
+		ChunkQueueDepth:         10,
+		RetransmitQueueDepth:    50,
+		ControlQueueDepth:       200,
+		TransportQueueDepth:     64,
+		ErrorQueueDepth:         50,
+		StreamBacklog:           128,
+	}
+}
+
+// Returned by Validate for Options that cannot be used
+var ErrInvalidOptions = errors.New("imux: invalid options")
+
+// Check that every option is usable, returning an error wrapping
+// ErrInvalidOptions that names the first one that is not
+func (options Options) Validate() error {
+	switch {
+	case options.ChunkSize <= 0 || uint64(options.ChunkSize) > math.MaxUint32:
+		return invalidOption("ChunkSize", options.ChunkSize)
+	case options.MiddlewareOverhead < 0 || options.MiddlewareOverhead >= options.ChunkSize:
+		return invalidOption("MiddlewareOverhead", options.MiddlewareOverhead)
+	case options.StreamWindowSize <= 0:
+		return invalidOption("StreamWindowSize", options.StreamWindowSize)
+	case options.Compression != CompressionNone && options.Compression != CompressionDeflate:
+		return invalidOption("Compression", options.Compression)
+	case options.ParityInterval < 0 || options.ParityInterval > maxParityInterval:
+		return invalidOption("ParityInterval", options.ParityInterval)
+	case options.DuplicateSends < 1 || options.DuplicateSends > maxDuplicateSends:
+		return invalidOption("DuplicateSends", options.DuplicateSends)
+	case options.MaxUnacknowledgedChunks < initialStreamCredit:
+		return invalidOption("MaxUnacknowledgedChunks", options.MaxUnacknowledgedChunks)
+	case options.RetransmitTimeout <= 0:
+		return invalidOption("RetransmitTimeout", options.RetransmitTimeout)
+	case options.HeartbeatInterval <= 0:
+		return invalidOption("HeartbeatInterval", options.HeartbeatInterval)
+	case options.HeartbeatTimeout <= options.HeartbeatInterval:
+		return invalidOption("HeartbeatTimeout", options.HeartbeatTimeout)
+	case options.HandshakeTimeout <= 0:
+		return invalidOption("HandshakeTimeout", options.HandshakeTimeout)
+	case options.RedialBackoff <= 0:
+		return invalidOption("RedialBackoff", options.RedialBackoff)
+	case options.MaxRedialBackoff < options.RedialBackoff:
+		return invalidOption("MaxRedialBackoff", options.MaxRedialBackoff)
+	case options.ClosedSocketMemory <= 0:
+		return invalidOption("ClosedSocketMemory", options.ClosedSocketMemory)
+	case options.ChunkQueueDepth < 0:
+		return invalidOption("ChunkQueueDepth", options.ChunkQueueDepth)
+	case options.RetransmitQueueDepth < 0:
+		return invalidOption("RetransmitQueueDepth", options.RetransmitQueueDepth)
+	case options.ControlQueueDepth < 1:
+		return invalidOption("ControlQueueDepth", options.ControlQueueDepth)
+	case options.TransportQueueDepth < 1:
+		return invalidOption("TransportQueueDepth", options.TransportQueueDepth)
+	case options.ErrorQueueDepth < 0:
+		return invalidOption("ErrorQueueDepth", options.ErrorQueueDepth)
+	case options.StreamBacklog < 0:
+		return invalidOption("StreamBacklog", options.StreamBacklog)
+	}
+	return nil
+}
+
+func invalidOption(name string, value interface{}) error {
+	return fmt.Errorf("%w: %s %v", ErrInvalidOptions, name, value)
+}
+
+// Features offered in a hello, including only the selected compression
+// algorithm and parity only if parity chunks are enabled
+func (options *Options) features() uint32 {
+	features := supportedFeatures&^compressionFeatures | options.Compression.feature()
+	if options.ParityInterval <= 0 {
+		features &^= FeatureParity
+	}
+	return features
+}
+
+// Number of chunks that fit in StreamWindowSize, never fewer than the
+// credit senders start with
+func (options *Options) streamWindow() uint64 {
+	window := options.StreamWindowSize / options.ChunkSize
+	if window < initialStreamCredit {
+		window = initialStreamCredit
+	}
+	return uint64(window)
+}
+
+// How long to wait before redialing after failures failures in a row
+func (options *Options) redialBackoff(failures int) time.Duration {
+	backoff := options.RedialBackoff
+	for i := 1; i < failures && backoff < options.MaxRedialBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > options.MaxRedialBackoff {
+		backoff = options.MaxRedialBackoff
+	}
+	return backoff
+}
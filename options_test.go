@@ -0,0 +1,62 @@
+package imux
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultOptionsValid(t *testing.T) {
+	if err := DefaultOptions().Validate(); err != nil {
+		t.Fatalf("expected the default options to be valid, got %v", err)
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	for _, test := range []struct {
+		option string
+		change func(*Options)
+	}{
+		{"ChunkSize", func(options *Options) { options.ChunkSize = 0 }},
+		{"MiddlewareOverhead", func(options *Options) { options.MiddlewareOverhead = -1 }},
+		{"MiddlewareOverhead", func(options *Options) { options.MiddlewareOverhead = options.ChunkSize }},
+		{"StreamWindowSize", func(options *Options) { options.StreamWindowSize = 0 }},
+		{"Compression", func(options *Options) { options.Compression = Compression(9) }},
+		{"ParityInterval", func(options *Options) { options.ParityInterval = maxParityInterval + 1 }},
+		{"DuplicateSends", func(options *Options) { options.DuplicateSends = 0 }},
+		{"DuplicateSends", func(options *Options) { options.DuplicateSends = maxDuplicateSends + 1 }},
+		{"MaxUnacknowledgedChunks", func(options *Options) { options.MaxUnacknowledgedChunks = initialStreamCredit - 1 }},
+		{"RetransmitTimeout", func(options *Options) { options.RetransmitTimeout = 0 }},
+		{"HeartbeatInterval", func(options *Options) { options.HeartbeatInterval = 0 }},
+		{"HeartbeatTimeout", func(options *Options) { options.HeartbeatTimeout = options.HeartbeatInterval }},
+		{"HandshakeTimeout", func(options *Options) { options.HandshakeTimeout = -time.Second }},
+		{"RedialBackoff", func(options *Options) { options.RedialBackoff = 0 }},
+		{"MaxRedialBackoff", func(options *Options) { options.MaxRedialBackoff = options.RedialBackoff - 1 }},
+		{"ClosedSocketMemory", func(options *Options) { options.ClosedSocketMemory = 0 }},
+		{"ChunkQueueDepth", func(options *Options) { options.ChunkQueueDepth = -1 }},
+		{"RetransmitQueueDepth", func(options *Options) { options.RetransmitQueueDepth = -1 }},
+		{"ControlQueueDepth", func(options *Options) { options.ControlQueueDepth = 0 }},
+		{"TransportQueueDepth", func(options *Options) { options.TransportQueueDepth = 0 }},
+		{"ErrorQueueDepth", func(options *Options) { options.ErrorQueueDepth = -1 }},
+		{"StreamBacklog", func(options *Options) { options.StreamBacklog = -1 }},
+	} {
+		options := DefaultOptions()
+		test.change(&options)
+		err := options.Validate()
+		if !errors.Is(err, ErrInvalidOptions) || !strings.Contains(err.Error(), test.option+" ") {
+			t.Errorf("expected an invalid %s, got %v", test.option, err)
+		}
+	}
+}
+
+func TestNewClientWithInvalidOptions(t *testing.T) {
+	options := DefaultOptions()
+	options.ControlQueueDepth = 0
+	if _, err := NewClientWithOptions(nil, nil, options); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected creating a Client with invalid options to fail, got %v", err)
+	}
+	if _, err := NewServerWithOptions(nil, options); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected creating a Server with invalid options to fail, got %v", err)
+	}
+}
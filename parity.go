@@ -0,0 +1,113 @@
+package imux
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// In forward error correction mode a parity chunk follows every
+// Options.ParityInterval data chunks read from a socket.  Its data is the
+// XOR of the data, lengths and frame flags of every chunk in its group, so
+// a receiver holding all but one chunk of the group can rebuild the
+// missing one without waiting for it to be retransmitted.  A parity chunk's
+// sequence ID is the sequence ID of the first chunk in its group, and its
+// data is laid out as:
+//
+//	count    2 bytes big endian number of chunks in the group
+//	lengths  4 bytes big endian XOR of chunk data lengths
+//	flags    1 byte  XOR of chunk frame flags
+//	data     XOR of chunk data, as long as the longest chunk
+const parityHeaderSize = 7
+
+// Largest allowed Options.ParityInterval.  Receivers keep this many
+// chunks after writing them out so they can be used to rebuild a later
+// chunk.
+const maxParityInterval = 16
+
+// Returned when a parity chunk does not describe its group
+var errInvalidParity = errors.New("invalid parity chunk")
+
+// Accumulates the parity of a group of chunks read from a socket
+type parityGroup struct {
+	start   uint64
+	count   int
+	lengths uint32
+	flags   byte
+	data    []byte
+}
+
+// Add a chunk to the group
+func (group *parityGroup) add(chunk Chunk) {
+	if group.count == 0 {
+		group.start = chunk.SequenceID
+	}
+	group.count++
+	group.lengths ^= uint32(len(chunk.Data))
+	group.flags ^= chunk.frameFlags()
+	if len(chunk.Data) > len(group.data) {
+		group.data = append(group.data, make([]byte, len(chunk.Data)-len(group.data))...)
+	}
+	for i, b := range chunk.Data {
+		group.data[i] ^= b
+	}
+}
+
+// Build the parity chunk for the group and start a new group
+func (group *parityGroup) flush(session_id, socket_id string) Chunk {
+	data := make([]byte, parityHeaderSize+len(group.data))
+	binary.BigEndian.PutUint16(data[0:2], uint16(group.count))
+	binary.BigEndian.PutUint32(data[2:6], group.lengths)
+	data[6] = group.flags
+	copy(data[parityHeaderSize:], group.data)
+	parity := Chunk{
+		SessionID:  session_id,
+		SocketID:   socket_id,
+		SequenceID: group.start,
+		Data:       data,
+		Parity:     true,
+	}
+	*group = parityGroup{}
+	return parity
+}
+
+// The sequence IDs of the first and last chunks covered by a parity chunk
+func parityRange(parity *Chunk) (uint64, uint64, error) {
+	if len(parity.Data) < parityHeaderSize || parity.SequenceID == 0 {
+		return 0, 0, errInvalidParity
+	}
+	count := binary.BigEndian.Uint16(parity.Data[0:2])
+	if count == 0 || count > maxParityInterval {
+		return 0, 0, errInvalidParity
+	}
+	return parity.SequenceID, parity.SequenceID + uint64(count) - 1, nil
+}
+
+// Rebuild the chunk with a sequence ID from its group's parity chunk and
+// every other chunk in the group
+func rebuildChunk(parity *Chunk, others []*Chunk, sequence_id uint64) (*Chunk, error) {
+	lengths := binary.BigEndian.Uint32(parity.Data[2:6])
+	flags := parity.Data[6]
+	data := make([]byte, len(parity.Data)-parityHeaderSize)
+	copy(data, parity.Data[parityHeaderSize:])
+	for _, chunk := range others {
+		if len(chunk.Data) > len(data) {
+			return nil, errInvalidParity
+		}
+		lengths ^= uint32(len(chunk.Data))
+		flags ^= chunk.frameFlags()
+		for i, b := range chunk.Data {
+			data[i] ^= b
+		}
+	}
+	if int(lengths) > len(data) {
+		return nil, errInvalidParity
+	}
+	return &Chunk{
+		SessionID:   parity.SessionID,
+		SocketID:    parity.SocketID,
+		SequenceID:  sequence_id,
+		Data:        data[:lengths],
+		Close:       flags&chunkFlagClose != 0,
+		Compression: flaggedCompression(flags),
+	}, nil
+}
@@ -0,0 +1,48 @@
+package imux
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Drops the first data chunk sent with a sequence ID
+type dropOnce struct {
+	sequence uint64
+	dropped  int32
+}
+
+func (middleware *dropOnce) Send(chunk *Chunk) error {
+	if chunk.Parity || chunk.SequenceID != middleware.sequence || len(chunk.Data) == 0 {
+		return nil
+	}
+	if atomic.CompareAndSwapInt32(&middleware.dropped, 0, 1) {
+		return errors.New("dropped by test")
+	}
+	return nil
+}
+
+func (middleware *dropOnce) Receive(*Chunk) error {
+	return nil
+}
+
+func TestParityRebuildsLostChunk(t *testing.T) {
+	options := DefaultOptions()
+	options.ChunkSize = 1024
+	options.ParityInterval = 4
+	options.RetransmitTimeout = time.Minute
+	pair := newLoopback(t, options, map[string]int{"127.0.0.1": 1})
+	dropper := &dropOnce{sequence: 2}
+	pair.client.Middleware = []Middleware{dropper}
+	pair.start(t)
+	conn := pair.dial(t)
+	stream := pair.accept(t)
+
+	payload := randomPayload(t, 8*1024)
+	go conn.Write(payload)
+	expectPayload(t, stream, payload)
+	if atomic.LoadInt32(&dropper.dropped) == 0 {
+		t.Fatal("expected a chunk to be dropped before being sent")
+	}
+}
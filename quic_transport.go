@@ -0,0 +1,447 @@
+package imux
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/quic-go/quic-go"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// The ALPN protocol QUIC transport sockets negotiate when the TLS config
+// does not name one
+const QUICProtocol = "imux"
+
+// How long a Server waits for the stream of a newly accepted QUIC
+// connection, and a Client for a new path to be validated when migrating
+const quicStreamTimeout = 10 * time.Second
+
+// Default QUICTransport.RebindInterval
+const defaultRebindInterval = 5 * time.Second
+
+// Returned by a QUICTransport that has no Address when dialing, or no
+// ListenAddress when listening
+var (
+	errNoQUICAddress       = errors.New("imux: QUIC transport has no address")
+	errNoQUICListenAddress = errors.New("imux: QUIC transport has no listen address")
+)
+
+// A Transport over QUIC.  Each transport socket is a QUIC connection of its
+// own carrying a single stream, dialed from a UDP socket bound to its bind,
+// so every transport socket keeps its own congestion control as it would
+// over TCP while a reconnect costs a single round trip.  Binds are
+// addresses like the binds of a ConnTransport, or names of network
+// interfaces.  While connections are open their binds are checked every
+// RebindInterval, and when the address of a bind changes its connections
+// migrate to UDP sockets bound to the new address instead of being
+// redialed.  Servers follow Clients whose address changes without them
+// knowing, such as behind a NAT.
+type QUICTransport struct {
+	// Address of the Server that Clients dial
+	Address string
+	// Address a Server listens on
+	ListenAddress string
+	// TLS settings used to dial or listen.  QUIC requires TLS 1.3, and
+	// QUICProtocol is negotiated if NextProtos is empty.
+	TLSConfig *tls.Config
+	// QUIC settings.  Nil uses quic-go's defaults with keep-alives.
+	Config *quic.Config
+	// How often the addresses of binds are checked for changes.  Zero
+	// checks every 5s.
+	RebindInterval time.Duration
+	// Where connections log, set before the transport is used.  Nil uses
+	// slog's default logger.
+	Logger *slog.Logger
+	binds  map[string]*quicBind
+	mux    sync.Mutex
+}
+
+// The QUIC connections dialed from one bind, watched for address changes
+// until stop is closed
+type quicBind struct {
+	conns map[*quicConn]bool
+	stop  chan struct{}
+}
+
+func (transport *QUICTransport) Dial(ctx context.Context, bind string) (TransportConn, error) {
+	if transport.Address == "" {
+		return nil, errNoQUICAddress
+	}
+	remote, err := net.ResolveUDPAddr("udp", transport.Address)
+	if err != nil {
+		return nil, err
+	}
+	address, err := resolveBind(bind, remote.IP)
+	if err != nil {
+		return nil, err
+	}
+	udp_transport, err := listenQUIC(address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := udp_transport.Dial(ctx, remote, transport.tlsConfig(), transport.config())
+	if err != nil {
+		udp_transport.Close()
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		udp_transport.Close()
+		return nil, err
+	}
+	quic_conn := &quicConn{
+		conn:       conn,
+		address:    address,
+		transports: []*quic.Transport{udp_transport},
+	}
+	transport.watch(bind, quic_conn)
+	socket := &quicStream{
+		Stream: stream,
+		conn:   conn,
+		close: func() {
+			transport.unwatch(bind, quic_conn)
+			quic_conn.close()
+		},
+	}
+	return newFramedConn(socket, bind, true, newLogger(transport.Logger)), nil
+}
+
+func (transport *QUICTransport) Listen() (TransportListener, error) {
+	if transport.ListenAddress == "" {
+		return nil, errNoQUICListenAddress
+	}
+	listener, err := quic.ListenAddr(transport.ListenAddress, transport.tlsConfig(), transport.config())
+	if err != nil {
+		return nil, err
+	}
+	quic_listener := &quicListener{
+		listener: listener,
+		accepted: make(chan TransportConn),
+		failed:   make(chan error, 1),
+		closed:   make(chan struct{}),
+		logger:   newLogger(transport.Logger),
+	}
+	go quic_listener.acceptConns()
+	return quic_listener, nil
+}
+
+// The TLS config to use, offering QUICProtocol if no protocol was named
+func (transport *QUICTransport) tlsConfig() *tls.Config {
+	config := &tls.Config{}
+	if transport.TLSConfig != nil {
+		config = transport.TLSConfig.Clone()
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{QUICProtocol}
+	}
+	return config
+}
+
+// The QUIC config to use, keeping idle connections alive by default
+func (transport *QUICTransport) config() *quic.Config {
+	if transport.Config != nil {
+		return transport.Config
+	}
+	return &quic.Config{KeepAlivePeriod: 15 * time.Second}
+}
+
+// Start watching a connection dialed from a bind, and the bind itself if
+// it is the first
+func (transport *QUICTransport) watch(bind string, conn *quicConn) {
+	transport.mux.Lock()
+	defer transport.mux.Unlock()
+	if transport.binds == nil {
+		transport.binds = make(map[string]*quicBind)
+	}
+	watched, ok := transport.binds[bind]
+	if !ok {
+		watched = &quicBind{
+			conns: make(map[*quicConn]bool),
+			stop:  make(chan struct{}),
+		}
+		transport.binds[bind] = watched
+		go transport.rebind(bind, watched)
+	}
+	watched.conns[conn] = true
+}
+
+// Stop watching a connection, and its bind if it was the last
+func (transport *QUICTransport) unwatch(bind string, conn *quicConn) {
+	transport.mux.Lock()
+	defer transport.mux.Unlock()
+	watched, ok := transport.binds[bind]
+	if !ok {
+		return
+	}
+	delete(watched.conns, conn)
+	if len(watched.conns) == 0 {
+		close(watched.stop)
+		delete(transport.binds, bind)
+	}
+}
+
+// Check the address of a bind every RebindInterval until it is no longer
+// watched, migrating its connections whenever it changes
+func (transport *QUICTransport) rebind(bind string, watched *quicBind) {
+	interval := transport.RebindInterval
+	if interval <= 0 {
+		interval = defaultRebindInterval
+	}
+	logger := newLogger(transport.Logger)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-watched.stop:
+			return
+		case <-ticker.C:
+		}
+		transport.mux.Lock()
+		conns := make([]*quicConn, 0, len(watched.conns))
+		for conn := range watched.conns {
+			conns = append(conns, conn)
+		}
+		transport.mux.Unlock()
+		for _, conn := range conns {
+			migrated, err := conn.migrate(bind)
+			if err != nil {
+				logger.Warn("error migrating QUIC connection, leaving it on its old address",
+					"at", "QUICTransport.rebind",
+					"bind", bind,
+					"error", err,
+				)
+			} else if migrated && logger.debugging() {
+				logger.Debug("migrated QUIC connection to new bind address",
+					"at", "QUICTransport.rebind",
+					"bind", bind,
+					"address", conn.localAddress().String(),
+				)
+			}
+		}
+	}
+}
+
+// The local address a bind names for dialing a remote address: an address
+// of the network interface by that name in the same family as the remote
+// address, or otherwise the bind resolved as a host
+func resolveBind(bind string, remote net.IP) (net.IP, error) {
+	if iface, err := net.InterfaceByName(bind); err == nil {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ip_net, ok := addr.(*net.IPNet)
+			if !ok || ip_net.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if (ip_net.IP.To4() == nil) == (remote.To4() == nil) {
+				return ip_net.IP, nil
+			}
+		}
+		return nil, fmt.Errorf("interface %s has no address to reach %s from", bind, remote)
+	}
+	address, err := net.ResolveUDPAddr("udp", net.JoinHostPort(bind, "0"))
+	if err != nil {
+		return nil, err
+	}
+	return address.IP, nil
+}
+
+// Open a UDP socket on an address to dial QUIC connections from
+func listenQUIC(address net.IP) (*quic.Transport, error) {
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: address})
+	if err != nil {
+		return nil, err
+	}
+	return &quic.Transport{Conn: socket}, nil
+}
+
+// A QUIC connection dialed by a Client along with every UDP socket it has
+// used.  UDP sockets left behind by a migration are kept until the
+// connection closes, since closing them would tear it down.
+type quicConn struct {
+	conn       *quic.Conn
+	address    net.IP
+	transports []*quic.Transport
+	closed     bool
+	mux        sync.Mutex
+}
+
+// Move the connection to a new UDP socket if the address of its bind
+// changed, returning whether it moved.  A migration that fails is not
+// tried again for the same address, leaving the connection to fail and be
+// redialed if its old address is gone.
+func (conn *quicConn) migrate(bind string) (bool, error) {
+	remote, ok := conn.conn.RemoteAddr().(*net.UDPAddr)
+	if !ok {
+		return false, nil
+	}
+	address, err := resolveBind(bind, remote.IP)
+	if err != nil {
+		return false, err
+	}
+	conn.mux.Lock()
+	if conn.closed || address.Equal(conn.address) {
+		conn.mux.Unlock()
+		return false, nil
+	}
+	conn.address = address
+	conn.mux.Unlock()
+
+	udp_transport, err := listenQUIC(address)
+	if err != nil {
+		return false, err
+	}
+	path, err := conn.conn.AddPath(udp_transport)
+	if err != nil {
+		udp_transport.Close()
+		return false, err
+	}
+	if !conn.keep(udp_transport) {
+		return false, net.ErrClosed
+	}
+	ctx, cancel := context.WithTimeout(conn.conn.Context(), quicStreamTimeout)
+	defer cancel()
+	if err := path.Probe(ctx); err != nil {
+		path.Close()
+		return false, err
+	}
+	if err := path.Switch(); err != nil {
+		path.Close()
+		return false, err
+	}
+	return true, nil
+}
+
+// Hold on to a UDP socket until the connection closes, closing it now if
+// the connection already has
+func (conn *quicConn) keep(udp_transport *quic.Transport) bool {
+	conn.mux.Lock()
+	defer conn.mux.Unlock()
+	if conn.closed {
+		udp_transport.Close()
+		return false
+	}
+	conn.transports = append(conn.transports, udp_transport)
+	return true
+}
+
+// The address the connection was last moved to
+func (conn *quicConn) localAddress() net.IP {
+	conn.mux.Lock()
+	defer conn.mux.Unlock()
+	return conn.address
+}
+
+// Close the connection and every UDP socket it used
+func (conn *quicConn) close() {
+	conn.mux.Lock()
+	conn.closed = true
+	transports := conn.transports
+	conn.transports = nil
+	conn.mux.Unlock()
+	conn.conn.CloseWithError(0, "")
+	for _, udp_transport := range transports {
+		udp_transport.Close()
+	}
+}
+
+// The stream of a QUIC transport socket as a net.Conn.  Closing it closes
+// the whole connection, running close if it is set.
+type quicStream struct {
+	*quic.Stream
+	conn    *quic.Conn
+	close   func()
+	closing sync.Once
+}
+
+func (stream *quicStream) LocalAddr() net.Addr {
+	return stream.conn.LocalAddr()
+}
+
+func (stream *quicStream) RemoteAddr() net.Addr {
+	return stream.conn.RemoteAddr()
+}
+
+func (stream *quicStream) Close() error {
+	stream.closing.Do(func() {
+		if stream.close != nil {
+			stream.close()
+			return
+		}
+		stream.conn.CloseWithError(0, "")
+	})
+	return nil
+}
+
+// Accepts QUIC connections, passing each to Accept once its stream is
+// opened.  Connections that do not open a stream in time are closed.
+type quicListener struct {
+	listener *quic.Listener
+	accepted chan TransportConn
+	failed   chan error
+	closed   chan struct{}
+	closing  sync.Once
+	logger   *logger
+}
+
+func (listener *quicListener) acceptConns() {
+	for {
+		conn, err := listener.listener.Accept(context.Background())
+		if err != nil {
+			listener.failed <- err
+			return
+		}
+		go listener.acceptStream(conn)
+	}
+}
+
+func (listener *quicListener) acceptStream(conn *quic.Conn) {
+	ctx, cancel := context.WithTimeout(conn.Context(), quicStreamTimeout)
+	defer cancel()
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		if listener.logger.debugging() {
+			listener.logger.Debug("QUIC connection opened no stream",
+				"at", "quicListener.acceptStream",
+				"remote", conn.RemoteAddr().String(),
+				"error", err,
+			)
+		}
+		conn.CloseWithError(0, "")
+		return
+	}
+	socket := &quicStream{Stream: stream, conn: conn}
+	select {
+	case listener.accepted <- newFramedConn(socket, peerRoute(socket), false, listener.logger):
+	case <-listener.closed:
+		conn.CloseWithError(0, "")
+	}
+}
+
+func (listener *quicListener) Accept() (TransportConn, error) {
+	select {
+	case conn := <-listener.accepted:
+		return conn, nil
+	case err := <-listener.failed:
+		listener.failed <- err
+		return nil, err
+	}
+}
+
+func (listener *quicListener) Close() error {
+	listener.closing.Do(func() {
+		close(listener.closed)
+	})
+	return listener.listener.Close()
+}
+
+func (listener *quicListener) Addr() net.Addr {
+	return listener.listener.Addr()
+}
@@ -0,0 +1,136 @@
+package imux
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A self signed certificate for localhost
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// Counts the transport sockets of a Client that went down
+type transportDownCounter struct {
+	NopObserver
+	down int32
+}
+
+func (observer *transportDownCounter) TransportDown(TransportEvent) {
+	atomic.AddInt32(&observer.down, 1)
+}
+
+func TestQUICMigration(t *testing.T) {
+	server_transport := &QUICTransport{
+		ListenAddress: "127.0.0.1:0",
+		TLSConfig:     &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}},
+	}
+	listener, err := server_transport.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, streams := NewStreamServer()
+	if err := server.StartTransport(context.Background(), listener); err != nil {
+		t.Fatal(err)
+	}
+	client_transport := &QUICTransport{
+		Address:        listener.Addr().String(),
+		TLSConfig:      &tls.Config{InsecureSkipVerify: true},
+		RebindInterval: time.Hour,
+	}
+	client := NewClient(map[string]int{"127.0.0.1": 1}, nil)
+	client.Transport = client_transport
+	observer := &transportDownCounter{}
+	client.Observer = observer
+	if err := client.Start(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		client.Shutdown(ctx)
+		server.Shutdown(ctx)
+	}()
+	select {
+	case <-client.imuxer.ready:
+	case <-time.After(loopbackTimeout):
+		t.Fatal("timed out waiting for a transport socket to negotiate")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), loopbackTimeout)
+	defer cancel()
+	conn, err := client.DialContext(ctx, "tcp", "quic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(loopbackTimeout))
+	stream, err := streams.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	go io.Copy(stream, stream)
+
+	payload := randomPayload(t, 64*1024)
+	go conn.Write(payload)
+	expectPayload(t, conn, payload)
+
+	client_transport.mux.Lock()
+	var quic_conn *quicConn
+	for watched := range client_transport.binds["127.0.0.1"].conns {
+		quic_conn = watched
+	}
+	client_transport.mux.Unlock()
+	// Pretend the bind used to have another address, so its current one
+	// looks new and the connection moves to a new UDP socket on it
+	quic_conn.mux.Lock()
+	quic_conn.address = net.ParseIP("127.0.0.2")
+	quic_conn.mux.Unlock()
+	migrated, err := quic_conn.migrate("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !migrated {
+		t.Fatal("expected the connection to migrate to the bind's new address")
+	}
+	quic_conn.mux.Lock()
+	sockets := len(quic_conn.transports)
+	moved_to := quic_conn.transports[sockets-1].Conn.LocalAddr().String()
+	quic_conn.mux.Unlock()
+	if sockets != 2 || moved_to == quic_conn.conn.LocalAddr().String() {
+		t.Fatalf("expected the connection to move to a new UDP socket, it is on %s", moved_to)
+	}
+
+	payload = randomPayload(t, 64*1024)
+	go conn.Write(payload)
+	expectPayload(t, conn, payload)
+	if down := atomic.LoadInt32(&observer.down); down != 0 {
+		t.Fatalf("expected the stream to move with its transport socket, %d transport sockets went down", down)
+	}
+}
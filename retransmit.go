@@ -0,0 +1,254 @@
+package imux
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of chunks a socket may send before the peer has advertised a
+// receive window for it.  Receivers always accept at least this many.
+const initialStreamCredit = 4
+
+// A retransmitBuffer holds every chunk read by a DataIMUX until the peer
+// acknowledges it, so chunks written into a transport socket that later
+// dies can be written again over the transport sockets that survive.  It
+// also tracks the credit each socket has been granted by the peer, the
+// highest sequence ID the peer's receive window will accept.  Reading
+// from a socket pauses while it has max unacknowledged chunks, and stops
+// once the socket is released while it is still being read from.
+type retransmitBuffer struct {
+	mux      sync.Mutex
+	space    *sync.Cond
+	sockets  map[string]map[uint64]*pendingChunk
+	credits  map[string]uint64
+	released map[string]bool
+	max      int
+	stopped  bool
+}
+
+// A chunk waiting for acknowledgement.  Queued chunks are waiting in a
+// DataIMUX chan to be written, otherwise the chunk was last written to
+// the transport socket with ID transport at sentAt.
+type pendingChunk struct {
+	chunk     Chunk
+	queued    bool
+	transport uint64
+	sentAt    time.Time
+}
+
+func newRetransmitBuffer(max int) *retransmitBuffer {
+	buffer := &retransmitBuffer{
+		sockets:  make(map[string]map[uint64]*pendingChunk),
+		credits:  make(map[string]uint64),
+		released: make(map[string]bool),
+		max:      max,
+	}
+	buffer.space = sync.NewCond(&buffer.mux)
+	return buffer
+}
+
+// Hold a newly read chunk, blocking while its socket already has the
+// maximum number of unacknowledged chunks.  Returns false without holding
+// the chunk if its socket was released or the buffer stopped while
+// waiting.
+func (buffer *retransmitBuffer) add(chunk Chunk) bool {
+	buffer.mux.Lock()
+	defer buffer.mux.Unlock()
+	for {
+		if buffer.stopped || buffer.released[chunk.SocketID] {
+			return false
+		}
+		pending, ok := buffer.sockets[chunk.SocketID]
+		if !ok {
+			pending = make(map[uint64]*pendingChunk)
+			buffer.sockets[chunk.SocketID] = pending
+		}
+		if len(pending) < buffer.max {
+			pending[chunk.SequenceID] = &pendingChunk{
+				chunk:  chunk,
+				queued: true,
+			}
+			return true
+		}
+		buffer.space.Wait()
+	}
+}
+
+// Record that a chunk is being written to a transport socket.  Returns
+// false if the chunk was acknowledged while it was queued and no longer
+// needs to be written.
+func (buffer *retransmitBuffer) sending(chunk Chunk, transport uint64) bool {
+	if chunk.SequenceID == 0 {
+		return true
+	}
+	buffer.mux.Lock()
+	defer buffer.mux.Unlock()
+	pending, ok := buffer.sockets[chunk.SocketID][chunk.SequenceID]
+	if !ok {
+		return false
+	}
+	pending.queued = false
+	pending.transport = transport
+	pending.sentAt = time.Now()
+	return true
+}
+
+// Drop a chunk that does not need to be acknowledged, such as one written
+// to a transport socket that did not negotiate acknowledgements
+func (buffer *retransmitBuffer) remove(socket_id string, sequence_id uint64) {
+	buffer.mux.Lock()
+	defer buffer.mux.Unlock()
+	buffer.drop(socket_id, sequence_id)
+}
+
+// Start tracking credit for a socket being read from
+func (buffer *retransmitBuffer) open(socket_id string) {
+	buffer.mux.Lock()
+	defer buffer.mux.Unlock()
+	buffer.credits[socket_id] = initialStreamCredit
+}
+
+// Stop tracking credit for a socket that is no longer being read from
+func (buffer *retransmitBuffer) close(socket_id string) {
+	buffer.mux.Lock()
+	defer buffer.mux.Unlock()
+	delete(buffer.credits, socket_id)
+	delete(buffer.released, socket_id)
+}
+
+// Block until the peer has granted enough credit for a socket to send the
+// chunk with a sequence ID.  Returns false if the socket was reset or the
+// buffer stopped while waiting and nothing more should be read from it.
+func (buffer *retransmitBuffer) awaitCredit(socket_id string, sequence_id uint64) bool {
+	buffer.mux.Lock()
+	defer buffer.mux.Unlock()
+	for {
+		credit, ok := buffer.credits[socket_id]
+		if !ok || buffer.stopped {
+			return false
+		}
+		if sequence_id <= credit {
+			return true
+		}
+		buffer.space.Wait()
+	}
+}
+
+// Drop all chunks covered by an Ack and extend the socket's credit to the
+// receive window it advertises
+func (buffer *retransmitBuffer) acknowledge(ack *Ack) {
+	buffer.mux.Lock()
+	defer buffer.mux.Unlock()
+	if credit, ok := buffer.credits[ack.SocketID]; ok && ack.Window > credit {
+		buffer.credits[ack.SocketID] = ack.Window
+		buffer.space.Broadcast()
+	}
+	pending, ok := buffer.sockets[ack.SocketID]
+	if !ok {
+		return
+	}
+	for sequence_id := range pending {
+		if sequence_id <= ack.Cumulative {
+			buffer.drop(ack.SocketID, sequence_id)
+		}
+	}
+	for _, sequence_id := range ack.Selective {
+		buffer.drop(ack.SocketID, sequence_id)
+	}
+}
+
+// Drop every chunk and all credit for a socket that has been reset,
+// refusing any more chunks read from it
+func (buffer *retransmitBuffer) release(socket_id string) {
+	buffer.mux.Lock()
+	defer buffer.mux.Unlock()
+	if _, reading := buffer.credits[socket_id]; reading {
+		buffer.released[socket_id] = true
+	}
+	delete(buffer.sockets, socket_id)
+	delete(buffer.credits, socket_id)
+	buffer.space.Broadcast()
+}
+
+// Wake every socket waiting on the buffer, failing their waits
+func (buffer *retransmitBuffer) stop() {
+	buffer.mux.Lock()
+	defer buffer.mux.Unlock()
+	buffer.stopped = true
+	buffer.space.Broadcast()
+}
+
+// Check if no chunk is waiting for acknowledgement and no socket is being
+// read from
+func (buffer *retransmitBuffer) idle() bool {
+	buffer.mux.Lock()
+	defer buffer.mux.Unlock()
+	return len(buffer.sockets) == 0 && len(buffer.credits) == 0
+}
+
+func (buffer *retransmitBuffer) drop(socket_id string, sequence_id uint64) {
+	pending, ok := buffer.sockets[socket_id]
+	if !ok {
+		return
+	}
+	if _, ok := pending[sequence_id]; !ok {
+		return
+	}
+	delete(pending, sequence_id)
+	if len(pending) == 0 {
+		delete(buffer.sockets, socket_id)
+	}
+	buffer.space.Broadcast()
+}
+
+// The transport sockets that last carried a socket's unacknowledged chunks
+// with sequence IDs from first to last
+func (buffer *retransmitBuffer) carriers(socket_id string, first, last uint64) map[uint64]bool {
+	buffer.mux.Lock()
+	defer buffer.mux.Unlock()
+	carriers := make(map[uint64]bool)
+	for sequence_id, pending := range buffer.sockets[socket_id] {
+		if sequence_id >= first && sequence_id <= last && !pending.queued {
+			carriers[pending.transport] = true
+		}
+	}
+	return carriers
+}
+
+// Return the unacknowledged chunks last written to a transport socket
+// that has died, marking them queued to be written again.  Chunks are
+// returned in sequence order so the chunks a write queue is waiting on
+// are written first.
+func (buffer *retransmitBuffer) failed(transport uint64) []Chunk {
+	return buffer.requeue(func(pending *pendingChunk) bool {
+		return pending.transport == transport
+	})
+}
+
+// Return the chunks that have gone unacknowledged for longer than the
+// timeout, marking them queued to be written again
+func (buffer *retransmitBuffer) expired(timeout time.Duration) []Chunk {
+	now := time.Now()
+	return buffer.requeue(func(pending *pendingChunk) bool {
+		return now.Sub(pending.sentAt) > timeout
+	})
+}
+
+func (buffer *retransmitBuffer) requeue(match func(*pendingChunk) bool) []Chunk {
+	buffer.mux.Lock()
+	defer buffer.mux.Unlock()
+	chunks := make([]Chunk, 0)
+	for _, pending := range buffer.sockets {
+		for _, entry := range pending {
+			if !entry.queued && match(entry) {
+				entry.queued = true
+				chunks = append(chunks, entry.chunk)
+			}
+		}
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].SequenceID < chunks[j].SequenceID
+	})
+	return chunks
+}
@@ -0,0 +1,117 @@
+package imux
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A transport socket that can be made to silently drop everything written
+// to it, like a route that stopped delivering
+type dyingConn struct {
+	net.Conn
+	swallowing int32
+	swallowed  int32
+}
+
+func (conn *dyingConn) Write(data []byte) (int, error) {
+	if atomic.LoadInt32(&conn.swallowing) == 1 {
+		atomic.AddInt32(&conn.swallowed, 1)
+		return len(data), nil
+	}
+	return conn.Conn.Write(data)
+}
+
+// Counts the chunks retransmitted by a Client
+type retransmitCounter struct {
+	NopObserver
+	retransmitted int32
+}
+
+func (observer *retransmitCounter) ChunkRetransmitted(ChunkEvent) {
+	atomic.AddInt32(&observer.retransmitted, 1)
+}
+
+func TestRetransmitAfterTransportDies(t *testing.T) {
+	options := DefaultOptions()
+	options.ChunkSize = 1024
+	options.RetransmitTimeout = time.Minute
+	pair := newLoopback(t, options, map[string]int{"127.0.0.1": 2})
+	var dying *dyingConn
+	var wrapping sync.Mutex
+	pair.wrap = func(conn net.Conn) net.Conn {
+		wrapping.Lock()
+		defer wrapping.Unlock()
+		if dying != nil {
+			return conn
+		}
+		dying = &dyingConn{Conn: conn}
+		return dying
+	}
+	observer := &retransmitCounter{}
+	pair.client.Observer = observer
+	pair.start(t)
+	pair.awaitTransports(t, 2)
+	conn := pair.dial(t)
+	stream := pair.accept(t)
+
+	wrapping.Lock()
+	atomic.StoreInt32(&dying.swallowing, 1)
+	wrapping.Unlock()
+	payload := randomPayload(t, 64*1024)
+	go conn.Write(payload)
+	deadline := time.Now().Add(loopbackTimeout)
+	for atomic.LoadInt32(&dying.swallowed) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a chunk to be lost")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	dying.Conn.Close()
+
+	expectPayload(t, stream, payload)
+	if atomic.LoadInt32(&observer.retransmitted) == 0 {
+		t.Fatal("expected chunks lost with the transport socket to be retransmitted")
+	}
+}
+
+func TestRetransmitBufferCredit(t *testing.T) {
+	buffer := newRetransmitBuffer(DefaultOptions().MaxUnacknowledgedChunks)
+	buffer.open("socket")
+	if !buffer.awaitCredit("socket", initialStreamCredit) {
+		t.Fatal("expected the initial credit to be granted before any ack")
+	}
+	granted := make(chan bool, 1)
+	go func() {
+		granted <- buffer.awaitCredit("socket", initialStreamCredit+1)
+	}()
+	select {
+	case <-granted:
+		t.Fatal("expected sending past the credit to wait for the window to open")
+	case <-time.After(20 * time.Millisecond):
+	}
+	buffer.acknowledge(&Ack{SocketID: "socket", Window: initialStreamCredit + 1})
+	select {
+	case ok := <-granted:
+		if !ok {
+			t.Fatal("expected the wider window to grant credit")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("credit was never granted")
+	}
+
+	go func() {
+		granted <- buffer.awaitCredit("socket", initialStreamCredit+2)
+	}()
+	buffer.release("socket")
+	select {
+	case ok := <-granted:
+		if ok {
+			t.Fatal("expected a released socket to stop waiting for credit")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("releasing the socket did not wake the sender")
+	}
+}
@@ -0,0 +1,271 @@
+package imux
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How long a socket accepted by a SOCKS5 Client may take to send its
+// request, and how long the Server may take to dial the address it names
+const socks5Timeout = 30 * time.Second
+
+// Returned when opening a stream to an address the Server will not dial
+var errNoDestinations = fmt.Errorf("imux: server does not dial addresses named by clients: %w", syscall.ECONNREFUSED)
+
+// Returned when an address is too long to carry in a ControlOpen
+var errDestinationTooLong = errors.New("imux: destination address too long")
+
+// The SOCKS5 protocol version, and the only command and authentication
+// method supported, CONNECT without authentication
+const (
+	socks5Version        byte = 5
+	socks5Connect        byte = 1
+	socks5NoAuth         byte = 0
+	socks5NoMethods      byte = 0xff
+	socks5AddressIPv4    byte = 1
+	socks5AddressDomain  byte = 3
+	socks5AddressIPv6    byte = 4
+	socks5Succeeded      byte = 0
+	socks5Failure        byte = 1
+	socks5Unreachable    byte = 4
+	socks5Refused        byte = 5
+	socks5BadCommand     byte = 7
+	socks5BadAddressType byte = 8
+)
+
+// A SOCKS5 request that could not be read, and the reply refusing it
+type socks5Error struct {
+	reply byte
+	err   error
+}
+
+func (err *socks5Error) Error() string {
+	return err.err.Error()
+}
+
+// Read the SOCKS5 handshake of an accepted socket and open a stream to the
+// address its CONNECT request names, replying once the Server has dialed
+// it or failed to
+func (client *Client) acceptSOCKS5(socket net.Conn) {
+	socket.SetDeadline(time.Now().Add(socks5Timeout))
+	destination, err := readSOCKS5Request(socket)
+	if err == nil && len(destination) > maxControlReason {
+		err = &socks5Error{reply: socks5BadAddressType, err: errDestinationTooLong}
+	}
+	if err != nil {
+		client.logger.Warn("refused SOCKS5 request",
+			"at", "Client.acceptSOCKS5",
+			"session_id", client.SessionID,
+			"error", err,
+		)
+		var request_err *socks5Error
+		if errors.As(err, &request_err) {
+			writeSOCKS5Reply(socket, request_err.reply)
+		}
+		socket.Close()
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), socks5Timeout)
+	defer cancel()
+	if err := client.awaitDestinations(ctx); err != nil {
+		client.logger.Warn("refused SOCKS5 request",
+			"at", "Client.acceptSOCKS5",
+			"session_id", client.SessionID,
+			"destination", destination,
+			"error", err,
+		)
+		writeSOCKS5Reply(socket, socks5Reply(err))
+		socket.Close()
+		return
+	}
+
+	socket_id := uuid.NewV4().String()
+	if client.logger.debugging() {
+		client.logger.Debug("accepted new SOCKS5 connection to imux",
+			"at", "Client.acceptSOCKS5",
+			"session_id", client.SessionID,
+			"socket_id", socket_id,
+			"destination", destination,
+		)
+	}
+	opened := client.expectOpen(socket_id)
+	replying := newSOCKS5Conn(socket)
+	client.open(socket_id, replying, destination)
+	select {
+	case err = <-opened:
+	case <-ctx.Done():
+		client.opened(socket_id, nil)
+		err = ctx.Err()
+		client.imuxer.resetStream(socket_id, err)
+	case <-client.lifecycle.done:
+		err = ErrShutdown
+	}
+	replying.reply(err)
+}
+
+// Read a SOCKS5 greeting and CONNECT request, returning the host and port
+// it names.  Requests that cannot be served return a *socks5Error with the
+// reply refusing them.
+func readSOCKS5Request(socket net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(socket, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(socket, methods); err != nil {
+		return "", err
+	}
+	method := socks5NoMethods
+	for _, offered := range methods {
+		if offered == socks5NoAuth {
+			method = socks5NoAuth
+		}
+	}
+	if _, err := socket.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == socks5NoMethods {
+		return "", errors.New("SOCKS5 client requires authentication")
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(socket, request); err != nil {
+		return "", err
+	}
+	if request[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", request[0])
+	}
+	if request[1] != socks5Connect {
+		return "", &socks5Error{reply: socks5BadCommand, err: fmt.Errorf("unsupported SOCKS5 command %d", request[1])}
+	}
+	var host string
+	switch request[3] {
+	case socks5AddressIPv4, socks5AddressIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socks5AddressIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(socket, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AddressDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(socket, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(socket, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", &socks5Error{reply: socks5BadAddressType, err: fmt.Errorf("unsupported SOCKS5 address type %d", request[3])}
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(socket, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// Write a SOCKS5 reply without a bound address
+func writeSOCKS5Reply(socket net.Conn, reply byte) error {
+	_, err := socket.Write([]byte{socks5Version, reply, 0, socks5AddressIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// The SOCKS5 reply for the error a stream failed to open with
+func socks5Reply(err error) byte {
+	if err == nil {
+		return socks5Succeeded
+	}
+	switch resetCode(err) {
+	case ResetRefused:
+		return socks5Refused
+	case ResetUnreachable, ResetTimeout:
+		return socks5Unreachable
+	}
+	return socks5Failure
+}
+
+// A socket accepted by a SOCKS5 Client whose stream waits until the reply
+// to its request has been written, so no stream data is mixed into the
+// handshake.  Once the reply refuses the stream, reading and writing fail
+// with the error it was refused for.
+type socks5Conn struct {
+	net.Conn
+	replied  chan struct{}
+	replying sync.Once
+	err      error
+}
+
+func newSOCKS5Conn(socket net.Conn) *socks5Conn {
+	return &socks5Conn{
+		Conn:    socket,
+		replied: make(chan struct{}),
+	}
+}
+
+// Reply to the request with the error the stream failed to open with, or
+// success if nil, then let the stream through
+func (conn *socks5Conn) reply(err error) {
+	conn.replying.Do(func() {
+		conn.Conn.SetDeadline(time.Now().Add(socks5Timeout))
+		write_err := writeSOCKS5Reply(conn.Conn, socks5Reply(err))
+		if err == nil {
+			err = write_err
+		}
+		conn.Conn.SetDeadline(time.Time{})
+		conn.err = err
+		close(conn.replied)
+		if err != nil {
+			conn.Conn.Close()
+		}
+	})
+}
+
+func (conn *socks5Conn) Read(data []byte) (int, error) {
+	<-conn.replied
+	if conn.err != nil {
+		return 0, conn.err
+	}
+	return conn.Conn.Read(data)
+}
+
+func (conn *socks5Conn) Write(data []byte) (int, error) {
+	<-conn.replied
+	if conn.err != nil {
+		return 0, conn.err
+	}
+	return conn.Conn.Write(data)
+}
+
+// Shut down the write side of the socket once the reply has been written,
+// closing it if it cannot be half-closed
+func (conn *socks5Conn) CloseWrite() error {
+	<-conn.replied
+	if closer, ok := conn.Conn.(halfCloser); ok {
+		return closer.CloseWrite()
+	}
+	return conn.Conn.Close()
+}
+
+// Close the socket once the reply has been written, so a stream refused
+// by the Server still gets its reply
+func (conn *socks5Conn) Close() error {
+	<-conn.replied
+	return conn.Conn.Close()
+}
@@ -0,0 +1,202 @@
+package imux
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Write a SOCKS5 greeting and request to one end of a pipe and read the
+// request from the other, returning the address read and the bytes
+// written back to the client
+func readRequest(t *testing.T, request []byte) (string, []byte, error) {
+	t.Helper()
+	local, remote := net.Pipe()
+	replies := make(chan []byte, 1)
+	go func() {
+		defer remote.Close()
+		remote.Write([]byte{socks5Version, 1, socks5NoAuth})
+		method := make([]byte, 2)
+		if _, err := io.ReadFull(remote, method); err != nil {
+			replies <- nil
+			return
+		}
+		remote.Write(request)
+		replies <- method
+	}()
+	remote.SetDeadline(time.Now().Add(time.Second))
+	local.SetDeadline(time.Now().Add(time.Second))
+	destination, err := readSOCKS5Request(local)
+	// Release the rest of a request that was refused before it was read
+	local.Close()
+	return destination, <-replies, err
+}
+
+func TestReadSOCKS5Request(t *testing.T) {
+	requests := map[string][]byte{
+		"example.com:443": {socks5Version, socks5Connect, 0, socks5AddressDomain, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 1, 187},
+		"10.0.0.1:80":     {socks5Version, socks5Connect, 0, socks5AddressIPv4, 10, 0, 0, 1, 0, 80},
+		"[::1]:8080":      {socks5Version, socks5Connect, 0, socks5AddressIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1f, 0x90},
+	}
+	for expected, request := range requests {
+		destination, method, err := readRequest(t, request)
+		if err != nil {
+			t.Fatalf("reading request for %s: %v", expected, err)
+		}
+		if method[1] != socks5NoAuth {
+			t.Fatalf("expected no authentication to be chosen, chose %d", method[1])
+		}
+		if destination != expected {
+			t.Fatalf("expected %s, read %s", expected, destination)
+		}
+	}
+}
+
+func TestReadSOCKS5RequestRefused(t *testing.T) {
+	requests := map[byte][]byte{
+		socks5BadCommand:     {socks5Version, 2, 0, socks5AddressIPv4, 10, 0, 0, 1, 0, 80},
+		socks5BadAddressType: {socks5Version, socks5Connect, 0, 9},
+	}
+	for reply, request := range requests {
+		_, _, err := readRequest(t, request)
+		var request_err *socks5Error
+		if !errors.As(err, &request_err) || request_err.reply != reply {
+			t.Fatalf("expected the request to be refused with reply %d, got %v", reply, err)
+		}
+	}
+}
+
+func TestSOCKS5Reply(t *testing.T) {
+	replies := map[error]byte{
+		nil:                                  socks5Succeeded,
+		syscall.ECONNREFUSED:                 socks5Refused,
+		&StreamError{Code: ResetUnreachable}: socks5Unreachable,
+		&StreamError{Code: ResetTimeout}:     socks5Unreachable,
+		errors.New("unknown"):                socks5Failure,
+	}
+	for err, expected := range replies {
+		if reply := socks5Reply(err); reply != expected {
+			t.Fatalf("expected %v to be replied to with %d, replied with %d", err, expected, reply)
+		}
+	}
+}
+
+// Start a SOCKS5 Client whose Server dials addresses with dial, shut down
+// when the test finishes, returning the address the Client listens on
+func startSOCKS5(t *testing.T, dial func(string) (net.Conn, error)) string {
+	t.Helper()
+	server_listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServerWithOptions(func() (net.Conn, error) {
+		return nil, syscall.ECONNREFUSED
+	}, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.DialAddress = dial
+	if err := server.Start(context.Background(), server_listener); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+
+	client_listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClientWithOptions(map[string]int{"127.0.0.1": 1}, func(string) Redialer {
+		return func() (net.Conn, error) {
+			return net.Dial("tcp", server_listener.Addr().String())
+		}
+	}, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SOCKS5 = true
+	if err := client.Start(context.Background(), client_listener); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		client.Shutdown(ctx)
+	})
+	return client_listener.Addr().String()
+}
+
+// Connect to a SOCKS5 Client and request a domain, returning the socket
+// and the reply to the request
+func connectSOCKS5(t *testing.T, address, domain string, port int) (net.Conn, byte) {
+	t.Helper()
+	socket, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { socket.Close() })
+	socket.SetDeadline(time.Now().Add(2 * time.Second))
+	request := []byte{socks5Version, 1, socks5NoAuth, socks5Version, socks5Connect, 0, socks5AddressDomain, byte(len(domain))}
+	request = append(request, domain...)
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := socket.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	replies := make([]byte, 12)
+	if _, err := io.ReadFull(socket, replies); err != nil {
+		t.Fatalf("expected a method and a reply, read %v", err)
+	}
+	return socket, replies[3]
+}
+
+func TestSOCKS5ClientConnect(t *testing.T) {
+	dialed := make(chan string, 1)
+	address := startSOCKS5(t, func(address string) (net.Conn, error) {
+		dialed <- address
+		local, remote := net.Pipe()
+		go func() {
+			defer remote.Close()
+			line, err := bufio.NewReader(remote).ReadString('\n')
+			if err == nil {
+				fmt.Fprintf(remote, "echo %s", line)
+			}
+		}()
+		return local, nil
+	})
+	socket, reply := connectSOCKS5(t, address, "destination.example", 443)
+	if reply != socks5Succeeded {
+		t.Fatalf("expected the request to succeed, replied %d", reply)
+	}
+	if destination := <-dialed; destination != "destination.example:443" {
+		t.Fatalf("expected the server to dial destination.example:443, dialed %s", destination)
+	}
+	if _, err := io.WriteString(socket, "through the stream\n"); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(socket).ReadString('\n')
+	if err != nil || line != "echo through the stream\n" {
+		t.Fatalf("expected the destination to echo the line, read %q, %v", line, err)
+	}
+}
+
+func TestSOCKS5ClientConnectRefused(t *testing.T) {
+	address := startSOCKS5(t, func(string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	})
+	socket, reply := connectSOCKS5(t, address, "refused.example", 80)
+	if reply != socks5Refused {
+		t.Fatalf("expected the request to be refused, replied %d", reply)
+	}
+	if _, err := socket.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the refused socket to be closed, read %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+package imux
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Most bytes written to one end of a stream pipe that are held until the
+// other end reads them, after which writes block
+const streamPipeSize = 64 << 10
+
+// The address of one end of a stream pipe
+type streamAddr string
+
+func (addr streamAddr) Network() string {
+	return "imux"
+}
+
+func (addr streamAddr) String() string {
+	return string(addr)
+}
+
+// One direction of a stream pipe, holding bytes written by one end until
+// the other end reads them.  WriteClosed is set once the writing end will
+// write no more, and readClosed once the reading end will read no more.
+// Changed is closed and replaced whenever anything changes.
+type pipeBuffer struct {
+	mux         sync.Mutex
+	data        []byte
+	changed     chan struct{}
+	writeClosed bool
+	readClosed  bool
+}
+
+func newPipeBuffer() *pipeBuffer {
+	return &pipeBuffer{
+		changed: make(chan struct{}),
+	}
+}
+
+// Wake everything waiting on the buffer.  Must be called holding mux.
+func (buffer *pipeBuffer) notify() {
+	close(buffer.changed)
+	buffer.changed = make(chan struct{})
+}
+
+// Read buffered bytes, blocking until there are some, the writing end
+// closes, or expired is closed
+func (buffer *pipeBuffer) read(data []byte, expired chan struct{}) (int, error) {
+	for {
+		select {
+		case <-expired:
+			return 0, os.ErrDeadlineExceeded
+		default:
+		}
+		buffer.mux.Lock()
+		if buffer.readClosed {
+			buffer.mux.Unlock()
+			return 0, net.ErrClosed
+		}
+		if len(buffer.data) > 0 || len(data) == 0 {
+			read := copy(data, buffer.data)
+			buffer.data = buffer.data[read:]
+			buffer.notify()
+			buffer.mux.Unlock()
+			return read, nil
+		}
+		if buffer.writeClosed {
+			buffer.mux.Unlock()
+			return 0, io.EOF
+		}
+		changed := buffer.changed
+		buffer.mux.Unlock()
+		select {
+		case <-changed:
+		case <-expired:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Buffer bytes for the reading end, blocking while the buffer is full
+// until the reading end catches up, either end closes, or expired is
+// closed
+func (buffer *pipeBuffer) write(data []byte, expired chan struct{}) (int, error) {
+	written := 0
+	for {
+		select {
+		case <-expired:
+			return written, os.ErrDeadlineExceeded
+		default:
+		}
+		buffer.mux.Lock()
+		if buffer.writeClosed || buffer.readClosed {
+			buffer.mux.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if written == len(data) {
+			buffer.mux.Unlock()
+			return written, nil
+		}
+		if space := streamPipeSize - len(buffer.data); space > 0 {
+			chunk := data[written:]
+			if len(chunk) > space {
+				chunk = chunk[:space]
+			}
+			buffer.data = append(buffer.data, chunk...)
+			written += len(chunk)
+			buffer.notify()
+			buffer.mux.Unlock()
+			continue
+		}
+		changed := buffer.changed
+		buffer.mux.Unlock()
+		select {
+		case <-changed:
+		case <-expired:
+			return written, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Mark the writing end finished, so the reading end reaches EOF once it
+// has read what is buffered
+func (buffer *pipeBuffer) closeWrite() {
+	buffer.mux.Lock()
+	defer buffer.mux.Unlock()
+	buffer.writeClosed = true
+	buffer.notify()
+}
+
+// Mark the reading end finished, dropping what is buffered and failing
+// writes
+func (buffer *pipeBuffer) closeRead() {
+	buffer.mux.Lock()
+	defer buffer.mux.Unlock()
+	buffer.readClosed = true
+	buffer.data = nil
+	buffer.notify()
+}
+
+// A read or write deadline for one end of a stream pipe.  Expired is
+// closed once the deadline passes, and replaced when the deadline is
+// moved into the future.
+type pipeDeadline struct {
+	mux     sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func newPipeDeadline() *pipeDeadline {
+	return &pipeDeadline{
+		expired: make(chan struct{}),
+	}
+}
+
+// Move the deadline, or clear it with the zero time
+func (deadline *pipeDeadline) set(at time.Time) {
+	deadline.mux.Lock()
+	defer deadline.mux.Unlock()
+	if deadline.timer != nil && !deadline.timer.Stop() {
+		// The timer already fired, wait for it to close expired
+		<-deadline.expired
+	}
+	deadline.timer = nil
+	closed := false
+	select {
+	case <-deadline.expired:
+		closed = true
+	default:
+	}
+	if at.IsZero() {
+		if closed {
+			deadline.expired = make(chan struct{})
+		}
+		return
+	}
+	wait := time.Until(at)
+	if wait <= 0 {
+		if !closed {
+			close(deadline.expired)
+		}
+		return
+	}
+	if closed {
+		deadline.expired = make(chan struct{})
+	}
+	expired := deadline.expired
+	deadline.timer = time.AfterFunc(wait, func() {
+		close(expired)
+	})
+}
+
+// The chan closed once the deadline passes
+func (deadline *pipeDeadline) wait() chan struct{} {
+	deadline.mux.Lock()
+	defer deadline.mux.Unlock()
+	return deadline.expired
+}
+
+// One end of an in-memory stream pipe, a net.Conn that reads what the
+// other end writes.  Unlike net.Pipe, writes are buffered up to
+// streamPipeSize and each direction can be closed on its own with
+// CloseWrite.
+type streamConn struct {
+	incoming      *pipeBuffer
+	outgoing      *pipeBuffer
+	readDeadline  *pipeDeadline
+	writeDeadline *pipeDeadline
+	local         net.Addr
+	remote        net.Addr
+	mux           sync.Mutex
+	closed        bool
+}
+
+// Create both ends of a stream pipe, the first with address local and the
+// second with address remote
+func newStreamPipe(local, remote net.Addr) (*streamConn, *streamConn) {
+	forward := newPipeBuffer()
+	backward := newPipeBuffer()
+	local_end := &streamConn{
+		incoming:      backward,
+		outgoing:      forward,
+		readDeadline:  newPipeDeadline(),
+		writeDeadline: newPipeDeadline(),
+		local:         local,
+		remote:        remote,
+	}
+	remote_end := &streamConn{
+		incoming:      forward,
+		outgoing:      backward,
+		readDeadline:  newPipeDeadline(),
+		writeDeadline: newPipeDeadline(),
+		local:         remote,
+		remote:        local,
+	}
+	return local_end, remote_end
+}
+
+func (conn *streamConn) isClosed() bool {
+	conn.mux.Lock()
+	defer conn.mux.Unlock()
+	return conn.closed
+}
+
+func (conn *streamConn) Read(data []byte) (int, error) {
+	read, err := conn.incoming.read(data, conn.readDeadline.wait())
+	if err != nil && err != io.EOF && conn.isClosed() {
+		err = net.ErrClosed
+	}
+	return read, err
+}
+
+func (conn *streamConn) Write(data []byte) (int, error) {
+	written, err := conn.outgoing.write(data, conn.writeDeadline.wait())
+	if err != nil && conn.isClosed() {
+		err = net.ErrClosed
+	}
+	return written, err
+}
+
+// Close both directions, so the other end reads EOF and its writes fail
+func (conn *streamConn) Close() error {
+	conn.mux.Lock()
+	if conn.closed {
+		conn.mux.Unlock()
+		return net.ErrClosed
+	}
+	conn.closed = true
+	conn.mux.Unlock()
+	conn.outgoing.closeWrite()
+	conn.incoming.closeRead()
+	return nil
+}
+
+// Finish writing, so the other end reads EOF once it has read what was
+// written, while reading continues
+func (conn *streamConn) CloseWrite() error {
+	if conn.isClosed() {
+		return net.ErrClosed
+	}
+	conn.outgoing.closeWrite()
+	return nil
+}
+
+func (conn *streamConn) LocalAddr() net.Addr {
+	return conn.local
+}
+
+func (conn *streamConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+func (conn *streamConn) SetDeadline(at time.Time) error {
+	conn.readDeadline.set(at)
+	conn.writeDeadline.set(at)
+	return nil
+}
+
+func (conn *streamConn) SetReadDeadline(at time.Time) error {
+	conn.readDeadline.set(at)
+	return nil
+}
+
+func (conn *streamConn) SetWriteDeadline(at time.Time) error {
+	conn.writeDeadline.set(at)
+	return nil
+}
@@ -0,0 +1,96 @@
+package imux
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// A net.Listener whose Accept returns each stream opened on a Server as a
+// net.Conn, in place of the Server dialing a destination for it.  The
+// local address of each stream is its socket ID and the remote address is
+// the session of the Client that opened it.  Closing the StreamListener
+// refuses new streams while the streams already accepted and the Server
+// keep running until the Server is shut down.
+type StreamListener struct {
+	streams chan net.Conn
+	closed  chan struct{}
+	closing sync.Once
+	mux     sync.Mutex
+}
+
+// Create a Server that passes its streams to a StreamListener instead of
+// dialing a destination for each
+func NewStreamServer() (*Server, *StreamListener) {
+	server, stream_listener, _ := NewStreamServerWithOptions(DefaultOptions())
+	return server, stream_listener
+}
+
+// Create a Server like NewStreamServer, tuned by options.  The
+// StreamListener holds up to options.StreamBacklog streams until they are
+// accepted, after which new streams are refused.  Returns an error
+// wrapping ErrInvalidOptions if options are not valid.
+func NewStreamServerWithOptions(options Options) (*Server, *StreamListener, error) {
+	if err := options.Validate(); err != nil {
+		return nil, nil, err
+	}
+	stream_listener := &StreamListener{
+		streams: make(chan net.Conn, options.StreamBacklog),
+		closed:  make(chan struct{}),
+	}
+	return newServer(stream_listener.dial, &options), stream_listener, nil
+}
+
+// Open a stream, queueing one end of it to be accepted and returning the
+// other for the Server
+func (stream_listener *StreamListener) dial(session_id, socket_id string) (net.Conn, error) {
+	accepted, destination := newStreamPipe(streamAddr(socket_id), streamAddr(session_id))
+	stream_listener.mux.Lock()
+	defer stream_listener.mux.Unlock()
+	select {
+	case <-stream_listener.closed:
+		return nil, fmt.Errorf("stream listener closed: %w", syscall.ECONNREFUSED)
+	default:
+	}
+	select {
+	case stream_listener.streams <- accepted:
+		return destination, nil
+	default:
+		return nil, fmt.Errorf("stream listener backlog full: %w", syscall.ECONNREFUSED)
+	}
+}
+
+// Wait for the next stream
+func (stream_listener *StreamListener) Accept() (net.Conn, error) {
+	select {
+	case stream := <-stream_listener.streams:
+		return stream, nil
+	case <-stream_listener.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Stop accepting streams, closing streams that were waiting to be accepted
+func (stream_listener *StreamListener) Close() error {
+	err := net.ErrClosed
+	stream_listener.closing.Do(func() {
+		err = nil
+		stream_listener.mux.Lock()
+		close(stream_listener.closed)
+		stream_listener.mux.Unlock()
+		for {
+			select {
+			case stream := <-stream_listener.streams:
+				stream.Close()
+			default:
+				return
+			}
+		}
+	})
+	return err
+}
+
+func (stream_listener *StreamListener) Addr() net.Addr {
+	return streamAddr("imux")
+}
@@ -0,0 +1,63 @@
+package imux
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStreamPipeReadDeadline(t *testing.T) {
+	local, remote := newStreamPipe(streamAddr("local"), streamAddr("remote"))
+	defer local.Close()
+	defer remote.Close()
+
+	local.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := local.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a read past the deadline to fail with os.ErrDeadlineExceeded, got %v", err)
+	}
+	local.SetReadDeadline(time.Time{})
+	go remote.Write([]byte("late"))
+	received := make([]byte, 4)
+	if _, err := io.ReadFull(local, received); err != nil || string(received) != "late" {
+		t.Fatalf("expected reads to resume once the deadline was cleared, read %q, %v", received, err)
+	}
+}
+
+func TestStreamPipeWriteDeadline(t *testing.T) {
+	local, remote := newStreamPipe(streamAddr("local"), streamAddr("remote"))
+	defer local.Close()
+	defer remote.Close()
+
+	local.SetDeadline(time.Now().Add(20 * time.Millisecond))
+	written, err := local.Write(make([]byte, streamPipeSize+1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) || written != streamPipeSize {
+		t.Fatalf("expected the write to fill the pipe then time out, wrote %d, %v", written, err)
+	}
+}
+
+func TestStreamPipeCloseWrite(t *testing.T) {
+	local, remote := newStreamPipe(streamAddr("local"), streamAddr("remote"))
+	defer local.Close()
+	defer remote.Close()
+
+	local.Write([]byte("request"))
+	if err := local.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := local.Write([]byte("more")); err == nil {
+		t.Fatal("expected writing after CloseWrite to fail")
+	}
+	request, err := io.ReadAll(remote)
+	if err != nil || string(request) != "request" {
+		t.Fatalf("expected the other end to read the request then EOF, read %q, %v", request, err)
+	}
+
+	remote.Write([]byte("response"))
+	remote.Close()
+	response, err := io.ReadAll(local)
+	if err != nil || string(response) != "response" {
+		t.Fatalf("expected to keep reading after CloseWrite, read %q, %v", response, err)
+	}
+}
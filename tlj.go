@@ -1,27 +1,132 @@
 package imux
 
 import (
-	log "github.com/Sirupsen/logrus"
 	"github.com/hkparker/TLJ"
 	"net"
 	"reflect"
+	"sync"
 )
 
-// Tag all TLJ sockets as "all"
-func tag_socket(socket net.Conn, server *tlj.Server) {
-	log.WithFields(log.Fields{
-		"at": "tag_socket",
-	}).Debug("accepted new socket")
-	server.TagSocket(socket, "all")
+// Create a TLJ tag function that tags all sockets as "all"
+func tag_socket(logger *logger) func(net.Conn, *tlj.Server) {
+	return func(socket net.Conn, server *tlj.Server) {
+		if logger.debugging() {
+			logger.Debug("accepted new socket", "at", "tag_socket")
+		}
+		server.TagSocket(socket, "all")
+	}
 }
 
 // Create a TLJ type store for only chunks
-func type_store() tlj.TypeStore {
+func type_store(logger *logger) tlj.TypeStore {
 	type_store := tlj.NewTypeStore()
 	type_store.AddType(
 		reflect.TypeOf(Chunk{}),
 		reflect.TypeOf(&Chunk{}),
-		buildChunk,
+		buildChunk(logger),
 	)
 	return type_store
 }
+
+// Writes chunks to transport sockets that did not negotiate binary framing
+type tljChunkWriter struct {
+	writer       tlj.StreamWriter
+	maxChunkSize int
+}
+
+func newTLJChunkWriter(socket net.Conn, max_chunk_size int, logger *logger) (chunkWriter, error) {
+	writer, err := tlj.NewStreamWriter(socket, type_store(logger), reflect.TypeOf(Chunk{}))
+	if err != nil {
+		return nil, err
+	}
+	return &tljChunkWriter{writer: writer, maxChunkSize: max_chunk_size}, nil
+}
+
+// Compression and parity are only negotiated with binary framing, so
+// compressed chunks are decompressed before being written and parity
+// chunks are dropped
+func (writer *tljChunkWriter) WriteChunk(chunk Chunk) error {
+	if chunk.Parity {
+		return nil
+	}
+	if chunk.Compression != CompressionNone {
+		data, err := decompressData(chunk.Compression, chunk.Data, writer.maxChunkSize)
+		if err != nil {
+			return err
+		}
+		chunk.Data = data
+		chunk.Compression = CompressionNone
+	}
+	return writer.writer.Write(chunk)
+}
+
+// Acknowledgements are only negotiated with binary framing
+func (writer *tljChunkWriter) WriteAck(_ Ack) error {
+	return errUnsupportedFrame
+}
+
+// Control messages are only negotiated with binary framing
+func (writer *tljChunkWriter) WriteControl(_ Control) error {
+	return errUnsupportedFrame
+}
+
+// Heartbeats are only negotiated with binary framing
+func (writer *tljChunkWriter) WritePing(_ uint64) error {
+	return errUnsupportedFrame
+}
+
+func (writer *tljChunkWriter) WritePong(_ uint64) error {
+	return errUnsupportedFrame
+}
+
+// Reads chunks from a transport socket that did not negotiate binary
+// framing.  Each socket is served by a TLJ server of its own, which passes
+// chunks to ReadFrame until the socket fails.
+type tljChunkReader struct {
+	chunks chan *Chunk
+	failed chan struct{}
+}
+
+func newTLJChunkReader(socket net.Conn, logger *logger) chunkReader {
+	reader := &tljChunkReader{
+		chunks: make(chan *Chunk),
+		failed: make(chan struct{}),
+	}
+	tlj_server := tlj.Server{
+		TypeStore:       type_store(logger),
+		Tag:             tag_socket(logger),
+		Tags:            make(map[net.Conn][]string),
+		Sockets:         make(map[string][]net.Conn),
+		Events:          make(map[string]map[uint16][]func(interface{}, tlj.TLJContext)),
+		Requests:        make(map[string]map[uint16][]func(interface{}, tlj.TLJContext)),
+		FailedServer:    make(chan error, 1),
+		FailedSockets:   make(chan net.Conn, 1),
+		TagManipulation: &sync.Mutex{},
+		InsertRequests:  &sync.Mutex{},
+		InsertEvents:    &sync.Mutex{},
+	}
+	tlj_server.Accept("all", reflect.TypeOf(Chunk{}), func(iface interface{}, _ tlj.TLJContext) {
+		if chunk, ok := iface.(*Chunk); ok {
+			select {
+			case reader.chunks <- chunk:
+			case <-reader.failed:
+			}
+		}
+	})
+	go func() {
+		<-tlj_server.FailedSockets
+		close(reader.failed)
+	}()
+	tlj_server.Insert(socket)
+	return reader
+}
+
+// Wait for the next chunk, failing once TLJ stops reading the socket
+func (reader *tljChunkReader) ReadFrame() (interface{}, error) {
+	select {
+	case chunk := <-reader.chunks:
+		return chunk, nil
+	case <-reader.failed:
+		return nil, errTransportClosed
+	}
+}
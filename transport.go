@@ -0,0 +1,64 @@
+package imux
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// A Transport carries frames between Clients and Servers.  Clients dial a
+// TransportConn for each of their transport sockets from a bind address,
+// and Servers accept them from a TransportListener.  ConnTransport carries
+// frames over net.Conns such as TLS connections.
+type Transport interface {
+	// Dial a connection to the Server from a bind address, giving up once
+	// ctx is done
+	Dial(ctx context.Context, bind string) (TransportConn, error)
+	// Listen for connections dialed by Clients
+	Listen() (TransportListener, error)
+}
+
+// Accepts the TransportConns dialed by Clients
+type TransportListener interface {
+	Accept() (TransportConn, error)
+	Close() error
+	Addr() net.Addr
+}
+
+// A TransportConn carries the frames of one transport socket.  Negotiate
+// is called once before any frames are written or read.  After that
+// frames may be written from many goroutines at once while one goroutine
+// reads them, and writing a frame that was not negotiated fails.  Close
+// unblocks any read or write in progress.
+type TransportConn interface {
+	// Exchange hellos with the peer, returning the peer's hello with the
+	// features both sides support.  A dialed connection sends local and
+	// waits for the answer, while an accepted connection reads the
+	// peer's hello and answers with local, or rejects it with a
+	// HandshakeError.  Peers that predate the handshake are returned as
+	// an empty hello, without a session or any features.  The exchange
+	// must finish within timeout, which accepted connections only start
+	// once the peer's hello begins.
+	Negotiate(local Hello, timeout time.Duration) (Hello, error)
+	WriteChunk(chunk Chunk) error
+	WriteAck(ack Ack) error
+	WriteControl(control Control) error
+	WritePing(nonce uint64) error
+	WritePong(nonce uint64) error
+	// Read the next frame, a *Chunk, an *Ack, a *Control or a *Heartbeat
+	ReadFrame() (interface{}, error)
+	// The bind the connection was dialed from, or the address of the
+	// peer it was accepted from
+	Route() string
+	Stats() TransportStats
+	Close() error
+}
+
+// What a TransportConn has carried so far, counting bytes as they were
+// written to or read from the underlying connection
+type TransportStats struct {
+	FramesSent     uint64
+	FramesReceived uint64
+	BytesSent      uint64
+	BytesReceived  uint64
+}
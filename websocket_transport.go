@@ -0,0 +1,274 @@
+package imux
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/coder/websocket"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Default WebSocketTransport.Path
+const defaultWebSocketPath = "/imux"
+
+// Returned by a WebSocketTransport that has no URL when dialing
+var errNoWebSocketURL = errors.New("imux: WebSocket transport has no URL")
+
+// A Transport over WebSockets, for networks that only let HTTP through.
+// Each transport socket is a WebSocket connection of its own carrying
+// frames as binary messages, so imux can sit behind a reverse proxy.
+// Clients dial URL from each bind, over TLS for wss URLs.  Servers accept
+// upgrades on Path from Listener, while connections to Listener that do
+// not start with an HTTP request are carried like a ConnTransport's, so
+// Clients of either transport can share one port.
+type WebSocketTransport struct {
+	// The ws or wss URL of the Server that Clients dial
+	URL string
+	// Headers added to each upgrade request, such as credentials for a
+	// reverse proxy
+	Header http.Header
+	// TLS settings for wss URLs
+	TLSConfig *tls.Config
+	// Dials the connections upgrade requests are sent over from each
+	// bind, before any TLS.  Nil dials the host of URL from each bind.
+	Redialers RedialerGenerator
+	// The path Servers accept upgrades on.  Empty accepts them on /imux.
+	Path string
+	// Where Servers accept connections
+	Listener net.Listener
+	// How long a connection may take to send the headers of its upgrade
+	// request.  Zero uses the default HandshakeTimeout option.
+	HandshakeTimeout time.Duration
+	// Where connections log, set before the transport is used.  Nil uses
+	// slog's default logger.
+	Logger *slog.Logger
+}
+
+func (transport *WebSocketTransport) Dial(ctx context.Context, bind string) (TransportConn, error) {
+	if transport.URL == "" {
+		return nil, errNoWebSocketURL
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:     transport.dialer(bind),
+			TLSClientConfig: transport.TLSConfig,
+		},
+	}
+	conn, _, err := websocket.Dial(ctx, transport.URL, &websocket.DialOptions{
+		HTTPClient: client,
+		HTTPHeader: transport.Header,
+	})
+	if err != nil {
+		return nil, err
+	}
+	socket := websocket.NetConn(context.Background(), conn, websocket.MessageBinary)
+	return newFramedConn(socket, bind, true, newLogger(transport.Logger)), nil
+}
+
+// Create a function dialing the host of an upgrade request from a bind
+func (transport *WebSocketTransport) dialer(bind string) func(context.Context, string, string) (net.Conn, error) {
+	if transport.Redialers != nil {
+		redialer := transport.Redialers(bind)
+		return func(context.Context, string, string) (net.Conn, error) {
+			return redialer()
+		}
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		bind_addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(bind, "0"))
+		if err != nil {
+			return nil, err
+		}
+		dialer := &net.Dialer{LocalAddr: bind_addr}
+		return dialer.DialContext(ctx, network, address)
+	}
+}
+
+func (transport *WebSocketTransport) Listen() (TransportListener, error) {
+	if transport.Listener == nil {
+		return nil, errNoListener
+	}
+	path := transport.Path
+	if path == "" {
+		path = defaultWebSocketPath
+	}
+	timeout := transport.HandshakeTimeout
+	if timeout == 0 {
+		timeout = DefaultOptions().HandshakeTimeout
+	}
+	listener := &webSocketListener{
+		listener: transport.Listener,
+		accepted: make(chan TransportConn),
+		requests: make(chan net.Conn),
+		failed:   make(chan error, 1),
+		closed:   make(chan struct{}),
+		logger:   newLogger(transport.Logger),
+	}
+	handlers := http.NewServeMux()
+	handlers.HandleFunc(path, listener.upgrade)
+	listener.server = &http.Server{
+		Handler:           handlers,
+		ReadHeaderTimeout: timeout,
+	}
+	go listener.server.Serve(&requestListener{listener: listener})
+	go listener.acceptConns()
+	return listener, nil
+}
+
+// Accepts connections from a WebSocketTransport's Listener, passing those
+// that start with an HTTP request to an HTTP server that upgrades them and
+// the rest straight to Accept
+type webSocketListener struct {
+	listener net.Listener
+	server   *http.Server
+	accepted chan TransportConn
+	requests chan net.Conn
+	failed   chan error
+	closed   chan struct{}
+	closing  sync.Once
+	logger   *logger
+}
+
+func (listener *webSocketListener) acceptConns() {
+	for {
+		socket, err := listener.listener.Accept()
+		if err != nil {
+			listener.failed <- err
+			return
+		}
+		go listener.sniff(socket)
+	}
+}
+
+// Read the first bytes of a connection to tell an HTTP request from a
+// transport socket, putting them back before passing it on.  Peers that
+// predate the handshake may stay idle before sending anything, so there is
+// no deadline, but the connection is closed if the listener closes first.
+func (listener *webSocketListener) sniff(socket net.Conn) {
+	sniffed := make(chan struct{})
+	go func() {
+		select {
+		case <-listener.closed:
+			socket.Close()
+		case <-sniffed:
+		}
+	}()
+	start := make([]byte, 4)
+	read, err := io.ReadFull(socket, start)
+	close(sniffed)
+	if err != nil {
+		if listener.logger.debugging() {
+			listener.logger.Debug("connection closed before sending anything",
+				"at", "webSocketListener.sniff",
+				"remote", socket.RemoteAddr().String(),
+				"error", err,
+			)
+		}
+		socket.Close()
+		return
+	}
+	replay := &replayConn{
+		Conn:   socket,
+		reader: io.MultiReader(bytes.NewReader(start[:read]), socket),
+	}
+	if !isHTTPRequest(start) {
+		listener.deliver(newFramedConn(replay, peerRoute(socket), false, listener.logger))
+		return
+	}
+	select {
+	case listener.requests <- replay:
+	case <-listener.closed:
+		socket.Close()
+	}
+}
+
+// Check if the first bytes of a connection start an HTTP request
+func isHTTPRequest(start []byte) bool {
+	for _, method := range []string{"GET ", "HEAD", "POST", "PUT ", "DELE", "OPTI", "PATC", "CONN", "TRAC"} {
+		if string(start) == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Upgrade a request to a WebSocket carrying a transport socket
+func (listener *webSocketListener) upgrade(writer http.ResponseWriter, request *http.Request) {
+	conn, err := websocket.Accept(writer, request, nil)
+	if err != nil {
+		if listener.logger.debugging() {
+			listener.logger.Debug("error upgrading request to WebSocket",
+				"at", "webSocketListener.upgrade",
+				"remote", request.RemoteAddr,
+				"error", err,
+			)
+		}
+		return
+	}
+	route, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		route = request.RemoteAddr
+	}
+	socket := websocket.NetConn(context.Background(), conn, websocket.MessageBinary)
+	listener.deliver(newFramedConn(socket, route, false, listener.logger))
+}
+
+// Pass a transport socket to Accept, closing it if the listener closes
+// first
+func (listener *webSocketListener) deliver(conn TransportConn) {
+	select {
+	case listener.accepted <- conn:
+	case <-listener.closed:
+		conn.Close()
+	}
+}
+
+func (listener *webSocketListener) Accept() (TransportConn, error) {
+	select {
+	case conn := <-listener.accepted:
+		return conn, nil
+	case err := <-listener.failed:
+		listener.failed <- err
+		return nil, err
+	}
+}
+
+func (listener *webSocketListener) Close() error {
+	listener.closing.Do(func() {
+		close(listener.closed)
+		listener.server.Close()
+	})
+	return listener.listener.Close()
+}
+
+func (listener *webSocketListener) Addr() net.Addr {
+	return listener.listener.Addr()
+}
+
+// The net.Listener the HTTP server of a webSocketListener serves, handing
+// it the connections that start with an HTTP request
+type requestListener struct {
+	listener *webSocketListener
+}
+
+func (requests *requestListener) Accept() (net.Conn, error) {
+	select {
+	case socket := <-requests.listener.requests:
+		return socket, nil
+	case <-requests.listener.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (requests *requestListener) Close() error {
+	return nil
+}
+
+func (requests *requestListener) Addr() net.Addr {
+	return requests.listener.Addr()
+}
@@ -0,0 +1,81 @@
+package imux
+
+import (
+	"github.com/satori/go.uuid"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWebSocketListenerKeepsIdleLegacyPeers(t *testing.T) {
+	socket_listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &WebSocketTransport{
+		Listener:         socket_listener,
+		HandshakeTimeout: 20 * time.Millisecond,
+	}
+	listener, err := transport.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	peer, err := net.Dial("tcp", socket_listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	time.Sleep(100 * time.Millisecond)
+	if _, err := peer.Write([]byte(`{"a":"session","b":"socket"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan TransportConn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+		remote, err := conn.Negotiate(Hello{
+			Version:      ProtocolVersion,
+			Features:     supportedFeatures,
+			MaxChunkSize: 512,
+			SessionID:    uuid.Nil.String(),
+		}, 20*time.Millisecond)
+		if err != nil || remote.Features != 0 {
+			t.Fatalf("expected the idle peer to be negotiated as a legacy peer, got %+v, %v", remote, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("idle legacy peer was never accepted")
+	}
+}
+
+func TestWebSocketListenerCloseDropsUnsniffedConns(t *testing.T) {
+	socket_listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := (&WebSocketTransport{Listener: socket_listener}).Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := net.Dial("tcp", socket_listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	time.Sleep(20 * time.Millisecond)
+	listener.Close()
+
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected a connection that sent nothing to be closed with the listener, got %v", err)
+	}
+}
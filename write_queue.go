@@ -1,48 +1,220 @@
 package imux
 
 import (
-	log "github.com/Sirupsen/logrus"
+	"errors"
 	"io"
+	"sync"
+	"time"
 )
 
+var errSocketClosed = errors.New("socket has already closed")
+
+// Returned when a chunk arrives for a socket whose destination is still
+// being dialed
+var errSocketOpening = errors.New("socket is still opening")
+
+// Returned when a chunk arrives for a session with no responding DataIMUX
+var errNoResponder = errors.New("no responding reader exists for session")
+
 // A WriteQueue will receive chunks and order them, writing
-// their data out to the Destination in the correct order
+// their data out to the Destination in the correct order,
+// acknowledging them through the acker DataIMUX if it has one.
 type WriteQueue struct {
+	socketID    string
 	destination io.WriteCloser
 	lastDump    int
 	Chunks      chan *Chunk
 	queue       []*Chunk
+	window      uint64
+	redundant   chan *Chunk
+	accepted    map[uint64]bool
+	mux         sync.Mutex
+	parities    map[uint64]*Chunk
+	retained    []*Chunk
+	acker       *DataIMUX
+	owner       *writeQueues
+	done        chan struct{}
+	closed      bool
+	written     uint64
+	failure     error
+	resetErr    error
+	options     *Options
+	logger      *logger
 }
 
+// Create a WriteQueue for destination that does not acknowledge the
+// chunks it receives, with the default Options
 func NewWriteQueue(destination io.WriteCloser) *WriteQueue {
+	return newWriteQueue("", destination, nil, nil)
+}
+
+// Create a WriteQueue for a socket that removes itself from the owner's
+// WriteQueues once it has closed, and is closed when the owner's
+// lifecycle stops.  Chunks is sized to the receive window from the
+// acker's Options, or the default Options without an acker, so a peer
+// that respects the window never finds it full.
+func newWriteQueue(socket_id string, destination io.WriteCloser, acker *DataIMUX, owner *writeQueues) *WriteQueue {
+	defaults := DefaultOptions()
+	options, logger := &defaults, newLogger(nil)
+	if acker != nil {
+		options = acker.options
+		logger = acker.logger
+	}
+	window := options.streamWindow()
 	write_queue := WriteQueue{
+		socketID:    socket_id,
 		destination: destination,
-		Chunks:      make(chan *Chunk, 0),
+		Chunks:      make(chan *Chunk, window),
 		queue:       make([]*Chunk, 0),
+		window:      window,
+		redundant:   make(chan *Chunk, window),
+		accepted:    make(map[uint64]bool),
+		parities:    make(map[uint64]*Chunk),
+		acker:       acker,
+		owner:       owner,
+		done:        make(chan struct{}),
+		options:     options,
+		logger:      logger,
+	}
+	if owner == nil {
+		go write_queue.process()
+	} else if !owner.lifecycle.run(write_queue.process, destination) {
+		write_queue.closed = true
+		destination.Close()
+		close(write_queue.done)
 	}
-	go write_queue.process()
 	return &write_queue
 }
 
+// Pass a chunk to the queue, returning false if the queue has closed.
+// When the peer negotiated flow control, parity chunks and copies of
+// chunks already received are dropped if there is no room for them
+// instead of blocking the transport socket, since the first copy of
+// each chunk in the receive window always has room.
+func (write_queue *WriteQueue) deliver(chunk *Chunk) bool {
+	flow_controlled := write_queue.acker != nil && write_queue.acker.flowControlled()
+	if flow_controlled && chunk.SequenceID != 0 && (chunk.Parity || !write_queue.accept(chunk.SequenceID)) {
+		select {
+		case write_queue.redundant <- chunk:
+		case <-write_queue.done:
+			return false
+		default:
+			if write_queue.logger.debugging() {
+				write_queue.logger.Debug("dropped redundant chunk for full write queue",
+					"at", "WriteQueue.deliver",
+					"sequence_id", chunk.SequenceID,
+					"socket_id", chunk.SocketID,
+				)
+			}
+		}
+		return true
+	}
+	select {
+	case write_queue.Chunks <- chunk:
+		return true
+	case <-write_queue.done:
+		return false
+	}
+}
+
+// Check if a sequence ID is in the receive window and was not received
+// before, recording it as received if so
+func (write_queue *WriteQueue) accept(sequence_id uint64) bool {
+	write_queue.mux.Lock()
+	defer write_queue.mux.Unlock()
+	if sequence_id <= uint64(write_queue.lastDump) || sequence_id > write_queue.credit() || write_queue.accepted[sequence_id] {
+		return false
+	}
+	write_queue.accepted[sequence_id] = true
+	return true
+}
+
+// Process chunks until the queue closes, or bail if the owner's lifecycle
+// stops first
 func (write_queue *WriteQueue) process() {
-	for chunk := range write_queue.Chunks {
-		write_queue.insert(chunk)
-		write_queue.dump()
+	var stop chan struct{}
+	if write_queue.owner != nil {
+		stop = write_queue.owner.lifecycle.done
+	}
+	for {
+		var chunk *Chunk
+		select {
+		case chunk = <-write_queue.Chunks:
+		case chunk = <-write_queue.redundant:
+		case <-stop:
+			write_queue.fail(ErrShutdown)
+			write_queue.bail(write_queue.socketID)
+			return
+		}
+		if chunk.Parity {
+			write_queue.addParity(chunk)
+		} else {
+			write_queue.insert(chunk)
+		}
+		if !write_queue.closed {
+			write_queue.rebuild()
+			write_queue.dump()
+		}
+		write_queue.acknowledge(chunk)
+		if write_queue.closed {
+			return
+		}
 	}
 }
 
-// Place a chunk in the correct location in the queue
+// Reset the queue's socket with the failure the peer reported,
+// releasing its unacknowledged chunks and closing the Destination once
+// the queue reaches the reset
+func (write_queue *WriteQueue) reset(err error) {
+	write_queue.mux.Lock()
+	write_queue.resetErr = err
+	write_queue.mux.Unlock()
+	chunk := &Chunk{
+		SocketID:   write_queue.socketID,
+		SequenceID: 0,
+		Close:      true,
+	}
+	select {
+	case write_queue.Chunks <- chunk:
+	case <-write_queue.done:
+	}
+}
+
+// Place a chunk in the correct location in the queue, dropping chunks
+// already written out or beyond the receive window
 func (write_queue *WriteQueue) insert(chunk *Chunk) {
 	if chunk.SequenceID == 0 {
-		log.WithFields(log.Fields{
-			"socket":  chunk.SocketID,
-			"session": chunk.SessionID,
-		}).Debug("reset chunk received")
+		if write_queue.logger.debugging() {
+			write_queue.logger.Debug("reset chunk received",
+				"socket", chunk.SocketID,
+				"session", chunk.SessionID,
+			)
+		}
+		if write_queue.acker != nil {
+			write_queue.acker.retransmit.release(chunk.SocketID)
+		}
+		write_queue.fail(write_queue.resetFailure())
 		write_queue.bail(chunk.SocketID)
 		return
 	}
+	if chunk.SequenceID <= uint64(write_queue.lastDump) {
+		return
+	}
+	if write_queue.acker != nil && write_queue.acker.flowControlled() && chunk.SequenceID > write_queue.credit() {
+		if write_queue.logger.debugging() {
+			write_queue.logger.Debug("dropped chunk beyond receive window",
+				"at", "WriteQueue.insert",
+				"sequence_id", chunk.SequenceID,
+				"socket_id", chunk.SocketID,
+			)
+		}
+		return
+	}
 	smaller := 0
 	for _, item := range write_queue.queue {
+		if item.SequenceID == chunk.SequenceID {
+			return
+		}
 		if item.SequenceID < chunk.SequenceID {
 			smaller++
 		}
@@ -52,7 +224,8 @@ func (write_queue *WriteQueue) insert(chunk *Chunk) {
 	write_queue.queue = append(smaller_chunks, append([]*Chunk{chunk}, larger_chunks...)...)
 }
 
-// Dump as much chunk data out the Destination as available in order
+// Dump as much chunk data out the Destination as available in order,
+// closing the queue and resetting the socket if a write fails
 func (write_queue *WriteQueue) dump() {
 	for {
 		if len(write_queue.queue) == 0 {
@@ -60,52 +233,344 @@ func (write_queue *WriteQueue) dump() {
 		}
 		chunk := write_queue.queue[0]
 		if chunk.SequenceID == uint64(write_queue.lastDump+1) {
-			log.WithFields(log.Fields{
-				"at":       "WriteQueue.Dump",
-				"sequence": chunk.SequenceID,
-				"socket":   chunk.SocketID,
-				"session":  chunk.SessionID,
-			}).Debug("writing out chunk data")
+			if write_queue.logger.debugging() {
+				write_queue.logger.Debug("writing out chunk data",
+					"at", "WriteQueue.Dump",
+					"sequence", chunk.SequenceID,
+					"socket", chunk.SocketID,
+					"session", chunk.SessionID,
+				)
+			}
 			write_queue.queue = write_queue.queue[1:]
-			_, err := write_queue.destination.Write(chunk.Data)
+			data, err := decompressData(chunk.Compression, chunk.Data, write_queue.maxChunkSize())
+			if err == nil {
+				var written int
+				written, err = write_queue.destination.Write(data)
+				write_queue.written += uint64(written)
+			}
+			write_queue.mux.Lock()
+			write_queue.lastDump = write_queue.lastDump + 1
+			delete(write_queue.accepted, chunk.SequenceID)
+			write_queue.mux.Unlock()
+			write_queue.retain(chunk)
 			if chunk.Close {
-				log.WithFields(log.Fields{
-					"sequence": chunk.SequenceID,
-					"socket":   chunk.SocketID,
-					"session":  chunk.SessionID,
-					"data_len": len(chunk.Data),
-				}).Debug("close chunk")
-				write_queue.bail(chunk.SocketID)
+				if write_queue.logger.debugging() {
+					write_queue.logger.Debug("close chunk",
+						"sequence", chunk.SequenceID,
+						"socket", chunk.SocketID,
+						"session", chunk.SessionID,
+						"data_len", len(chunk.Data),
+					)
+				}
+				write_queue.finish(chunk.SocketID)
 				return
 			}
 			if err != nil {
-				log.WithFields(log.Fields{
-					"at":    "WriteQueue.Dump",
-					"error": err.Error(),
-				}).Warn("error writing data out")
-				if reporter, ok := FailedSocketOuts[chunk.SocketID]; ok {
-					reporter <- true
-				} else {
-					log.WithFields(log.Fields{
-						"at":        "WriteQueue.dump",
-						"socket_id": chunk.SocketID,
-					}).Error("unable to lookup fail socket out channel")
+				write_queue.logger.Warn("error writing data out",
+					"at", "WriteQueue.Dump",
+					"error", err,
+				)
+				stream_err := writeFailure(chunk.SocketID, err)
+				write_queue.fail(stream_err)
+				// The reset is queued before the Destination is closed, so
+				// it reaches the peer ahead of the close that follows
+				if acker := write_queue.acker; acker != nil {
+					acker.reporter.report(stream_err)
+					acker.retransmit.release(chunk.SocketID)
+					acker.resetStream(stream_err.SocketID, stream_err)
 				}
+				write_queue.bail(chunk.SocketID)
+				return
 			}
-			write_queue.lastDump = write_queue.lastDump + 1
 		} else {
 			break
 		}
 	}
 }
 
+// The most data a chunk may carry once decompressed, the chunk size
+// negotiated with the peer or ChunkSize without an acker
+func (write_queue *WriteQueue) maxChunkSize() int {
+	if write_queue.acker != nil {
+		return write_queue.acker.chunkSize()
+	}
+	return write_queue.options.ChunkSize
+}
+
+// Hold a parity chunk until its group has arrived or a chunk is rebuilt
+// from it
+func (write_queue *WriteQueue) addParity(parity *Chunk) {
+	first, last, err := parityRange(parity)
+	if err != nil {
+		write_queue.logger.Warn("dropped parity chunk",
+			"at", "WriteQueue.addParity",
+			"sequence_id", parity.SequenceID,
+			"socket_id", parity.SocketID,
+			"error", err,
+		)
+		return
+	}
+	if last <= uint64(write_queue.lastDump) || first > write_queue.credit() {
+		return
+	}
+	if uint64(len(write_queue.parities)) >= write_queue.window {
+		return
+	}
+	write_queue.parities[first] = parity
+}
+
+// Rebuild any chunk that is the only one missing from a group with a
+// parity chunk, dropping parity chunks that can no longer be used
+func (write_queue *WriteQueue) rebuild() {
+	for first, parity := range write_queue.parities {
+		_, last, _ := parityRange(parity)
+		others := make([]*Chunk, 0, last-first)
+		missing := make([]uint64, 0, 1)
+		usable := true
+		for sequence_id := first; sequence_id <= last; sequence_id++ {
+			if chunk := write_queue.find(sequence_id); chunk != nil {
+				others = append(others, chunk)
+			} else if sequence_id <= uint64(write_queue.lastDump) {
+				usable = false
+				break
+			} else {
+				missing = append(missing, sequence_id)
+			}
+		}
+		if !usable || len(missing) == 0 {
+			delete(write_queue.parities, first)
+			continue
+		}
+		if len(missing) > 1 {
+			continue
+		}
+		delete(write_queue.parities, first)
+		chunk, err := rebuildChunk(parity, others, missing[0])
+		if err != nil {
+			write_queue.logger.Warn("unable to rebuild chunk from parity",
+				"at", "WriteQueue.rebuild",
+				"sequence_id", missing[0],
+				"socket_id", parity.SocketID,
+				"error", err,
+			)
+			continue
+		}
+		if write_queue.logger.debugging() {
+			write_queue.logger.Debug("rebuilt chunk from parity",
+				"at", "WriteQueue.rebuild",
+				"sequence_id", chunk.SequenceID,
+				"socket_id", chunk.SocketID,
+			)
+		}
+		write_queue.accept(chunk.SequenceID)
+		write_queue.insert(chunk)
+	}
+}
+
+// Find a chunk that is queued or retained after being written out
+func (write_queue *WriteQueue) find(sequence_id uint64) *Chunk {
+	for _, chunk := range write_queue.queue {
+		if chunk.SequenceID == sequence_id {
+			return chunk
+		}
+	}
+	for _, chunk := range write_queue.retained {
+		if chunk.SequenceID == sequence_id {
+			return chunk
+		}
+	}
+	return nil
+}
+
+// Keep a chunk that was written out in case a later chunk in its parity
+// group needs to be rebuilt
+func (write_queue *WriteQueue) retain(chunk *Chunk) {
+	if write_queue.acker == nil || !write_queue.acker.parityNegotiated() {
+		return
+	}
+	write_queue.retained = append(write_queue.retained, chunk)
+	if len(write_queue.retained) > maxParityInterval {
+		write_queue.retained = write_queue.retained[1:]
+	}
+}
+
+// Acknowledge every chunk written out so far, along with any
+// chunks waiting in the queue for earlier chunks to arrive
+func (write_queue *WriteQueue) acknowledge(chunk *Chunk) {
+	if chunk.SequenceID == 0 || write_queue.acker == nil || !write_queue.acker.acknowledging() {
+		return
+	}
+	selective := make([]uint64, 0, len(write_queue.queue))
+	for _, item := range write_queue.queue {
+		if len(selective) == maxSelectiveAcks {
+			break
+		}
+		selective = append(selective, item.SequenceID)
+	}
+	write_queue.acker.queueAck(Ack{
+		SessionID:  chunk.SessionID,
+		SocketID:   chunk.SocketID,
+		Cumulative: uint64(write_queue.lastDump),
+		Selective:  selective,
+		Window:     write_queue.credit(),
+	})
+}
+
+// The highest sequence ID that fits in the receive window
+func (write_queue *WriteQueue) credit() uint64 {
+	return uint64(write_queue.lastDump) + write_queue.window
+}
+
+// Close the Destination after the peer finished writing to it, shutting
+// down only its write side if half-close was negotiated
+func (write_queue *WriteQueue) finish(socket_id string) {
+	if write_queue.acker != nil && write_queue.acker.halfClosing() {
+		if closer, ok := write_queue.destination.(halfCloser); ok {
+			write_queue.shutdown(socket_id, closer.CloseWrite)
+			return
+		}
+	}
+	write_queue.bail(socket_id)
+}
+
 func (write_queue *WriteQueue) bail(socket_id string) {
-	write_queue.destination.Close()
-	close(write_queue.Chunks)
-	swqMux.Lock()
-	delete(server_write_queues, socket_id)
-	swqMux.Unlock()
-	cwqMux.Lock()
-	delete(client_write_queues, socket_id)
-	cwqMux.Unlock()
+	write_queue.shutdown(socket_id, write_queue.destination.Close)
+}
+
+// Stop writing to the Destination, closing it with closer, remove the
+// queue from its owner and tell the acker's observer how many bytes were
+// written
+func (write_queue *WriteQueue) shutdown(socket_id string, closer func() error) {
+	if write_queue.closed {
+		return
+	}
+	write_queue.closed = true
+	closer()
+	close(write_queue.done)
+	if write_queue.owner != nil {
+		write_queue.owner.remove(socket_id, write_queue)
+	}
+	if write_queue.acker != nil {
+		write_queue.acker.reporter.observer.StreamClosed(StreamEvent{
+			SessionID: write_queue.acker.SessionID,
+			SocketID:  socket_id,
+			Bytes:     write_queue.written,
+			Err:       write_queue.failure,
+		})
+	}
+}
+
+// The failure the peer reset the queue's socket with, or ErrStreamReset
+// if it sent a reset chunk without one
+func (write_queue *WriteQueue) resetFailure() error {
+	write_queue.mux.Lock()
+	defer write_queue.mux.Unlock()
+	if write_queue.resetErr == nil {
+		return ErrStreamReset
+	}
+	return write_queue.resetErr
+}
+
+// Remember the first error that ended the queue's socket
+func (write_queue *WriteQueue) fail(err error) {
+	if write_queue.failure == nil {
+		write_queue.failure = err
+	}
+}
+
+// The WriteQueues of a Client or Server by socket ID, along with the
+// sockets whose WriteQueue has closed.  Chunks that arrive for closed
+// sockets late, such as retransmissions of chunks whose acknowledgement
+// was lost, are acknowledged and dropped instead of opening the socket
+// again.  Closed sockets are remembered for memory.  Sockets whose
+// destination is still being dialed in the background are opening.
+type writeQueues struct {
+	queues    map[string]*WriteQueue
+	closed    map[string]time.Time
+	opening   map[string]bool
+	memory    time.Duration
+	mux       sync.Mutex
+	lifecycle *lifecycle
+}
+
+func newWriteQueues(lifecycle *lifecycle, memory time.Duration) *writeQueues {
+	return &writeQueues{
+		queues:    make(map[string]*WriteQueue),
+		closed:    make(map[string]time.Time),
+		opening:   make(map[string]bool),
+		memory:    memory,
+		lifecycle: lifecycle,
+	}
+}
+
+// Get the WriteQueue for a socket
+func (write_queues *writeQueues) get(socket_id string) (*WriteQueue, bool) {
+	write_queues.mux.Lock()
+	defer write_queues.mux.Unlock()
+	queue, ok := write_queues.queues[socket_id]
+	return queue, ok
+}
+
+// Add the WriteQueue for a socket
+func (write_queues *writeQueues) add(socket_id string, queue *WriteQueue) {
+	write_queues.mux.Lock()
+	write_queues.queues[socket_id] = queue
+	write_queues.mux.Unlock()
+}
+
+// Check if every WriteQueue has closed
+func (write_queues *writeQueues) empty() bool {
+	write_queues.mux.Lock()
+	defer write_queues.mux.Unlock()
+	return len(write_queues.queues) == 0
+}
+
+// Remove a socket's WriteQueue after it closed, remembering the socket
+func (write_queues *writeQueues) remove(socket_id string, queue *WriteQueue) {
+	write_queues.mux.Lock()
+	defer write_queues.mux.Unlock()
+	if write_queues.queues[socket_id] == queue {
+		delete(write_queues.queues, socket_id)
+	}
+	write_queues.markClosedLocked(socket_id)
+}
+
+// Remember that a socket has closed
+func (write_queues *writeQueues) markClosed(socket_id string) {
+	write_queues.mux.Lock()
+	write_queues.markClosedLocked(socket_id)
+	write_queues.mux.Unlock()
+}
+
+// Remember that a socket has closed, forgetting sockets that closed long
+// enough ago.  The caller must hold mux.
+func (write_queues *writeQueues) markClosedLocked(socket_id string) {
+	now := time.Now()
+	for closed_id, closed_at := range write_queues.closed {
+		if now.Sub(closed_at) > write_queues.memory {
+			delete(write_queues.closed, closed_id)
+		}
+	}
+	write_queues.closed[socket_id] = now
+}
+
+// Check if a socket has recently closed
+func (write_queues *writeQueues) isClosed(socket_id string) bool {
+	write_queues.mux.Lock()
+	defer write_queues.mux.Unlock()
+	_, closed := write_queues.closed[socket_id]
+	return closed
+}
+
+// Acknowledge a chunk that arrived for a socket that has already closed,
+// so the peer stops retransmitting it
+func acknowledgeClosed(acker *DataIMUX, chunk *Chunk) {
+	if acker == nil || chunk.SequenceID == 0 || chunk.Parity || !acker.acknowledging() {
+		return
+	}
+	acker.queueAck(Ack{
+		SessionID:  chunk.SessionID,
+		SocketID:   chunk.SocketID,
+		Cumulative: chunk.SequenceID,
+	})
 }
@@ -0,0 +1,135 @@
+package imux
+
+import (
+	"errors"
+	"github.com/satori/go.uuid"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errDestinationFull = errors.New("destination is full")
+
+// A destination whose writes fail, counting writes and closes
+type failingDestination struct {
+	writes int32
+	closes int32
+}
+
+func (destination *failingDestination) Write(data []byte) (int, error) {
+	atomic.AddInt32(&destination.writes, 1)
+	return 0, errDestinationFull
+}
+
+func (destination *failingDestination) Close() error {
+	atomic.AddInt32(&destination.closes, 1)
+	return nil
+}
+
+// Passes the streams closed to a channel, dropping them once it is full
+type streamClosedRecorder struct {
+	NopObserver
+	closed chan StreamEvent
+}
+
+func (observer *streamClosedRecorder) StreamClosed(event StreamEvent) {
+	select {
+	case observer.closed <- event:
+	default:
+	}
+}
+
+func TestWriteQueueClosesAfterWriteFailure(t *testing.T) {
+	options := DefaultOptions()
+	lifecycle := newLifecycle()
+	defer lifecycle.stop()
+	failures := make(chan error, 8)
+	acker := newDataIMUX(uuid.NewV4().String(), &options, lifecycle, newLogger(nil), newReporter(failures), newPipeline())
+	observer := &streamClosedRecorder{closed: make(chan StreamEvent, 1)}
+	acker.reporter.use(observer)
+	acker.negotiated(supportedFeatures)
+	owner := newWriteQueues(lifecycle, time.Minute)
+	destination := &failingDestination{}
+	socket_id := uuid.NewV4().String()
+	write_queue := newWriteQueue(socket_id, destination, acker, owner)
+	owner.add(socket_id, write_queue)
+
+	for sequence := uint64(1); sequence <= 3; sequence++ {
+		write_queue.deliver(&Chunk{
+			SessionID:  acker.SessionID,
+			SocketID:   socket_id,
+			SequenceID: sequence,
+			Data:       []byte("data"),
+		})
+	}
+	select {
+	case event := <-observer.closed:
+		var stream_err *StreamError
+		if !errors.As(event.Err, &stream_err) || stream_err.Code != ResetWriteFailed {
+			t.Fatalf("expected the stream to close with a write failure, closed with %v", event.Err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write queue did not close after its destination failed")
+	}
+	select {
+	case control := <-acker.Controls:
+		if control.Type != ControlReset || control.Code != ResetWriteFailed {
+			t.Fatalf("expected a write failed reset, queued %+v", control)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("peer was not told the stream was reset")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if writes := atomic.LoadInt32(&destination.writes); writes != 1 {
+		t.Fatalf("expected one write to the failed destination, wrote %d times", writes)
+	}
+	if closes := atomic.LoadInt32(&destination.closes); closes != 1 {
+		t.Fatalf("expected the destination to be closed once, closed %d times", closes)
+	}
+	if len(failures) != 1 || len(acker.Controls) != 0 {
+		t.Fatalf("expected one failure reported and one reset, reported %d and queued %d more resets", len(failures), len(acker.Controls))
+	}
+	if !owner.empty() || !owner.isClosed(socket_id) {
+		t.Fatal("expected the write queue to be removed from its owner")
+	}
+}
+
+func TestWriteQueueReceiveWindow(t *testing.T) {
+	options := DefaultOptions()
+	options.ChunkSize = 1024
+	options.StreamWindowSize = 8 * 1024
+	lifecycle := newLifecycle()
+	defer lifecycle.stop()
+	acker := newDataIMUX(uuid.NewV4().String(), &options, lifecycle, newLogger(nil), newReporter(nil), newPipeline())
+	acker.negotiated(supportedFeatures)
+	destination := &bufferDestination{}
+	write_queue := newWriteQueue(uuid.NewV4().String(), destination, acker, newWriteQueues(lifecycle, time.Minute))
+	if cap(write_queue.Chunks) != 8 {
+		t.Fatalf("expected room for a window of 8 chunks, have room for %d", cap(write_queue.Chunks))
+	}
+	if write_queue.accept(9) {
+		t.Fatal("expected a chunk past the window to be refused")
+	}
+	if !write_queue.accept(8) || write_queue.accept(8) {
+		t.Fatal("expected the last chunk in the window to be accepted once")
+	}
+
+	write_queue.deliver(&Chunk{
+		SessionID:  acker.SessionID,
+		SocketID:   write_queue.socketID,
+		SequenceID: 1,
+		Data:       []byte("first"),
+	})
+	select {
+	case ack := <-acker.Acks:
+		if ack.Cumulative != 1 || ack.Window != 9 {
+			t.Fatalf("expected chunk 1 acknowledged with the window moved to 9, got %+v", ack)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("chunk was never acknowledged")
+	}
+	if !write_queue.accept(9) {
+		t.Fatal("expected the window to move past the chunk written out")
+	}
+}